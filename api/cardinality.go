@@ -0,0 +1,192 @@
+package api
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// OtherValue replaces label values beyond the cardinality limit.
+const OtherValue = "__other__"
+
+// Cardinality overflow behaviours.
+const (
+	// OverflowOther replaces new values beyond the limit with OtherValue.
+	OverflowOther = "other"
+	// OverflowReject rejects events with new values beyond the limit.
+	OverflowReject = "reject"
+)
+
+// CardinalityLimit bounds the number of distinct values per label.
+// MaxValuesPerLabel applies to every label (0 = unlimited), Labels overrides it
+// for single labels. Overflow is OverflowOther (default) or OverflowReject.
+type CardinalityLimit struct {
+	MaxValuesPerLabel int
+	Labels            map[string]int
+	Overflow          string
+}
+
+// LabelCardinality is the state of a single label.
+type LabelCardinality struct {
+	Values     int    `json:"values"`
+	Limit      int    `json:"limit"`
+	Overflowed uint64 `json:"overflowed"`
+}
+
+// CardinalityLimiter tracks the distinct values seen per label. Values are kept in
+// a set bounded by the limit, so memory stays bounded too. It is safe for concurrent use.
+type CardinalityLimiter struct {
+	limit CardinalityLimit
+
+	mu         sync.Mutex
+	seen       map[string]map[string]struct{}
+	overflowed map[string]uint64
+}
+
+// CardinalityError is returned by Limit for rejected events.
+type CardinalityError struct {
+	Labels []string
+}
+
+func (e *CardinalityError) Error() string {
+	return fmt.Sprintf("cardinality limit reached for labels: %s", strings.Join(e.Labels, ", "))
+}
+
+// NewCardinalityLimiter validates the limit and returns an empty limiter.
+func NewCardinalityLimiter(limit CardinalityLimit) (*CardinalityLimiter, error) {
+	switch limit.Overflow {
+	case "":
+		limit.Overflow = OverflowOther
+	case OverflowOther, OverflowReject:
+	default:
+		return nil, fmt.Errorf("unknown overflow '%s', expected other or reject", limit.Overflow)
+	}
+	if limit.MaxValuesPerLabel < 0 {
+		return nil, fmt.Errorf("maxValuesPerLabel must not be negative")
+	}
+	for label, max := range limit.Labels {
+		if max < 0 {
+			return nil, fmt.Errorf("limit for label '%s' must not be negative", label)
+		}
+	}
+	return &CardinalityLimiter{
+		limit:      limit,
+		seen:       make(map[string]map[string]struct{}),
+		overflowed: make(map[string]uint64),
+	}, nil
+}
+
+func (l *CardinalityLimiter) limitFor(label string) int {
+	if max, ok := l.limit.Labels[label]; ok {
+		return max
+	}
+	return l.limit.MaxValuesPerLabel
+}
+
+// Limit returns the labels with values beyond the limit replaced by OtherValue.
+// With OverflowReject it returns a CardinalityError instead and records nothing.
+func (l *CardinalityLimiter) Limit(labels map[string]string) (map[string]string, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.check([]map[string]string{labels}); err != nil {
+		return nil, err
+	}
+	return l.commit(labels), nil
+}
+
+// Check returns a CardinalityError with OverflowReject if the label sets of an
+// event together have new values beyond the limit, without recording them. Events
+// with several samples are checked as a whole before their samples are committed,
+// so a rejected event uses up no values. With OverflowOther it never fails.
+func (l *CardinalityLimiter) Check(labelSets ...map[string]string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.check(labelSets)
+}
+
+// Commit records the values of labels checked with Check and returns the labels
+// with values beyond the limit replaced by OtherValue. With OverflowReject this
+// only happens if a concurrent event used up the limit since the check.
+func (l *CardinalityLimiter) Commit(labels map[string]string) map[string]string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.commit(labels)
+}
+
+func (l *CardinalityLimiter) check(labelSets []map[string]string) error {
+	if l.limit.Overflow != OverflowReject {
+		return nil
+	}
+	added := make(map[string]map[string]struct{})
+	for _, labels := range labelSets {
+		for label, value := range labels {
+			if l.limitFor(label) == 0 {
+				continue
+			}
+			if _, ok := l.seen[label][value]; ok {
+				continue
+			}
+			if added[label] == nil {
+				added[label] = make(map[string]struct{})
+			}
+			added[label][value] = struct{}{}
+		}
+	}
+	var overflowing []string
+	for label, values := range added {
+		if len(l.seen[label])+len(values) > l.limitFor(label) {
+			overflowing = append(overflowing, label)
+		}
+	}
+	if len(overflowing) == 0 {
+		return nil
+	}
+	sort.Strings(overflowing)
+	for _, label := range overflowing {
+		l.overflowed[label]++
+	}
+	return &CardinalityError{Labels: overflowing}
+}
+
+func (l *CardinalityLimiter) commit(labels map[string]string) map[string]string {
+	limited := make(map[string]string, len(labels))
+	for label, value := range labels {
+		limited[label] = value
+		max := l.limitFor(label)
+		if max == 0 {
+			continue
+		}
+		values, ok := l.seen[label]
+		if !ok {
+			values = make(map[string]struct{})
+			l.seen[label] = values
+		}
+		if _, ok := values[value]; ok {
+			continue
+		}
+		if len(values) >= max {
+			limited[label] = OtherValue
+			l.overflowed[label]++
+			continue
+		}
+		values[value] = struct{}{}
+	}
+	return limited
+}
+
+// Status returns the current cardinality of every limited label.
+func (l *CardinalityLimiter) Status() map[string]LabelCardinality {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	status := make(map[string]LabelCardinality, len(l.seen))
+	for label, values := range l.seen {
+		status[label] = LabelCardinality{
+			Values:     len(values),
+			Limit:      l.limitFor(label),
+			Overflowed: l.overflowed[label],
+		}
+	}
+	return status
+}
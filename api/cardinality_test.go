@@ -0,0 +1,118 @@
+package api
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCardinalityLimiterOther(t *testing.T) {
+	limiter, err := NewCardinalityLimiter(CardinalityLimit{
+		MaxValuesPerLabel: 2,
+		Labels:            map[string]int{"state": 0},
+	})
+	assert.NoError(t, err)
+
+	events := []struct {
+		labels   map[string]string
+		expected map[string]string
+	}{
+		{map[string]string{"commit": "a", "state": "FINISHED"}, map[string]string{"commit": "a", "state": "FINISHED"}},
+		{map[string]string{"commit": "b", "state": "FAILED"}, map[string]string{"commit": "b", "state": "FAILED"}},
+		{map[string]string{"commit": "c", "state": "QUEUED"}, map[string]string{"commit": OtherValue, "state": "QUEUED"}},
+		{map[string]string{"commit": "a", "state": "PLANNING"}, map[string]string{"commit": "a", "state": "PLANNING"}},
+	}
+	for _, e := range events {
+		limited, err := limiter.Limit(e.labels)
+		assert.NoError(t, err)
+		assert.Equal(t, e.expected, limited)
+	}
+
+	assert.Equal(t, map[string]LabelCardinality{
+		"commit": {Values: 2, Limit: 2, Overflowed: 1},
+	}, limiter.Status())
+}
+
+func TestCardinalityLimiterReject(t *testing.T) {
+	limiter, err := NewCardinalityLimiter(CardinalityLimit{
+		Labels:   map[string]int{"commit": 1, "branch": 1},
+		Overflow: OverflowReject,
+	})
+	assert.NoError(t, err)
+
+	_, err = limiter.Limit(map[string]string{"commit": "a", "branch": "main"})
+	assert.NoError(t, err)
+
+	_, err = limiter.Limit(map[string]string{"commit": "b", "branch": "main"})
+	var cardinalityErr *CardinalityError
+	assert.ErrorAs(t, err, &cardinalityErr)
+	assert.Equal(t, []string{"commit"}, cardinalityErr.Labels)
+
+	_, err = limiter.Limit(map[string]string{"commit": "a", "branch": "dev"})
+	assert.ErrorContains(t, err, "branch")
+
+	// Rejected events record nothing
+	status := limiter.Status()
+	assert.Equal(t, 1, status["commit"].Values)
+	assert.Equal(t, uint64(1), status["commit"].Overflowed)
+	assert.Equal(t, 1, status["branch"].Values)
+}
+
+func TestCardinalityLimiterCheckCommit(t *testing.T) {
+	limiter, err := NewCardinalityLimiter(CardinalityLimit{
+		Labels:   map[string]int{"commit": 2},
+		Overflow: OverflowReject,
+	})
+	assert.NoError(t, err)
+
+	// The samples of an event are checked together
+	err = limiter.Check(map[string]string{"commit": "a"}, map[string]string{"commit": "b"}, map[string]string{"commit": "c"})
+	assert.ErrorContains(t, err, "commit")
+	assert.Equal(t, map[string]LabelCardinality{}, limiter.Status(), "a rejected event records nothing")
+
+	assert.NoError(t, limiter.Check(map[string]string{"commit": "a"}, map[string]string{"commit": "b"}))
+	assert.Equal(t, map[string]string{"commit": "a"}, limiter.Commit(map[string]string{"commit": "a"}))
+	assert.Equal(t, map[string]string{"commit": "b"}, limiter.Commit(map[string]string{"commit": "b"}))
+	assert.Equal(t, LabelCardinality{Values: 2, Limit: 2, Overflowed: 1}, limiter.Status()["commit"])
+
+	assert.NoError(t, limiter.Check(map[string]string{"commit": "a"}), "known values pass")
+	assert.Error(t, limiter.Check(map[string]string{"commit": "c"}))
+}
+
+func TestCardinalityLimiterLabelCase(t *testing.T) {
+	limiter, err := NewCardinalityLimiter(CardinalityLimit{Labels: map[string]int{"commit_issueId": 1}})
+	assert.NoError(t, err)
+
+	_, err = limiter.Limit(map[string]string{"commit_issueId": "INFRA-1", "commit_issueid": "INFRA-1"})
+	assert.NoError(t, err)
+	limited, err := limiter.Limit(map[string]string{"commit_issueId": "INFRA-2", "commit_issueid": "INFRA-2"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"commit_issueId": OtherValue, "commit_issueid": "INFRA-2"}, limited, "label names are case-sensitive")
+}
+
+func TestCardinalityLimiterConcurrent(t *testing.T) {
+	limiter, err := NewCardinalityLimiter(CardinalityLimit{MaxValuesPerLabel: 10})
+	assert.NoError(t, err)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := limiter.Limit(map[string]string{"run": string(rune('a' + i%26))})
+			assert.NoError(t, err)
+		}(i)
+	}
+	wg.Wait()
+	assert.Equal(t, 10, limiter.Status()["run"].Values)
+}
+
+func TestNewCardinalityLimiterErrors(t *testing.T) {
+	_, err := NewCardinalityLimiter(CardinalityLimit{Overflow: "drop"})
+	assert.ErrorContains(t, err, "unknown overflow 'drop'")
+	_, err = NewCardinalityLimiter(CardinalityLimit{MaxValuesPerLabel: -1})
+	assert.ErrorContains(t, err, "must not be negative")
+	_, err = NewCardinalityLimiter(CardinalityLimit{Labels: map[string]int{"commit": -1}})
+	assert.ErrorContains(t, err, "label 'commit'")
+}
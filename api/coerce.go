@@ -0,0 +1,206 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// timeLayouts maps well known layout names to their Go layout, so configs can say "RFC3339" instead of spelling it out.
+var timeLayouts = map[string]string{
+	"RFC3339":     time.RFC3339,
+	"RFC3339Nano": time.RFC3339Nano,
+	"RFC1123":     time.RFC1123,
+	"DateTime":    time.DateTime,
+	"DateOnly":    time.DateOnly,
+	"TimeOnly":    time.TimeOnly,
+}
+
+// validateType reports unknown field types, so typos fail at config load.
+func validateType(typ string) error {
+	switch typ {
+	case "", "string", "int", "float", "bool", "duration", "unix_s", "unix_ms", "unix_ns":
+		return nil
+	}
+	return fmt.Errorf("unsupported type '%s'", typ)
+}
+
+// validateFormat reports formats that cannot render values of typ, so they fail at
+// config load instead of producing labels like %!f(string=...). A format needs a
+// type, and its fmt verb must fit the type. Time layouts are not checked.
+func validateFormat(typ string, format string) error {
+	if format == "" {
+		return nil
+	}
+	var sample interface{}
+	switch typ {
+	case "":
+		return fmt.Errorf("format '%s' needs a type", format)
+	case "unix_s", "unix_ms", "unix_ns":
+		return nil
+	case "string":
+		sample = ""
+	case "int":
+		sample = int64(0)
+	case "float":
+		sample = float64(0)
+	case "bool":
+		sample = false
+	case "duration":
+		sample = time.Duration(0)
+	}
+	if rendered := fmt.Sprintf(format, sample); strings.Contains(rendered, "%!") {
+		return fmt.Errorf("format '%s' does not fit type %s: %s", format, typ, rendered)
+	}
+	return nil
+}
+
+// coerceValue converts an extracted value into the requested type.
+// An empty type leaves the value untouched. If format is set, the converted value is
+// rendered into a string: a Go time layout (or layout name) for the unix_* types,
+// a fmt verb such as "%.2f" for everything else.
+func coerceValue(value interface{}, typ string, format string) (interface{}, error) {
+	var (
+		converted interface{}
+		err       error
+	)
+	switch typ {
+	case "":
+		converted = value
+	case "string":
+		converted = FormatValue(value)
+	case "int":
+		converted, err = toInt64(value)
+	case "float":
+		converted, err = toFloat64(value)
+	case "bool":
+		converted, err = toBool(value)
+	case "duration":
+		converted, err = toDuration(value)
+	case "unix_s", "unix_ms", "unix_ns":
+		converted, err = toTime(value, typ)
+	default:
+		return nil, fmt.Errorf("unsupported type '%s'", typ)
+	}
+	if err != nil || format == "" {
+		return converted, err
+	}
+
+	if t, ok := converted.(time.Time); ok {
+		if layout, ok := timeLayouts[format]; ok {
+			format = layout
+		}
+		return t.Format(format), nil
+	}
+	return fmt.Sprintf(format, converted), nil
+}
+
+// FormatValue renders an extracted value as a string suitable for a label value.
+// Numbers are written without exponent, timestamps as RFC3339.
+func FormatValue(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case float32:
+		return strconv.FormatFloat(float64(v), 'f', -1, 32)
+	case time.Time:
+		return v.Format(time.RFC3339)
+	default:
+		return fmt.Sprintf("%v", v)
+	}
+}
+
+func toInt64(value interface{}) (int64, error) {
+	switch v := value.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i, nil
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return 0, err
+		}
+		return floatToInt64(f)
+	case float64:
+		return floatToInt64(v)
+	case int:
+		return int64(v), nil
+	case int64:
+		return v, nil
+	case string:
+		return strconv.ParseInt(v, 10, 64)
+	}
+	return 0, fmt.Errorf("cannot convert %T to int", value)
+}
+
+// floatToInt64 converts f if it is an integer within the range of int64.
+func floatToInt64(f float64) (int64, error) {
+	// -2^63 is exactly representable, 2^63 is the first float beyond the range
+	if f != math.Trunc(f) || f < math.MinInt64 || f >= math.MaxInt64 {
+		return 0, fmt.Errorf("%v is not an integer within the range of int64", f)
+	}
+	return int64(f), nil
+}
+
+func toFloat64(value interface{}) (float64, error) {
+	switch v := value.(type) {
+	case json.Number:
+		return v.Float64()
+	case float64:
+		return v, nil
+	case int:
+		return float64(v), nil
+	case int64:
+		return float64(v), nil
+	case string:
+		return strconv.ParseFloat(v, 64)
+	}
+	return 0, fmt.Errorf("cannot convert %T to float", value)
+}
+
+func toBool(value interface{}) (bool, error) {
+	switch v := value.(type) {
+	case bool:
+		return v, nil
+	case string:
+		return strconv.ParseBool(v)
+	}
+	return false, fmt.Errorf("cannot convert %T to bool", value)
+}
+
+// toDuration parses Go duration strings like "1m30s"; plain numbers are taken as seconds.
+func toDuration(value interface{}) (time.Duration, error) {
+	if s, ok := value.(string); ok {
+		if d, err := time.ParseDuration(s); err == nil {
+			return d, nil
+		}
+	}
+	seconds, err := toFloat64(value)
+	if err != nil {
+		return 0, fmt.Errorf("cannot convert %v to duration", value)
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// toTime interprets a number as a unix timestamp in seconds, milliseconds or nanoseconds.
+func toTime(value interface{}, typ string) (time.Time, error) {
+	epoch, err := toInt64(value)
+	if err != nil {
+		return time.Time{}, err
+	}
+	switch typ {
+	case "unix_s":
+		return time.Unix(epoch, 0).UTC(), nil
+	case "unix_ms":
+		return time.UnixMilli(epoch).UTC(), nil
+	default:
+		return time.Unix(0, epoch).UTC(), nil
+	}
+}
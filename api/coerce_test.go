@@ -0,0 +1,73 @@
+package api
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCoerceValue(t *testing.T) {
+	tests := []struct {
+		name          string
+		value         interface{}
+		typ           string
+		format        string
+		expected      interface{}
+		expectedError bool
+	}{
+		{name: "no type", value: json.Number("42"), expected: json.Number("42")},
+		{name: "large int stays exact", value: json.Number("1742103798000000001"), typ: "int", expected: int64(1742103798000000001)},
+		{name: "int from string", value: "17", typ: "int", expected: int64(17)},
+		{name: "int from garbage", value: "abc", typ: "int", expectedError: true},
+		{name: "int from integral float", value: json.Number("1.7e3"), typ: "int", expected: int64(1700)},
+		{name: "int from fraction", value: json.Number("1.5"), typ: "int", expectedError: true},
+		{name: "int from float64 fraction", value: 2.25, typ: "int", expectedError: true},
+		{name: "int overflow", value: json.Number("1e19"), typ: "int", expectedError: true},
+		{name: "int from float64 overflow", value: -1e19, typ: "int", expectedError: true},
+		{name: "float", value: json.Number("1.5"), typ: "float", expected: 1.5},
+		{name: "float with format", value: json.Number("1.2345"), typ: "float", format: "%.2f", expected: "1.23"},
+		{name: "bool from string", value: "true", typ: "bool", expected: true},
+		{name: "bool from number", value: json.Number("1"), typ: "bool", expectedError: true},
+		{name: "string from number", value: json.Number("1742103798000000001"), typ: "string", expected: "1742103798000000001"},
+		{name: "duration string", value: "1m30s", typ: "duration", expected: 90 * time.Second},
+		{name: "duration seconds", value: json.Number("2.5"), typ: "duration", expected: 2500 * time.Millisecond},
+		{name: "unix seconds", value: json.Number("1742103798"), typ: "unix_s", expected: time.Date(2025, 3, 16, 5, 43, 18, 0, time.UTC)},
+		{name: "unix millis rfc3339", value: json.Number("1742103798000"), typ: "unix_ms", format: "RFC3339", expected: "2025-03-16T05:43:18Z"},
+		{name: "unix nanos go layout", value: json.Number("1742103798000000001"), typ: "unix_ns", format: "2006-01-02 15:04:05.000000000", expected: "2025-03-16 05:43:18.000000001"},
+		{name: "unknown type", value: "x", typ: "uuid", expectedError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := coerceValue(tt.value, tt.typ, tt.format)
+			if tt.expectedError {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, result)
+		})
+	}
+}
+
+func TestFormatValue(t *testing.T) {
+	assert.Equal(t, "1742103798000000001", FormatValue(json.Number("1742103798000000001")))
+	assert.Equal(t, "1742103798000000000", FormatValue(float64(1742103798000000001)))
+	assert.Equal(t, "0.25", FormatValue(0.25))
+	assert.Equal(t, "true", FormatValue(true))
+	assert.Equal(t, "2025-03-16T05:43:18Z", FormatValue(time.Date(2025, 3, 16, 5, 43, 18, 0, time.UTC)))
+}
+
+func TestValidateFormat(t *testing.T) {
+	assert.NoError(t, validateFormat("", ""))
+	assert.NoError(t, validateFormat("float", "%.2f"))
+	assert.NoError(t, validateFormat("int", "%05d"))
+	assert.NoError(t, validateFormat("duration", "%s"))
+	assert.NoError(t, validateFormat("unix_s", "RFC3339"))
+	assert.ErrorContains(t, validateFormat("", "%.2f"), "format '%.2f' needs a type")
+	assert.ErrorContains(t, validateFormat("string", "%d"), "format '%d' does not fit type string")
+	assert.ErrorContains(t, validateFormat("float", "%.2f %s"), "does not fit type float")
+	assert.ErrorContains(t, validateFormat("bool", "yes"), "does not fit type bool")
+}
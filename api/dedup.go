@@ -0,0 +1,150 @@
+package api
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Deduplication identifies repeated deliveries of a webhook. The idempotency key is
+// the value of Header, e.g. a delivery ID, or, without that header, the values of
+// Paths combined, e.g. $.run.id and $.state. Keys are remembered for TTL (default 1h),
+// at most MaxEntries (default 10000) at a time. Without Header and Paths nothing is
+// deduplicated.
+type Deduplication struct {
+	Header     string
+	Paths      []string
+	TTL        time.Duration
+	MaxEntries int
+}
+
+// Enabled reports whether an idempotency key is configured.
+func (d Deduplication) Enabled() bool {
+	return d.Header != "" || len(d.Paths) > 0
+}
+
+// Deduplicator remembers idempotency keys in a cache bounded by TTL and size.
+// Keys expire in the order they were claimed, so the oldest are dropped first when
+// the cache is full. It is safe for concurrent use.
+type Deduplicator struct {
+	header     string
+	paths      []*JSONPath
+	ttl        time.Duration
+	maxEntries int
+
+	// claims indexes the elements of order, which lists the claims oldest first
+	mu     sync.Mutex
+	claims map[string]*list.Element
+	order  *list.List
+}
+
+type claim struct {
+	key     string
+	expires time.Time
+}
+
+// NewDeduplicator compiles the paths. All invalid paths are reported together.
+func NewDeduplicator(d Deduplication) (*Deduplicator, error) {
+	if d.TTL < 0 {
+		return nil, fmt.Errorf("ttl must not be negative")
+	}
+	if d.MaxEntries < 0 {
+		return nil, fmt.Errorf("maxEntries must not be negative")
+	}
+	if d.TTL == 0 {
+		d.TTL = time.Hour
+	}
+	if d.MaxEntries == 0 {
+		d.MaxEntries = 10000
+	}
+	dedup := &Deduplicator{
+		header:     d.Header,
+		ttl:        d.TTL,
+		maxEntries: d.MaxEntries,
+		claims:     make(map[string]*list.Element),
+		order:      list.New(),
+	}
+	var errs []error
+	for i, path := range d.Paths {
+		compiled, err := CompileJSONPath(path)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("path %d: %v", i, err))
+			continue
+		}
+		dedup.paths = append(dedup.paths, compiled)
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return dedup, nil
+}
+
+// Key returns the idempotency key of a delivery. found is false if the header is
+// missing and one of the paths has no value, such deliveries are not deduplicated.
+func (d *Deduplicator) Key(header http.Header, document interface{}) (key string, found bool) {
+	if d.header != "" {
+		if value := header.Get(d.header); value != "" {
+			return "header:" + value, true
+		}
+	}
+	if len(d.paths) == 0 {
+		return "", false
+	}
+	values := make([]string, len(d.paths))
+	for i, path := range d.paths {
+		value, ok := path.Lookup(document)
+		if !ok || value == nil {
+			return "", false
+		}
+		values[i] = fmt.Sprint(value)
+	}
+	return "paths:" + strings.Join(values, "\x1f"), true
+}
+
+// Claim remembers key and reports true, or false if the key was claimed before and
+// has not expired yet, i.e. the delivery is a duplicate.
+func (d *Deduplicator) Claim(key string, now time.Time) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.expire(now)
+	if _, ok := d.claims[key]; ok {
+		return false
+	}
+	for len(d.claims) >= d.maxEntries {
+		d.remove(d.order.Front())
+	}
+	d.claims[key] = d.order.PushBack(claim{key: key, expires: now.Add(d.ttl)})
+	return true
+}
+
+// Release forgets a claimed key, so a retry of a delivery that could not be
+// accepted is not taken for a duplicate.
+func (d *Deduplicator) Release(key string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if element, ok := d.claims[key]; ok {
+		d.remove(element)
+	}
+}
+
+// Len returns the number of remembered keys.
+func (d *Deduplicator) Len() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.claims)
+}
+
+// expire drops the keys expired at now.
+func (d *Deduplicator) expire(now time.Time) {
+	for front := d.order.Front(); front != nil && !now.Before(front.Value.(claim).expires); front = d.order.Front() {
+		d.remove(front)
+	}
+}
+
+func (d *Deduplicator) remove(element *list.Element) {
+	delete(d.claims, d.order.Remove(element).(claim).key)
+}
@@ -0,0 +1,85 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeduplicatorKey(t *testing.T) {
+	dedup, err := NewDeduplicator(Deduplication{Header: "X-Delivery-Id", Paths: []string{"$.run.id", "{.state}"}})
+	require.NoError(t, err)
+	document := map[string]interface{}{
+		"run":   map[string]interface{}{"id": "01HQ"},
+		"state": "FINISHED",
+	}
+
+	tests := []struct {
+		name     string
+		header   string
+		document interface{}
+		key      string
+		found    bool
+	}{
+		{"header", "abc", document, "header:abc", true},
+		{"paths without header", "", document, "paths:01HQ\x1fFINISHED", true},
+		{"missing path", "", map[string]interface{}{"state": "FINISHED"}, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			if tt.header != "" {
+				header.Set("X-Delivery-Id", tt.header)
+			}
+			key, found := dedup.Key(header, tt.document)
+			assert.Equal(t, tt.key, key)
+			assert.Equal(t, tt.found, found)
+		})
+	}
+}
+
+func TestDeduplicatorClaim(t *testing.T) {
+	now := time.Date(2025, 3, 16, 12, 0, 0, 0, time.UTC)
+	dedup, err := NewDeduplicator(Deduplication{Header: "X-Delivery-Id", TTL: time.Minute, MaxEntries: 2})
+	require.NoError(t, err)
+
+	assert.True(t, dedup.Claim("a", now))
+	assert.False(t, dedup.Claim("a", now.Add(59*time.Second)), "duplicate within the ttl")
+	assert.True(t, dedup.Claim("a", now.Add(time.Minute)), "expired")
+
+	dedup.Release("a")
+	assert.True(t, dedup.Claim("a", now.Add(time.Minute)), "released")
+
+	// The cache is full, b and c push out a
+	assert.True(t, dedup.Claim("b", now.Add(time.Minute)))
+	assert.True(t, dedup.Claim("c", now.Add(time.Minute)))
+	assert.Equal(t, 2, dedup.Len())
+	assert.True(t, dedup.Claim("a", now.Add(time.Minute)))
+}
+
+func TestDeduplicatorReleaseFreesMemory(t *testing.T) {
+	now := time.Now()
+	dedup, err := NewDeduplicator(Deduplication{Header: "X-Delivery-Id", MaxEntries: 10})
+	require.NoError(t, err)
+
+	// e.g. deliveries answered with 503 while the queue is full
+	for range 1000 {
+		require.True(t, dedup.Claim("a", now))
+		dedup.Release("a")
+	}
+	assert.Equal(t, 0, dedup.Len())
+	assert.Equal(t, 0, dedup.order.Len(), "released claims are removed from the expiry order")
+}
+
+func TestNewDeduplicatorReportsAllErrors(t *testing.T) {
+	_, err := NewDeduplicator(Deduplication{Paths: []string{"$.run.id", "$.[", "{.state"}})
+	assert.ErrorContains(t, err, "path 1")
+	assert.ErrorContains(t, err, "path 2")
+	assert.NotContains(t, err.Error(), "path 0")
+
+	_, err = NewDeduplicator(Deduplication{TTL: -time.Second})
+	assert.ErrorContains(t, err, "ttl must not be negative")
+}
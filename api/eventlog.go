@@ -0,0 +1,329 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Event log outputs.
+const (
+	EventLogStdout        = "stdout"
+	EventLogFile          = "file"
+	EventLogLoki          = "loki"
+	EventLogElasticsearch = "elasticsearch"
+)
+
+// EventDocument is the JSON document an EventLog writes per event: the extracted
+// fields, the renamed labels and the samples, with the time the event was received
+// and the API key that sent it.
+type EventDocument struct {
+	Timestamp time.Time              `json:"@timestamp"`
+	Key       string                 `json:"key,omitempty"`
+	Fields    map[string]interface{} `json:"fields"`
+	Labels    map[string]interface{} `json:"labels"`
+	Metrics   []EventMetric          `json:"metrics,omitempty"`
+}
+
+// EventMetric is a sample of an EventDocument.
+type EventMetric struct {
+	Name   string            `json:"name"`
+	Type   string            `json:"type,omitempty"`
+	Value  float64           `json:"value"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// NewEventDocument converts an event. Events without a receive time get now.
+func NewEventDocument(ev Event) EventDocument {
+	document := EventDocument{
+		Timestamp: ev.Received,
+		Key:       ev.Key,
+		Fields:    ev.Fields,
+		Labels:    ev.Labels,
+	}
+	if document.Timestamp.IsZero() {
+		document.Timestamp = time.Now()
+	}
+	for _, sample := range ev.Samples {
+		document.Metrics = append(document.Metrics, EventMetric{Name: sample.Name, Type: sample.Type, Value: sample.Value, Labels: sample.Labels})
+	}
+	return document
+}
+
+// EventLogOptions configure an EventLog. Output is one of EventLogStdout (default),
+// EventLogFile, EventLogLoki or EventLogElasticsearch.
+//
+// The file output appends to Path and rotates it once it would grow beyond
+// MaxSizeBytes (default 100 MiB), keeping MaxBackups (default 5) old files as
+// Path.1, Path.2, ...
+//
+// The HTTP outputs send to URL, the push API of Loki (e.g.
+// http://loki:3100/loki/api/v1/push) or the bulk API of Elasticsearch (e.g.
+// http://elasticsearch:9200/_bulk), with Client (default: 10s timeout). Loki streams are labelled with
+// the StreamLabels of the event and service_name; keep them few and of low
+// cardinality. Elasticsearch documents are created in Index (default
+// spacelift-events), which may be a data stream. HealthURL is checked by Health.
+type EventLogOptions struct {
+	Output       string
+	Path         string
+	MaxSizeBytes int64
+	MaxBackups   int
+	URL          string
+	Client       *http.Client
+	HealthURL    string
+	StreamLabels []string
+	Index        string
+}
+
+// EventLog writes every event as a JSON document, so high cardinality values like
+// commit messages end up in logs instead of metric labels.
+type EventLog struct {
+	options EventLogOptions
+
+	// mu serializes writes to out
+	mu  sync.Mutex
+	out io.Writer
+	// file is the rotated file of the file output
+	file *rotatingFile
+}
+
+// NewEventLog opens the output.
+func NewEventLog(options EventLogOptions) (*EventLog, error) {
+	l := &EventLog{options: options}
+	switch options.Output {
+	case "", EventLogStdout:
+		l.options.Output = EventLogStdout
+		l.out = os.Stdout
+	case EventLogFile:
+		if options.Path == "" {
+			return nil, fmt.Errorf("missing path")
+		}
+		if options.MaxSizeBytes <= 0 {
+			options.MaxSizeBytes = 100 << 20
+		}
+		if options.MaxBackups <= 0 {
+			options.MaxBackups = 5
+		}
+		file, err := openRotatingFile(options.Path, options.MaxSizeBytes, options.MaxBackups)
+		if err != nil {
+			return nil, err
+		}
+		l.file, l.out = file, file
+	case EventLogLoki, EventLogElasticsearch:
+		if options.URL == "" {
+			return nil, fmt.Errorf("missing url")
+		}
+		if options.Client == nil {
+			l.options.Client = &http.Client{Timeout: 10 * time.Second}
+		}
+		if options.Index == "" {
+			l.options.Index = "spacelift-events"
+		}
+	default:
+		return nil, fmt.Errorf("unknown output '%s', expected stdout, file, loki or elasticsearch", options.Output)
+	}
+	return l, nil
+}
+
+// Emit writes samples without fields, EventLog is an EventSink.
+func (l *EventLog) Emit(ctx context.Context, samples []MetricSample) error {
+	return l.EmitEvent(ctx, Event{Samples: samples})
+}
+
+// EmitEvent writes the document of the event. Documents that cannot be encoded
+// and requests the receiver rejects are Permanent errors.
+func (l *EventLog) EmitEvent(ctx context.Context, ev Event) error {
+	document := NewEventDocument(ev)
+	line, err := json.Marshal(document)
+	if err != nil {
+		return Permanent(fmt.Errorf("encoding event: %v", err))
+	}
+	switch l.options.Output {
+	case EventLogLoki:
+		return l.pushLoki(ctx, ev, document.Timestamp, line)
+	case EventLogElasticsearch:
+		return l.bulkIndex(ctx, line)
+	default:
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if _, err := l.out.Write(append(line, '\n')); err != nil {
+			return fmt.Errorf("writing event: %v", err)
+		}
+		return nil
+	}
+}
+
+// pushLoki sends the document as a log line of the stream of its labels.
+func (l *EventLog) pushLoki(ctx context.Context, ev Event, timestamp time.Time, line []byte) error {
+	stream := map[string]string{"service_name": "spacelift-pushgateway"}
+	labels := LabelValues(ev.Labels)
+	for _, name := range l.options.StreamLabels {
+		if value := labels[name]; value != "" {
+			stream[name] = value
+		}
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"streams": []interface{}{map[string]interface{}{
+			"stream": stream,
+			"values": [][]string{{strconv.FormatInt(timestamp.UnixNano(), 10), string(line)}},
+		}},
+	})
+	if err != nil {
+		return Permanent(fmt.Errorf("encoding Loki push: %v", err))
+	}
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+	return postBody(ctx, l.options.Client, l.options.URL, header, body, "Loki push")
+}
+
+// bulkResponse is the part of an Elasticsearch bulk response needed to find
+// rejected documents.
+type bulkResponse struct {
+	Errors bool `json:"errors"`
+	Items  []map[string]struct {
+		Status int `json:"status"`
+		Error  struct {
+			Type   string `json:"type"`
+			Reason string `json:"reason"`
+		} `json:"error"`
+	} `json:"items"`
+}
+
+// bulkIndex creates the document with the bulk API, which reports rejected
+// documents in a 200 response.
+func (l *EventLog) bulkIndex(ctx context.Context, line []byte) error {
+	action, err := json.Marshal(map[string]interface{}{"create": map[string]string{"_index": l.options.Index}})
+	if err != nil {
+		return Permanent(fmt.Errorf("encoding bulk action: %v", err))
+	}
+	body := append(append(append(action, '\n'), line...), '\n')
+	header := http.Header{}
+	header.Set("Content-Type", "application/x-ndjson")
+	response, err := postForResponse(ctx, l.options.Client, l.options.URL, header, body, "Elasticsearch bulk")
+	if err != nil {
+		return err
+	}
+
+	var result bulkResponse
+	if err := json.Unmarshal(response, &result); err != nil {
+		return fmt.Errorf("invalid Elasticsearch bulk response: %v", err)
+	}
+	if !result.Errors {
+		return nil
+	}
+	for _, item := range result.Items {
+		for _, outcome := range item {
+			if outcome.Status/100 == 2 {
+				continue
+			}
+			err := &StatusError{Destination: "Elasticsearch bulk item", Code: outcome.Status, Message: fmt.Sprintf("%s: %s", outcome.Error.Type, outcome.Error.Reason)}
+			if outcome.Status == http.StatusTooManyRequests {
+				return err
+			}
+			return Permanent(err)
+		}
+	}
+	for i, item := range result.Items {
+		for _, outcome := range item {
+			if outcome.Error.Type != "" {
+				return fmt.Errorf("elasticsearch bulk item %d failed with status %d: %s: %s", i, outcome.Status, outcome.Error.Type, outcome.Error.Reason)
+			}
+		}
+	}
+	return fmt.Errorf("elasticsearch bulk response reports errors, but none of its %d items failed", len(result.Items))
+}
+
+// Health checks the health URL of the HTTP outputs, the other outputs are always
+// healthy.
+func (l *EventLog) Health(ctx context.Context) error {
+	if l.options.Output != EventLogLoki && l.options.Output != EventLogElasticsearch {
+		return nil
+	}
+	return checkHealthURL(ctx, l.options.Client, l.options.HealthURL, l.options.Output)
+}
+
+// Close closes the file of the file output.
+func (l *EventLog) Close(ctx context.Context) error {
+	if l.file == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
+
+// rotatingFile appends to a file and rotates it before it grows beyond maxSize.
+// It is not safe for concurrent use.
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+func openRotatingFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	f := &rotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open event log: %v", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to open event log: %v", err)
+	}
+	f.file, f.size = file, info.Size()
+	return nil
+}
+
+// Write rotates the file first if p does not fit anymore. A write larger than
+// maxSize goes into a file of its own.
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	if f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// rotate renames path to path.1, path.1 to path.2 and so on, dropping the oldest
+// backup, and opens a new file. If renaming fails, the current file is reopened.
+func (f *rotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return fmt.Errorf("failed to close event log: %v", err)
+	}
+	for i := f.maxBackups - 1; i >= 1; i-- {
+		older := fmt.Sprintf("%s.%d", f.path, i)
+		if _, err := os.Stat(older); err == nil {
+			if err := os.Rename(older, fmt.Sprintf("%s.%d", f.path, i+1)); err != nil {
+				return errors.Join(fmt.Errorf("failed to rotate event log: %v", err), f.open())
+			}
+		}
+	}
+	if err := os.Rename(f.path, f.path+".1"); err != nil {
+		return errors.Join(fmt.Errorf("failed to rotate event log: %v", err), f.open())
+	}
+	return f.open()
+}
+
+func (f *rotatingFile) Close() error {
+	return f.file.Close()
+}
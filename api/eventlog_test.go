@@ -0,0 +1,162 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testEvent() Event {
+	return Event{
+		Fields:   map[string]interface{}{"stackId": "infra", "state": "FAILED", "commit.message": "Fix the \"network\"\nfor real"},
+		Labels:   map[string]interface{}{"stackId": "infra", "state": "FAILED", "commit_message": "Fix the \"network\"\nfor real"},
+		Samples:  []MetricSample{{Name: "spacelift_run", Labels: map[string]string{"stackId": "infra", "state": "FAILED"}, Value: 1}},
+		Received: time.Date(2025, 3, 16, 12, 0, 0, 0, time.UTC),
+		Key:      "spacelift",
+	}
+}
+
+func TestEventLogWritesDocuments(t *testing.T) {
+	sink, err := NewEventLog(EventLogOptions{})
+	require.NoError(t, err)
+	var out bytes.Buffer
+	sink.out = &out
+
+	require.NoError(t, sink.EmitEvent(context.Background(), testEvent()))
+	require.NoError(t, sink.EmitEvent(context.Background(), testEvent()))
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	require.Len(t, lines, 2, "one line per event")
+	assert.JSONEq(t, `{
+		"@timestamp": "2025-03-16T12:00:00Z",
+		"key": "spacelift",
+		"fields": {"stackId": "infra", "state": "FAILED", "commit.message": "Fix the \"network\"\nfor real"},
+		"labels": {"stackId": "infra", "state": "FAILED", "commit_message": "Fix the \"network\"\nfor real"},
+		"metrics": [{"name": "spacelift_run", "value": 1, "labels": {"stackId": "infra", "state": "FAILED"}}]
+	}`, lines[0])
+}
+
+func TestEventLogRotatesFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.log")
+	sink, err := NewEventLog(EventLogOptions{Output: EventLogFile, Path: path, MaxSizeBytes: 600, MaxBackups: 2})
+	require.NoError(t, err)
+	for range 5 {
+		require.NoError(t, sink.EmitEvent(context.Background(), testEvent()))
+	}
+	require.NoError(t, sink.Close(context.Background()))
+
+	count := func(path string) int {
+		content, err := os.ReadFile(path)
+		require.NoError(t, err)
+		return strings.Count(string(content), "\n")
+	}
+	// Every document is about 400 bytes, so every file holds one of them
+	assert.Equal(t, 1, count(path))
+	assert.Equal(t, 1, count(path+".1"))
+	assert.Equal(t, 1, count(path+".2"))
+	assert.NoFileExists(t, path+".3", "only two backups are kept")
+
+	sink, err = NewEventLog(EventLogOptions{Output: EventLogFile, Path: path, MaxSizeBytes: 1000})
+	require.NoError(t, err)
+	require.NoError(t, sink.EmitEvent(context.Background(), testEvent()))
+	require.NoError(t, sink.Close(context.Background()))
+	assert.Equal(t, 2, count(path), "existing files are appended to")
+}
+
+func TestEventLogPushesToLoki(t *testing.T) {
+	var push struct {
+		Streams []struct {
+			Stream map[string]string `json:"stream"`
+			Values [][]string        `json:"values"`
+		} `json:"streams"`
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/loki/api/v1/push", r.URL.Path)
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&push))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	sink, err := NewEventLog(EventLogOptions{Output: EventLogLoki, URL: server.URL + "/loki/api/v1/push", Client: server.Client(), StreamLabels: []string{"stackId", "space"}})
+	require.NoError(t, err)
+	require.NoError(t, sink.EmitEvent(context.Background(), testEvent()))
+
+	require.Len(t, push.Streams, 1)
+	assert.Equal(t, map[string]string{"service_name": "spacelift-pushgateway", "stackId": "infra"}, push.Streams[0].Stream)
+	require.Len(t, push.Streams[0].Values, 1)
+	assert.Equal(t, "1742126400000000000", push.Streams[0].Values[0][0])
+	var document EventDocument
+	require.NoError(t, json.Unmarshal([]byte(push.Streams[0].Values[0][1]), &document))
+	assert.Equal(t, "Fix the \"network\"\nfor real", document.Fields["commit.message"])
+}
+
+func TestEventLogIndexesInElasticsearch(t *testing.T) {
+	tests := []struct {
+		name      string
+		response  string
+		err       string
+		permanent bool
+		errorType string
+	}{
+		{name: "created", response: `{"errors":false,"items":[{"create":{"status":201}}]}`},
+		{name: "rejected", response: `{"errors":true,"items":[{"create":{"status":400,"error":{"type":"document_parsing_exception","reason":"failed to parse field"}}}]}`, err: "status code 400: document_parsing_exception: failed to parse field", permanent: true, errorType: "status"},
+		{name: "throttled", response: `{"errors":true,"items":[{"create":{"status":429,"error":{"type":"es_rejected_execution_exception","reason":"queue full"}}}]}`, err: "status code 429", errorType: "status"},
+		{name: "error without failed item", response: `{"errors":true,"items":[{"create":{"status":201}}]}`, err: "reports errors, but none of its 1 items failed", errorType: "invalid"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var body string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, "application/x-ndjson", r.Header.Get("Content-Type"))
+				content, err := io.ReadAll(r.Body)
+				require.NoError(t, err)
+				body = string(content)
+				w.Write([]byte(tt.response))
+			}))
+			defer server.Close()
+
+			sink, err := NewEventLog(EventLogOptions{Output: EventLogElasticsearch, URL: server.URL + "/_bulk", Client: server.Client()})
+			require.NoError(t, err)
+			err = sink.EmitEvent(context.Background(), testEvent())
+			lines := strings.Split(body, "\n")
+			require.Len(t, lines, 3, "action, document and the final newline")
+			assert.JSONEq(t, `{"create":{"_index":"spacelift-events"}}`, lines[0])
+			assert.Contains(t, lines[1], `"@timestamp":"2025-03-16T12:00:00Z"`)
+			if tt.err == "" {
+				assert.NoError(t, err)
+				return
+			}
+			assert.ErrorContains(t, err, tt.err)
+			assert.Equal(t, tt.permanent, IsPermanent(err))
+			assert.Equal(t, tt.errorType, PushErrorType(err))
+		})
+	}
+}
+
+func TestNewEventLogErrors(t *testing.T) {
+	tests := []struct {
+		options EventLogOptions
+		err     string
+	}{
+		{EventLogOptions{Output: "syslog"}, "unknown output 'syslog'"},
+		{EventLogOptions{Output: EventLogFile}, "missing path"},
+		{EventLogOptions{Output: EventLogFile, Path: filepath.Join(t.TempDir(), "missing", "events.log")}, "failed to open event log"},
+		{EventLogOptions{Output: EventLogLoki}, "missing url"},
+		{EventLogOptions{Output: EventLogElasticsearch}, "missing url"},
+	}
+	for _, tt := range tests {
+		_, err := NewEventLog(tt.options)
+		assert.ErrorContains(t, err, tt.err)
+	}
+}
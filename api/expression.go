@@ -0,0 +1,162 @@
+package api
+
+import (
+	"fmt"
+	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/ast"
+	"github.com/expr-lang/expr/vm"
+	"sort"
+	"strings"
+)
+
+// Expression is a compiled expr-lang (https://expr-lang.org) expression.
+// Expressions see the top-level keys of the transformed payload as variables
+// (e.g. labels.environment, commit.author), the whole payload as "event" and
+// the values extracted so far as "fields" (e.g. fields["commit.author"]).
+// Only the payload keys in Variables can be used, so typos fail at compile time.
+// Variables that are not present in a payload evaluate to nil; use ?. to access
+// nested values that may be missing.
+type Expression struct {
+	source  string
+	program *vm.Program
+}
+
+// Variables are the top-level payload keys expressions may use besides event and
+// fields, see PayloadVariables.
+type Variables []string
+
+// PayloadVariables returns the top-level payload keys read by the paths of fields,
+// e.g. commit for {.commit.author}. Paths starting with a wildcard or recursive
+// descent name no key.
+func PayloadVariables(fields []Field) Variables {
+	seen := make(map[string]struct{})
+	variables := Variables{}
+	for _, field := range fields {
+		if strings.TrimSpace(field.Path) == "" {
+			continue
+		}
+		path, err := CompileJSONPath(field.Path)
+		if err != nil {
+			continue
+		}
+		if key, ok := path.topLevelKey(); ok {
+			if _, ok := seen[key]; !ok {
+				seen[key] = struct{}{}
+				variables = append(variables, key)
+			}
+		}
+	}
+	sort.Strings(variables)
+	return variables
+}
+
+// CompileExpression compiles an expression that may return any value.
+func CompileExpression(source string, variables Variables) (*Expression, error) {
+	return compileExpression(source, variables)
+}
+
+// CompileCondition compiles an expression that must return a boolean.
+func CompileCondition(source string, variables Variables) (*Expression, error) {
+	return compileExpression(source, variables, expr.AsBool())
+}
+
+// CompileValueExpression compiles an expression that must return a number, which is converted to float64.
+func CompileValueExpression(source string, variables Variables) (*Expression, error) {
+	return compileExpression(source, variables, expr.AsFloat64())
+}
+
+func compileExpression(source string, variables Variables, options ...expr.Option) (*Expression, error) {
+	// Payloads differ per event, so variables are typed at runtime and only their
+	// names are checked here
+	options = append(options, expr.AllowUndefinedVariables())
+	program, err := expr.Compile(source, options...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compile expression '%s': %v", source, err)
+	}
+	node := program.Node()
+	checker := &variableChecker{known: map[string]struct{}{"event": {}, "fields": {}, "$env": {}}, declared: map[string]struct{}{}}
+	for _, name := range variables {
+		checker.known[name] = struct{}{}
+	}
+	ast.Walk(&node, checker)
+	for _, name := range checker.unknown {
+		if _, ok := checker.declared[name]; !ok {
+			return nil, fmt.Errorf("failed to compile expression '%s': unknown variable '%s', expected event, fields or one of the payload keys read by fieldsToExtract %v", source, name, variables)
+		}
+	}
+	return &Expression{source: source, program: program}, nil
+}
+
+// variableChecker collects the names an expression uses that are neither known nor
+// builtin. Names declared with let are collected separately, since they are only
+// visited after their uses.
+type variableChecker struct {
+	known    map[string]struct{}
+	declared map[string]struct{}
+	unknown  []string
+}
+
+func (c *variableChecker) Visit(node *ast.Node) {
+	switch n := (*node).(type) {
+	case *ast.IdentifierNode:
+		if _, ok := c.known[n.Value]; !ok {
+			c.unknown = append(c.unknown, n.Value)
+		}
+	case *ast.VariableDeclaratorNode:
+		c.declared[n.Name] = struct{}{}
+	}
+}
+
+// String returns the expression source.
+func (e *Expression) String() string {
+	return e.source
+}
+
+// Eval runs the expression against env, see ExpressionEnv.
+func (e *Expression) Eval(env map[string]interface{}) (interface{}, error) {
+	result, err := expr.Run(e.program, env)
+	if err != nil {
+		return nil, fmt.Errorf("failed to evaluate expression '%s': %v", e.source, err)
+	}
+	return result, nil
+}
+
+// Match runs a condition compiled with CompileCondition.
+func (e *Expression) Match(env map[string]interface{}) (bool, error) {
+	result, err := e.Eval(env)
+	if err != nil {
+		return false, err
+	}
+	matched, ok := result.(bool)
+	if !ok {
+		return false, fmt.Errorf("expression '%s' returned %T instead of bool", e.source, result)
+	}
+	return matched, nil
+}
+
+// Float runs a value expression compiled with CompileValueExpression.
+func (e *Expression) Float(env map[string]interface{}) (float64, error) {
+	result, err := e.Eval(env)
+	if err != nil {
+		return 0, err
+	}
+	value, ok := result.(float64)
+	if !ok {
+		return 0, fmt.Errorf("expression '%s' returned %T instead of a number", e.source, result)
+	}
+	return value, nil
+}
+
+// ExpressionEnv builds the variables available to expressions from the transformed
+// payload and the extracted fields.
+func ExpressionEnv(document interface{}, fields map[string]interface{}) map[string]interface{} {
+	env := make(map[string]interface{})
+	if object, ok := document.(map[string]interface{}); ok {
+		for key, value := range object {
+			env[key] = value
+		}
+	}
+	env["event"] = document
+	env["fields"] = fields
+	return env
+}
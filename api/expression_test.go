@@ -0,0 +1,99 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExpressions(t *testing.T) {
+	document, err := DecodeJSON([]byte(`{
+		"state": "FINISHED",
+		"projectRoot": "stacks/foo-prod",
+		"labels": {"environment": "prod"},
+		"commit": {"createdAt": 1742103798000000001}
+	}`))
+	assert.NoError(t, err)
+	env := ExpressionEnv(document, map[string]interface{}{"commit_author": "hansihamster"})
+	variables := Variables{"commit", "labels", "projectRoot", "stack", "state"}
+
+	t.Run("computed value", func(t *testing.T) {
+		e, err := CompileExpression(`projectRoot startsWith "stacks/" ? "infra" : "unknown"`, variables)
+		assert.NoError(t, err)
+		value, err := e.Eval(env)
+		assert.NoError(t, err)
+		assert.Equal(t, "infra", value)
+	})
+
+	t.Run("extracted fields", func(t *testing.T) {
+		e, err := CompileExpression(`fields.commit_author + "@" + event.state`, variables)
+		assert.NoError(t, err)
+		value, err := e.Eval(env)
+		assert.NoError(t, err)
+		assert.Equal(t, "hansihamster@FINISHED", value)
+	})
+
+	t.Run("condition", func(t *testing.T) {
+		e, err := CompileCondition(`labels.environment == "prod" && state in ["FINISHED", "FAILED"]`, variables)
+		assert.NoError(t, err)
+		matched, err := e.Match(env)
+		assert.NoError(t, err)
+		assert.True(t, matched)
+	})
+
+	t.Run("missing nested value", func(t *testing.T) {
+		e, err := CompileCondition(`stack?.name == nil`, variables)
+		assert.NoError(t, err)
+		matched, err := e.Match(env)
+		assert.NoError(t, err)
+		assert.True(t, matched)
+
+		e, err = CompileExpression(`stack.name`, variables)
+		assert.NoError(t, err)
+		_, err = e.Eval(env)
+		assert.Error(t, err)
+	})
+
+	t.Run("value", func(t *testing.T) {
+		e, err := CompileValueExpression(`commit.createdAt / 1e9`, variables)
+		assert.NoError(t, err)
+		value, err := e.Float(env)
+		assert.NoError(t, err)
+		assert.InDelta(t, 1742103798.0, value, 0.001)
+	})
+
+	t.Run("compile errors", func(t *testing.T) {
+		_, err := CompileExpression(`state ==`, variables)
+		assert.Error(t, err)
+		_, err = CompileCondition(`"not a bool"`, variables)
+		assert.Error(t, err)
+		_, err = CompileValueExpression(`"not a number"`, variables)
+		assert.Error(t, err)
+	})
+
+	t.Run("unknown variables", func(t *testing.T) {
+		_, err := CompileCondition(`stat == "FAILED"`, variables)
+		assert.ErrorContains(t, err, "unknown variable 'stat'")
+		_, err = CompileExpression(`uppercase(state)`, variables)
+		assert.ErrorContains(t, err, "unknown variable 'uppercase'")
+
+		e, err := CompileExpression(`let name = lower(state); name + "!"`, variables)
+		assert.NoError(t, err)
+		value, err := e.Eval(env)
+		assert.NoError(t, err)
+		assert.Equal(t, "finished!", value)
+	})
+}
+
+func TestPayloadVariables(t *testing.T) {
+	variables := PayloadVariables([]Field{
+		{Path: "{.state}"},
+		{Path: "$.commit.author"},
+		{Path: "$['commit'].hash"},
+		{Path: "$.runs[?(@.type == 'APPLY')].id"},
+		{Path: "$..id"},
+		{Path: "$[*]"},
+		{Expr: "state", As: "copy"},
+	})
+	assert.Equal(t, Variables{"commit", "runs", "state"}, variables)
+}
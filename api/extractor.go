@@ -1,55 +1,197 @@
 package api
 
 import (
-	"bytes"
-	"encoding/json"
+	"errors"
 	"fmt"
-	"k8s.io/client-go/util/jsonpath"
-	"log"
+	log "github.com/sirupsen/logrus"
 	"strings"
 )
 
+// Field describes a single value to extract from a payload.
+// Path is the JSONPath expression, As the resulting key. Instead of a Path a field
+// can have an Expr, which computes the value from the payload and the fields
+// extracted before it (see Expression). If the field yields no result, Default is
+// used instead; a Required field without a result fails the whole extraction.
+// Type optionally converts the value and Format renders it into a string (see coerceValue);
+// a Format needs a Type.
+type Field struct {
+	Path     string
+	Expr     string
+	As       string
+	Default  interface{}
+	Required bool
+	Type     string
+	Format   string
+}
+
+// UnmarshalText allows plain JSONPath strings to be used as fieldsToExtract entries.
+func (f *Field) UnmarshalText(text []byte) error {
+	*f = Field{Path: string(text)}
+	return nil
+}
+
+// Key returns the name under which the extracted value is stored.
+// Without an explicit As, the key is derived from the path, e.g. "commit.author" for "{.commit.author}" or "$.commit.author".
+func (f Field) Key() string {
+	if f.As != "" {
+		return f.As
+	}
+	return strings.Trim(f.Path, "{}$.")
+}
+
+// source returns the path or expression for messages.
+func (f Field) source() string {
+	if f.Expr != "" {
+		return f.Expr
+	}
+	return f.Path
+}
+
+type compiledField struct {
+	Field
+	path *JSONPath
+	expr *Expression
+}
+
+// Extractor extracts a set of fields from payloads. Paths and expressions are
+// compiled once by NewExtractor and reused for every payload.
+type Extractor struct {
+	fields []compiledField
+}
+
+// NewExtractor compiles the given fields. Computed fields can use the payload keys
+// read by the paths, see PayloadVariables. All invalid fields are reported together.
+func NewExtractor(fields []Field) (*Extractor, error) {
+	var errs []error
+	extractor := &Extractor{}
+	variables := PayloadVariables(fields)
+	for i, field := range fields {
+		compiled, err := compileField(field, variables)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("field %d: %v", i, err))
+			continue
+		}
+		extractor.fields = append(extractor.fields, compiled)
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return extractor, nil
+}
+
+func compileField(field Field, variables Variables) (compiledField, error) {
+	compiled := compiledField{Field: field}
+	hasPath := strings.TrimSpace(field.Path) != ""
+	hasExpr := strings.TrimSpace(field.Expr) != ""
+
+	if err := validateType(field.Type); err != nil {
+		return compiled, err
+	}
+	if err := validateFormat(field.Type, field.Format); err != nil {
+		return compiled, err
+	}
+
+	var err error
+	switch {
+	case hasPath && hasExpr:
+		return compiled, fmt.Errorf("field '%s' has both path and expr", field.Key())
+	case hasExpr:
+		if field.As == "" {
+			return compiled, fmt.Errorf("computed field '%s' needs a name in as", field.Expr)
+		}
+		compiled.expr, err = CompileExpression(field.Expr, variables)
+	case hasPath:
+		compiled.path, err = CompileJSONPath(field.Path)
+	default:
+		return compiled, fmt.Errorf("empty JSONPath for field '%s'", field.As)
+	}
+	return compiled, err
+}
+
 // ExtractMultipleJSONPaths extracts key-value pairs from JSON data using multiple JSONPath expressions.
 // It returns a flat map where each JSONPath expression yields a key-value pair.
 // If a JSONPath does not match any data, a warning is logged.
 func ExtractMultipleJSONPaths(data []byte, paths []string) (map[string]interface{}, error) {
-	// Unmarshal JSON data into a generic map
-	var jsonData interface{}
-	if err := json.Unmarshal(data, &jsonData); err != nil {
+	fields := make([]Field, 0, len(paths))
+	for _, path := range paths {
+		fields = append(fields, Field{Path: path})
+	}
+	return ExtractFields(data, fields)
+}
+
+// ExtractFields extracts the given fields from JSON data into a flat map keyed by Field.Key.
+// Missing fields fall back to their default, are skipped with a warning if they have none,
+// and cause an error if they are required.
+func ExtractFields(data []byte, fields []Field) (map[string]interface{}, error) {
+	// Unmarshal JSON data into a generic map, keeping large integers like nanosecond timestamps exact
+	jsonData, err := DecodeJSON(data)
+	if err != nil {
 		return nil, fmt.Errorf("failed to unmarshal JSON: %v", err)
 	}
 
 	// Result map to hold key-value pairs
 	results := make(map[string]interface{})
 
-	for _, path := range paths {
-		// Generate a key name based on the JSONPath, e.g., "commit.author" for "{.commit.author}"
-		key := strings.Trim(path, "{}.")
-		jp := jsonpath.New("extractor")
-		if err := jp.Parse(path); err != nil {
-			return nil, fmt.Errorf("failed to parse JSONPath '%s': %v", path, err)
-		}
-
-		// Buffer to hold output
-		var resultBuffer bytes.Buffer
-		if err := jp.Execute(&resultBuffer, jsonData); err != nil {
-			// Log a warning if JSONPath yields no results
-			log.Printf("Warning: No results found for JSONPath '%s'\n", path)
-			continue
+	variables := PayloadVariables(fields)
+	for _, field := range fields {
+		compiled, err := compileField(field, variables)
+		if err != nil {
+			return nil, err
+		}
+		if err := compiled.extractInto(jsonData, results); err != nil {
+			return nil, err
 		}
+	}
 
-		// Try to decode the result as JSON, fallback to string if it fails
-		var extractedValue interface{}
-		rawOutput := resultBuffer.String()
+	return results, nil
+}
 
-		// Check if JSONPath result is valid JSON array or object
-		if json.Unmarshal([]byte(rawOutput), &extractedValue) != nil {
-			// If it fails, treat raw output as a single string result
-			extractedValue = rawOutput
+// Extract extracts all fields from a decoded payload, see DecodeJSON.
+// Computed fields see the fields listed before them.
+func (e *Extractor) Extract(document interface{}) (map[string]interface{}, error) {
+	results := make(map[string]interface{})
+	for _, field := range e.fields {
+		if err := field.extractInto(document, results); err != nil {
+			return nil, err
 		}
+	}
+	return results, nil
+}
+
+// extractInto looks up the field in document and stores the converted value in results.
+func (f compiledField) extractInto(document interface{}, results map[string]interface{}) error {
+	value, found, err := f.lookup(document, results)
+	if err != nil {
+		return err
+	}
+	if !found {
+		if f.Required {
+			return fmt.Errorf("required field '%s' not found", f.source())
+		}
+		if f.Default == nil {
+			log.Warnf("No results found for '%s'", f.source())
+			return nil
+		}
+		value = f.Default
+	}
 
-		results[key] = extractedValue
+	value, err = coerceValue(value, f.Type, f.Format)
+	if err != nil {
+		return fmt.Errorf("failed to convert field '%s': %v", f.source(), err)
 	}
+	results[f.Key()] = value
+	return nil
+}
 
-	return results, nil
+// lookup evaluates the path or expression of a field. found is false if there is no result.
+func (f compiledField) lookup(document interface{}, results map[string]interface{}) (interface{}, bool, error) {
+	if f.expr != nil {
+		value, err := f.expr.Eval(ExpressionEnv(document, results))
+		if err != nil {
+			return nil, false, err
+		}
+		return value, value != nil, nil
+	}
+	value, found := f.path.Lookup(document)
+	return value, found, nil
 }
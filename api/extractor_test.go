@@ -3,8 +3,9 @@ package api
 import (
 	"bytes"
 	"encoding/json"
-	"log"
+	log "github.com/sirupsen/logrus"
 
+	"reflect"
 	"strings"
 	"testing"
 )
@@ -138,12 +139,195 @@ func TestExtractMultipleJSONPaths(t *testing.T) {
 
 			// Warnungen überprüfen, wenn Pfade nicht gefunden wurden
 			logContent := logBuffer.String()
-			if tt.expectWarning && !strings.Contains(logContent, "Warning") {
+			if tt.expectWarning && !strings.Contains(logContent, "level=warning") {
 				t.Error("Expected warning for missing JSONPath, but none was logged")
 			}
-			if !tt.expectWarning && strings.Contains(logContent, "Warning") {
+			if !tt.expectWarning && strings.Contains(logContent, "level=warning") {
 				t.Error("Did not expect warning for missing JSONPath, but one was logged")
 			}
 		})
 	}
 }
+
+func TestExtractFields(t *testing.T) {
+	data := []byte(`{
+		"state": "FINISHED",
+		"commit": {
+			"author": "hansihamster",
+			"createdAt": 1742103798000
+		}
+	}`)
+
+	tests := []struct {
+		name        string
+		fields      []Field
+		expected    map[string]interface{}
+		expectError bool
+	}{
+		{
+			name: "explicit key name",
+			fields: []Field{
+				{Path: "{.commit.author}", As: "commit_author"},
+			},
+			expected: map[string]interface{}{
+				"commit_author": "hansihamster",
+			},
+		},
+		{
+			name: "default for missing field",
+			fields: []Field{
+				{Path: "{.commit.issueId}", As: "issue", Default: "none"},
+				{Path: "{.state}", Default: "UNKNOWN"},
+			},
+			expected: map[string]interface{}{
+				"issue": "none",
+				"state": "FINISHED",
+			},
+		},
+		{
+			name: "missing required field",
+			fields: []Field{
+				{Path: "{.state}"},
+				{Path: "{.runId}", Required: true},
+			},
+			expectError: true,
+		},
+		{
+			name: "type conversion",
+			fields: []Field{
+				{Path: "{.commit.createdAt}", As: "created", Type: "int"},
+				{Path: "{.commit.issueId}", As: "has_issue", Default: "false", Type: "bool"},
+			},
+			expected: map[string]interface{}{
+				"created":   int64(1742103798000),
+				"has_issue": false,
+			},
+		},
+		{
+			name: "computed fields see earlier fields",
+			fields: []Field{
+				{Path: "{.commit.author}", As: "author"},
+				{Expr: `event.state == "FINISHED" ? fields.author : "nobody"`, As: "finisher"},
+				{Expr: `commit?.issueId`, As: "issue", Default: "none"},
+			},
+			expected: map[string]interface{}{
+				"author":   "hansihamster",
+				"finisher": "hansihamster",
+				"issue":    "none",
+			},
+		},
+		{
+			name: "computed field without name",
+			fields: []Field{
+				{Expr: `state`},
+			},
+			expectError: true,
+		},
+		{
+			name: "computed field with a key no path reads",
+			fields: []Field{
+				{Path: "{.commit.author}"},
+				{Expr: `state`, As: "copy"},
+			},
+			expectError: true,
+		},
+		{
+			name: "format",
+			fields: []Field{
+				{Path: "{.commit.createdAt}", As: "created", Type: "float", Format: "%.0f"},
+				{Path: "{.state}", Type: "string", Format: "state %s"},
+			},
+			expected: map[string]interface{}{
+				"created": "1742103798000",
+				"state":   "state FINISHED",
+			},
+		},
+		{
+			name: "format without type",
+			fields: []Field{
+				{Path: "{.commit.createdAt}", As: "created", Format: "%.2f"},
+			},
+			expectError: true,
+		},
+		{
+			name: "format not fitting the type",
+			fields: []Field{
+				{Path: "{.commit.createdAt}", As: "created", Type: "int", Format: "%.2f"},
+			},
+			expectError: true,
+		},
+		{
+			name: "unsupported type",
+			fields: []Field{
+				{Path: "{.state}", Type: "uuid"},
+			},
+			expectError: true,
+		},
+		{
+			name: "empty path",
+			fields: []Field{
+				{As: "nothing"},
+			},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			results, err := ExtractFields(data, tt.fields)
+			if tt.expectError {
+				if err == nil {
+					t.Errorf("Expected an error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Did not expect an error but got: %v", err)
+			}
+			if !reflect.DeepEqual(results, tt.expected) {
+				t.Errorf("Expected %v, got %v", tt.expected, results)
+			}
+		})
+	}
+}
+
+func TestFieldUnmarshalText(t *testing.T) {
+	var f Field
+	if err := f.UnmarshalText([]byte("{.commit.hash}")); err != nil {
+		t.Fatal(err)
+	}
+	if f.Path != "{.commit.hash}" || f.Key() != "commit.hash" {
+		t.Errorf("unexpected field %+v with key %s", f, f.Key())
+	}
+}
+
+func TestNewExtractor(t *testing.T) {
+	_, err := NewExtractor([]Field{
+		{Path: "{.state"},
+		{Path: "{.branch}"},
+		{Path: "{.name}", Expr: "name"},
+		{Path: "{.stackId}", Type: "uuid"},
+	})
+	if err == nil {
+		t.Fatal("Expected an error but got none")
+	}
+	for _, expected := range []string{"field 0", "field 2", "field 3"} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("Expected error to mention %q, got: %v", expected, err)
+		}
+	}
+
+	extractor, err := NewExtractor([]Field{{Path: "$.branch"}, {Expr: "branch + \"!\"", As: "shout"}})
+	if err != nil {
+		t.Fatalf("Did not expect an error but got: %v", err)
+	}
+	document, _ := DecodeJSON([]byte(`{"branch": "master"}`))
+	results, err := extractor.Extract(document)
+	if err != nil {
+		t.Fatalf("Did not expect an error but got: %v", err)
+	}
+	expected := map[string]interface{}{"branch": "master", "shout": "master!"}
+	if !reflect.DeepEqual(results, expected) {
+		t.Errorf("Expected %v, got %v", expected, results)
+	}
+}
@@ -0,0 +1,163 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Filter is a rule deciding whether an event is pushed. A rule matches either an
+// extracted field against a list of values (In) and/or an anchored regular
+// expression (Regex), or evaluates a condition (Expr, see Expression).
+// Action is "include" (default) or "exclude": an event is pushed if it matches
+// all include rules and none of the exclude rules. Name optionally identifies the
+// rule in metrics, the default is its index.
+type Filter struct {
+	Name   string
+	Action string
+	Field  string
+	In     []string
+	Regex  string
+	Expr   string
+}
+
+// String describes the rule for logs and metrics, e.g. `exclude state in [QUEUED PREPARING]`.
+func (f Filter) String() string {
+	action := f.Action
+	if action == "" {
+		action = "include"
+	}
+	if f.Expr != "" {
+		return fmt.Sprintf("%s %s", action, f.Expr)
+	}
+	var conditions []string
+	if len(f.In) > 0 {
+		conditions = append(conditions, fmt.Sprintf("%s in %v", f.Field, f.In))
+	}
+	if f.Regex != "" {
+		conditions = append(conditions, fmt.Sprintf("%s =~ %s", f.Field, f.Regex))
+	}
+	return fmt.Sprintf("%s %s", action, strings.Join(conditions, " and "))
+}
+
+// Rejection describes the rule that rejected an event. Rule is the name or index of
+// the rule, for metrics, Reason the rule as written by String, for logs.
+type Rejection struct {
+	Rule   string
+	Reason string
+}
+
+type compiledFilter struct {
+	Filter
+	rule    string
+	exclude bool
+	in      map[string]struct{}
+	regex   *regexp.Regexp
+	expr    *Expression
+}
+
+// EventFilter decides which events are pushed. Rules are compiled once by NewEventFilter.
+type EventFilter struct {
+	filters []compiledFilter
+}
+
+// NewEventFilter compiles the given filters, whose expressions can use variables
+// (see PayloadVariables). All invalid filters are reported together.
+func NewEventFilter(filters []Filter, variables Variables) (*EventFilter, error) {
+	var errs []error
+	eventFilter := &EventFilter{}
+	for i, filter := range filters {
+		compiled, err := compileFilter(filter, variables)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("filter %d: %v", i, err))
+			continue
+		}
+		compiled.rule = filter.Name
+		if compiled.rule == "" {
+			compiled.rule = strconv.Itoa(i)
+		}
+		eventFilter.filters = append(eventFilter.filters, compiled)
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return eventFilter, nil
+}
+
+func compileFilter(filter Filter, variables Variables) (compiledFilter, error) {
+	compiled := compiledFilter{Filter: filter}
+	switch filter.Action {
+	case "", "include":
+	case "exclude":
+		compiled.exclude = true
+	default:
+		return compiled, fmt.Errorf("unknown action '%s', expected include or exclude", filter.Action)
+	}
+
+	var err error
+	switch {
+	case filter.Expr != "" && filter.Field != "":
+		return compiled, fmt.Errorf("a filter can have either expr or field, not both")
+	case filter.Expr != "":
+		compiled.expr, err = CompileCondition(filter.Expr, variables)
+		return compiled, err
+	case filter.Field == "":
+		return compiled, fmt.Errorf("a filter needs either expr or field")
+	case len(filter.In) == 0 && filter.Regex == "":
+		return compiled, fmt.Errorf("filter on field '%s' needs in or regex", filter.Field)
+	}
+
+	if len(filter.In) > 0 {
+		compiled.in = make(map[string]struct{}, len(filter.In))
+		for _, value := range filter.In {
+			compiled.in[value] = struct{}{}
+		}
+	}
+	if filter.Regex != "" {
+		// Anchor the regex like Prometheus does, so "prod" does not match "nonprod"
+		compiled.regex, err = regexp.Compile("^(?:" + filter.Regex + ")$")
+		if err != nil {
+			return compiled, fmt.Errorf("failed to compile regex '%s': %v", filter.Regex, err)
+		}
+	}
+	return compiled, nil
+}
+
+// matches reports whether the rule's condition holds for an event.
+// Missing fields are compared as empty strings.
+func (f compiledFilter) matches(fields map[string]interface{}, env map[string]interface{}) (bool, error) {
+	if f.expr != nil {
+		return f.expr.Match(env)
+	}
+	value := ""
+	if v, ok := fields[f.Field]; ok && v != nil {
+		value = FormatValue(v)
+	}
+	if f.in != nil {
+		if _, ok := f.in[value]; !ok {
+			return false, nil
+		}
+	}
+	if f.regex != nil && !f.regex.MatchString(value) {
+		return false, nil
+	}
+	return true, nil
+}
+
+// Accept reports whether an event passes the filters. fields are the extracted
+// fields, env the expression variables (see ExpressionEnv). If the event is
+// rejected, rejection describes the rule that rejected it.
+func (f *EventFilter) Accept(fields map[string]interface{}, env map[string]interface{}) (accepted bool, rejection Rejection, err error) {
+	for _, filter := range f.filters {
+		matched, err := filter.matches(fields, env)
+		if err != nil {
+			return false, Rejection{}, fmt.Errorf("filter '%s': %v", filter, err)
+		}
+		if matched == filter.exclude {
+			return false, Rejection{Rule: filter.rule, Reason: filter.String()}, nil
+		}
+	}
+	return true, Rejection{}, nil
+}
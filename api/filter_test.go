@@ -0,0 +1,88 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEventFilter(t *testing.T) {
+	filter, err := NewEventFilter([]Filter{
+		{Field: "state", In: []string{"FINISHED", "FAILED"}},
+		{Name: "no-dev", Action: "exclude", Field: "space", Regex: "dev|legacy-.*"},
+		{Expr: `labels?.environment != "test"`},
+	}, Variables{"labels", "state"})
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name           string
+		fields         map[string]interface{}
+		document       map[string]interface{}
+		expected       bool
+		expectedRule   string
+		expectedReason string
+	}{
+		{
+			name:     "all rules pass",
+			fields:   map[string]interface{}{"state": "FAILED", "space": "stable-prod"},
+			expected: true,
+		},
+		{
+			name:           "include rule rejects",
+			fields:         map[string]interface{}{"state": "QUEUED", "space": "stable-prod"},
+			expectedRule:   "0",
+			expectedReason: "include state in [FINISHED FAILED]",
+		},
+		{
+			name:           "missing field does not match include",
+			fields:         map[string]interface{}{"space": "stable-prod"},
+			expectedRule:   "0",
+			expectedReason: "include state in [FINISHED FAILED]",
+		},
+		{
+			name:           "exclude rule rejects",
+			fields:         map[string]interface{}{"state": "FINISHED", "space": "legacy-prod"},
+			expectedRule:   "no-dev",
+			expectedReason: "exclude space =~ dev|legacy-.*",
+		},
+		{
+			name:     "exclude regex is anchored",
+			fields:   map[string]interface{}{"state": "FINISHED", "space": "devops"},
+			expected: true,
+		},
+		{
+			name:           "expression rejects",
+			fields:         map[string]interface{}{"state": "FINISHED", "space": "stable-prod"},
+			document:       map[string]interface{}{"labels": map[string]interface{}{"environment": "test"}},
+			expectedRule:   "2",
+			expectedReason: `include labels?.environment != "test"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			accepted, rejection, err := filter.Accept(tt.fields, ExpressionEnv(tt.document, tt.fields))
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, accepted)
+			assert.Equal(t, tt.expectedRule, rejection.Rule)
+			assert.Equal(t, tt.expectedReason, rejection.Reason)
+		})
+	}
+}
+
+func TestNewEventFilterReportsAllErrors(t *testing.T) {
+	_, err := NewEventFilter([]Filter{
+		{Expr: `state ==`},
+		{Expr: `true`},
+		{Expr: `"x"`},
+		{Field: "state"},
+		{Field: "state", Regex: "("},
+		{Action: "drop", Field: "state", In: []string{"QUEUED"}},
+		{Field: "state", Expr: "true"},
+		{Expr: `stat == "FAILED"`},
+	}, Variables{"state"})
+	for _, expected := range []string{"filter 0", "filter 2", "filter 3", "filter 4", "filter 5", "filter 6", "filter 7: failed to compile expression 'stat == \"FAILED\"': unknown variable 'stat'"} {
+		assert.ErrorContains(t, err, expected)
+	}
+	assert.NotContains(t, err.Error(), "filter 1")
+}
@@ -0,0 +1,103 @@
+package api
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DependencyStatus is the state of a dependency as seen by a HealthChecker.
+type DependencyStatus struct {
+	Healthy             bool      `json:"healthy"`
+	ConsecutiveFailures int       `json:"consecutiveFailures"`
+	LastCheck           time.Time `json:"lastCheck,omitzero"`
+	LastSuccess         time.Time `json:"lastSuccess,omitzero"`
+	LastError           string    `json:"lastError,omitzero"`
+}
+
+// HealthChecker periodically probes a dependency. The dependency is healthy once a
+// check succeeded and stays healthy until FailureThreshold checks in a row failed.
+type HealthChecker struct {
+	Name             string
+	Check            func() error
+	Interval         time.Duration
+	FailureThreshold int
+
+	mu     sync.Mutex
+	status DependencyStatus
+}
+
+// DefaultHealthCheckInterval is the interval of a HealthChecker without a valid one.
+const DefaultHealthCheckInterval = 10 * time.Second
+
+// NewHealthChecker returns a checker for check. A FailureThreshold below 1 is set
+// to 1, an Interval of 0 or less to DefaultHealthCheckInterval.
+func NewHealthChecker(name string, check func() error, interval time.Duration, failureThreshold int) *HealthChecker {
+	if failureThreshold < 1 {
+		failureThreshold = 1
+	}
+	if interval <= 0 {
+		interval = DefaultHealthCheckInterval
+	}
+	return &HealthChecker{
+		Name:             name,
+		Check:            check,
+		Interval:         interval,
+		FailureThreshold: failureThreshold,
+	}
+}
+
+// Run checks the dependency right away and then every Interval until ctx is done.
+func (h *HealthChecker) Run(ctx context.Context) {
+	ticker := time.NewTicker(h.Interval)
+	defer ticker.Stop()
+	for {
+		h.Probe()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Probe runs a single check and updates the status. State changes are logged.
+func (h *HealthChecker) Probe() DependencyStatus {
+	err := h.Check()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	wasHealthy := h.status.Healthy
+	h.status.LastCheck = time.Now()
+	if err != nil {
+		h.status.ConsecutiveFailures++
+		h.status.LastError = err.Error()
+		if h.status.ConsecutiveFailures >= h.FailureThreshold {
+			h.status.Healthy = false
+		}
+	} else {
+		h.status.ConsecutiveFailures = 0
+		h.status.LastError = ""
+		h.status.LastSuccess = h.status.LastCheck
+		h.status.Healthy = true
+	}
+
+	switch {
+	case wasHealthy && !h.status.Healthy:
+		log.Errorf("%s is unhealthy after %d failed checks: %v", h.Name, h.status.ConsecutiveFailures, err)
+	case !wasHealthy && h.status.Healthy:
+		log.Infof("%s is healthy", h.Name)
+	case err != nil:
+		log.Warnf("%s check failed: %v", h.Name, err)
+	}
+	return h.status
+}
+
+// Status returns the status of the last check.
+func (h *HealthChecker) Status() DependencyStatus {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.status
+}
@@ -0,0 +1,71 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealthCheckerProbe(t *testing.T) {
+	var failing atomic.Bool
+	checker := NewHealthChecker("pushgateway", func() error {
+		if failing.Load() {
+			return errors.New("connection refused")
+		}
+		return nil
+	}, time.Second, 2)
+
+	assert.False(t, checker.Status().Healthy, "unhealthy before the first check")
+
+	status := checker.Probe()
+	assert.True(t, status.Healthy)
+	assert.False(t, status.LastSuccess.IsZero())
+	lastSuccess := status.LastSuccess
+
+	failing.Store(true)
+	status = checker.Probe()
+	assert.True(t, status.Healthy, "healthy until the failure threshold is reached")
+	assert.Equal(t, 1, status.ConsecutiveFailures)
+	assert.Equal(t, "connection refused", status.LastError)
+
+	status = checker.Probe()
+	assert.False(t, status.Healthy)
+	assert.Equal(t, 2, status.ConsecutiveFailures)
+	assert.Equal(t, lastSuccess, status.LastSuccess)
+
+	failing.Store(false)
+	status = checker.Probe()
+	assert.True(t, status.Healthy)
+	assert.Equal(t, 0, status.ConsecutiveFailures)
+	assert.Empty(t, status.LastError)
+}
+
+func TestHealthCheckerRun(t *testing.T) {
+	var checks atomic.Int32
+	checker := NewHealthChecker("pushgateway", func() error {
+		checks.Add(1)
+		return nil
+	}, 10*time.Millisecond, 0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		checker.Run(ctx)
+		close(done)
+	}()
+	assert.Eventually(t, func() bool { return checks.Load() >= 3 }, time.Second, 5*time.Millisecond)
+	cancel()
+	<-done
+	assert.True(t, checker.Status().Healthy)
+	assert.Equal(t, 1, checker.FailureThreshold)
+}
+
+func TestNewHealthCheckerDefaults(t *testing.T) {
+	checker := NewHealthChecker("pushgateway", func() error { return nil }, 0, 0)
+	assert.Equal(t, DefaultHealthCheckInterval, checker.Interval)
+	assert.Equal(t, 1, checker.FailureThreshold)
+}
@@ -0,0 +1,95 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// maxResponseBytes bounds the response bodies read by postForResponse.
+const maxResponseBytes = 1 << 20
+
+// StatusError is returned by the sinks when a receiver answers with an
+// unsuccessful status Code.
+type StatusError struct {
+	Destination string
+	Code        int
+	Message     string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s failed with unexpected status code %d: %s", e.Destination, e.Code, e.Message)
+}
+
+// postBody sends body to url for the HTTP based sinks. Responses with a 4xx status
+// other than 429 are Permanent errors, the request will not succeed on a retry.
+// destination names the receiver in errors.
+func postBody(ctx context.Context, client *http.Client, url string, header http.Header, body []byte, destination string) error {
+	_, err := postForResponse(ctx, client, url, header, body, destination)
+	return err
+}
+
+// postForResponse is postBody for receivers that report errors in the body of a 2xx
+// response. It returns the first maxResponseBytes of the body.
+func postForResponse(ctx context.Context, client *http.Client, url string, header http.Header, body []byte, destination string) ([]byte, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, Permanent(fmt.Errorf("invalid %s URL: %v", destination, err))
+	}
+	for name, values := range header {
+		request.Header[name] = values
+	}
+	request.Header.Set("User-Agent", "spacelift-pushgateway")
+
+	resp, err := client.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send to %s: %w", destination, err)
+	}
+	defer closeBody(resp.Body)
+
+	if resp.StatusCode/100 == 2 {
+		response, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseBytes))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read response of %s: %w", destination, err)
+		}
+		return response, nil
+	}
+	message, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	err = &StatusError{Destination: destination, Code: resp.StatusCode, Message: strings.TrimSpace(string(message))}
+	if resp.StatusCode/100 == 4 && resp.StatusCode != http.StatusTooManyRequests {
+		return nil, Permanent(err)
+	}
+	return nil, err
+}
+
+// checkHealthURL checks that url answers a GET with a 2xx status. Without url the
+// destination is considered healthy.
+func checkHealthURL(ctx context.Context, client *http.Client, url string, destination string) error {
+	if url == "" {
+		return nil
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return fmt.Errorf("invalid health URL: %v", err)
+	}
+	resp, err := client.Do(request)
+	if err != nil {
+		return fmt.Errorf("failed to connect to %s: %v", destination, err)
+	}
+	defer closeBody(resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s responded with unexpected status: %s", destination, resp.Status)
+	}
+	return nil
+}
+
+func closeBody(body io.ReadCloser) {
+	if err := body.Close(); err != nil {
+		log.Errorf("failed to close response body: %v", err)
+	}
+}
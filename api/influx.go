@@ -0,0 +1,99 @@
+package api
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// influxEscaper escapes measurements, tag keys and tag values. Metric names never
+// contain =, the only character escaped in tags but not in measurements. Line
+// protocol has no newlines in values, they are replaced with spaces.
+var influxEscaper = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `, "\n", `\ `, "\r", `\ `)
+
+// InfluxDB writes samples in line protocol to the HTTP write API of InfluxDB, e.g.
+// http://influxdb:8086/api/v2/write?org=infra&bucket=spacelift or the /write
+// endpoint of version 1. The sample name is the measurement, the labels are the
+// tags and the value is the field value.
+type InfluxDB struct {
+	url               string
+	healthURL         string
+	maxSamplesPerSend int
+	client            *http.Client
+}
+
+// NewInfluxDB sends to url with client, which adds the token or credentials.
+// Waiting events are sent together in requests of up to maxSamplesPerSend samples
+// (0: DefaultMaxSamplesPerSend). healthURL is checked by Health, e.g. /health or
+// /ping; without it the sink is always healthy.
+func NewInfluxDB(url string, client *http.Client, maxSamplesPerSend int, healthURL string) *InfluxDB {
+	if maxSamplesPerSend <= 0 {
+		maxSamplesPerSend = DefaultMaxSamplesPerSend
+	}
+	return &InfluxDB{
+		url:               url,
+		healthURL:         healthURL,
+		maxSamplesPerSend: maxSamplesPerSend,
+		client:            client,
+	}
+}
+
+// MaxBatchSamples makes InfluxDB a BatchingSink.
+func (i *InfluxDB) MaxBatchSamples() int {
+	return i.maxSamplesPerSend
+}
+
+// Emit writes the samples in a single request. Requests InfluxDB rejects with a 4xx
+// status other than 429 are Permanent errors.
+func (i *InfluxDB) Emit(ctx context.Context, samples []MetricSample) error {
+	body := encodeLineProtocol(samples, time.Now())
+	if len(body) == 0 {
+		return nil
+	}
+	header := http.Header{}
+	header.Set("Content-Type", "text/plain; charset=utf-8")
+	return postBody(ctx, i.client, i.url, header, body, "InfluxDB write")
+}
+
+// Health checks that the health URL answers with a 2xx status.
+func (i *InfluxDB) Health(ctx context.Context) error {
+	return checkHealthURL(ctx, i.client, i.healthURL, "InfluxDB")
+}
+
+// encodeLineProtocol writes one line per sample with nanosecond timestamps. Samples
+// without a timestamp get now. Labels with empty values are left out, InfluxDB
+// refuses empty tag values; samples with NaN or infinite values are skipped.
+func encodeLineProtocol(samples []MetricSample, now time.Time) []byte {
+	var lines strings.Builder
+	for _, sample := range samples {
+		if math.IsNaN(sample.Value) || math.IsInf(sample.Value, 0) {
+			log.Warnf("Skipping sample %s with value %v, InfluxDB does not store it", sample.Name, sample.Value)
+			continue
+		}
+		timestamp := sample.Timestamp
+		if timestamp.IsZero() {
+			timestamp = now
+		}
+		lines.WriteString(influxEscaper.Replace(sample.Name))
+		for _, name := range sample.LabelNames() {
+			if sample.Labels[name] == "" {
+				continue
+			}
+			lines.WriteByte(',')
+			lines.WriteString(influxEscaper.Replace(name))
+			lines.WriteByte('=')
+			lines.WriteString(influxEscaper.Replace(sample.Labels[name]))
+		}
+		lines.WriteString(" value=")
+		lines.WriteString(strconv.FormatFloat(sample.Value, 'g', -1, 64))
+		lines.WriteByte(' ')
+		lines.WriteString(strconv.FormatInt(timestamp.UnixNano(), 10))
+		lines.WriteByte('\n')
+	}
+	return []byte(lines.String())
+}
@@ -0,0 +1,93 @@
+package api
+
+import (
+	"context"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncodeLineProtocol(t *testing.T) {
+	received := time.Unix(1742126400, 5)
+	tests := []struct {
+		name     string
+		samples  []MetricSample
+		expected string
+	}{
+		{
+			name:     "sorted tags",
+			samples:  []MetricSample{{Name: "spacelift_run", Labels: map[string]string{"stack": "infra", "state": "FINISHED"}, Value: 1, Timestamp: received}},
+			expected: "spacelift_run,stack=infra,state=FINISHED value=1 1742126400000000005\n",
+		},
+		{
+			name:     "escaping",
+			samples:  []MetricSample{{Name: "spacelift_run", Labels: map[string]string{"commit_message": "fix a, b=c\nand d"}, Value: 0.5, Timestamp: received}},
+			expected: `spacelift_run,commit_message=fix\ a\,\ b\=c\ and\ d value=0.5 1742126400000000005` + "\n",
+		},
+		{
+			name:     "empty tag values are left out",
+			samples:  []MetricSample{{Name: "spacelift_run", Labels: map[string]string{"branch": "", "stack": "infra"}, Value: 1, Timestamp: received}},
+			expected: "spacelift_run,stack=infra value=1 1742126400000000005\n",
+		},
+		{
+			name: "invalid values are skipped",
+			samples: []MetricSample{
+				{Name: "spacelift_run", Value: math.NaN(), Timestamp: received},
+				{Name: "spacelift_run_duration_seconds", Value: 1e21, Timestamp: received},
+			},
+			expected: "spacelift_run_duration_seconds value=1e+21 1742126400000000005\n",
+		},
+		{
+			name:     "samples without timestamp get now",
+			samples:  []MetricSample{{Name: "spacelift_run", Value: 1}},
+			expected: "spacelift_run value=1 1742126460000000000\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, string(encodeLineProtocol(tt.samples, time.Unix(1742126460, 0))))
+		})
+	}
+}
+
+func TestInfluxDBEmit(t *testing.T) {
+	var bodies []string
+	status := http.StatusNoContent
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/v2/write", r.URL.Path)
+		assert.Equal(t, "spacelift", r.URL.Query().Get("bucket"))
+		assert.Equal(t, "text/plain; charset=utf-8", r.Header.Get("Content-Type"))
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		bodies = append(bodies, string(body))
+		if status != http.StatusNoContent {
+			http.Error(w, `{"code":"invalid","message":"unable to parse"}`, status)
+			return
+		}
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	received := time.Unix(1742126400, 0)
+	sink := NewInfluxDB(server.URL+"/api/v2/write?org=infra&bucket=spacelift", server.Client(), 0, "")
+	assert.Equal(t, DefaultMaxSamplesPerSend, sink.MaxBatchSamples())
+	require.NoError(t, sink.Emit(context.Background(), []MetricSample{
+		{Name: "spacelift_run", Labels: map[string]string{"stack": "infra"}, Value: 1, Timestamp: received},
+		{Name: "spacelift_run_duration_seconds", Labels: map[string]string{"stack": "infra"}, Value: 42.5, Timestamp: received},
+	}))
+	assert.Equal(t, []string{"spacelift_run,stack=infra value=1 1742126400000000000\nspacelift_run_duration_seconds,stack=infra value=42.5 1742126400000000000\n"}, bodies)
+
+	require.NoError(t, sink.Emit(context.Background(), []MetricSample{{Name: "spacelift_run", Value: math.Inf(1)}}))
+	assert.Len(t, bodies, 1, "nothing to write")
+
+	status = http.StatusBadRequest
+	err := sink.Emit(context.Background(), []MetricSample{{Name: "spacelift_run", Value: 1}})
+	assert.ErrorContains(t, err, "unable to parse")
+	assert.True(t, IsPermanent(err))
+}
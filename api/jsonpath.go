@@ -0,0 +1,158 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/ohler55/ojg/jp"
+	"strings"
+)
+
+// JSONPath is a compiled JSONPath expression used by every pipeline stage.
+//
+// The dialect follows Goessner's JSONPath as implemented by github.com/ohler55/ojg:
+// child access ($.a.b, $['a b']), array indexes and slices ($.a[0], $.a[1:3]),
+// wildcards ($.a[*]), recursive descent ($..id) and filters ($.a[?(@.type == "APPLY")]).
+// For compatibility the kubectl template syntax used by older configs ({.a.b}) is
+// accepted as well and translated into the equivalent $-expression.
+type JSONPath struct {
+	expression string
+	path       jp.Expr
+}
+
+// CompileJSONPath parses an expression in either the $.a.b or the {.a.b} syntax.
+func CompileJSONPath(expression string) (*JSONPath, error) {
+	normalized, err := normalizeJSONPath(expression)
+	if err != nil {
+		return nil, err
+	}
+	path, err := jp.ParseString(normalized)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse JSONPath '%s': %v", expression, err)
+	}
+	return &JSONPath{expression: expression, path: path}, nil
+}
+
+// normalizeJSONPath translates the kubectl template syntax into a $-expression.
+func normalizeJSONPath(expression string) (string, error) {
+	expr := strings.TrimSpace(expression)
+	if expr == "" {
+		return "", fmt.Errorf("empty JSONPath")
+	}
+	if strings.HasPrefix(expr, "{") {
+		if !strings.HasSuffix(expr, "}") || strings.Count(expr, "{") != 1 {
+			return "", fmt.Errorf("unsupported JSONPath template '%s': only a single {...} expression is allowed", expression)
+		}
+		expr = strings.TrimSpace(expr[1 : len(expr)-1])
+	}
+	switch {
+	case strings.HasPrefix(expr, "$"):
+		return expr, nil
+	case strings.HasPrefix(expr, ".") || strings.HasPrefix(expr, "["):
+		return "$" + expr, nil
+	default:
+		return "$." + expr, nil
+	}
+}
+
+// String returns the expression as it was written.
+func (p *JSONPath) String() string {
+	return p.expression
+}
+
+// Get returns all values matched by the expression.
+func (p *JSONPath) Get(data interface{}) []interface{} {
+	return p.path.Get(data)
+}
+
+// Lookup returns the matched value. A single match is returned as is, several
+// matches as a list. found is false if nothing matched.
+func (p *JSONPath) Lookup(data interface{}) (value interface{}, found bool) {
+	results := p.Get(data)
+	switch len(results) {
+	case 0:
+		return nil, false
+	case 1:
+		return results[0], true
+	default:
+		return results, true
+	}
+}
+
+// Modify replaces every matched value with the result of fn and reports how many values were visited.
+func (p *JSONPath) Modify(data interface{}, fn func(value interface{}) (interface{}, error)) (int, error) {
+	var (
+		matches int
+		fnErr   error
+	)
+	_, err := p.path.Modify(data, func(element any) (any, bool) {
+		if fnErr != nil {
+			return element, false
+		}
+		matches++
+		altered, err := fn(element)
+		if err != nil {
+			fnErr = err
+			return element, false
+		}
+		return altered, true
+	})
+	if err != nil {
+		return matches, fmt.Errorf("failed to modify JSON at %s: %v", p.expression, err)
+	}
+	return matches, fnErr
+}
+
+// DecodeJSON unmarshals data like json.Unmarshal, but keeps integers exact.
+// Numbers are decoded as json.Number first and then turned into int64 where
+// possible, so large values like nanosecond timestamps are not rounded to float64.
+func DecodeJSON(data []byte) (interface{}, error) {
+	var v interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&v); err != nil {
+		return nil, err
+	}
+	if decoder.More() {
+		return nil, fmt.Errorf("unexpected data after top-level value")
+	}
+	return normalizeNumbers(v), nil
+}
+
+// normalizeNumbers replaces json.Number values with int64 or float64.
+func normalizeNumbers(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, child := range v {
+			v[key] = normalizeNumbers(child)
+		}
+	case []interface{}:
+		for i, child := range v {
+			v[i] = normalizeNumbers(child)
+		}
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		if f, err := v.Float64(); err == nil {
+			return f
+		}
+		return v.String()
+	}
+	return value
+}
+
+// topLevelKey returns the key of the payload object the path starts with, e.g.
+// commit for $.commit.author or $['commit'].author.
+func (p *JSONPath) topLevelKey() (string, bool) {
+	for _, fragment := range p.path {
+		switch f := fragment.(type) {
+		case jp.Root, jp.Bracket:
+			continue
+		case jp.Child:
+			return string(f), true
+		}
+		return "", false
+	}
+	return "", false
+}
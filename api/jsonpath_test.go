@@ -0,0 +1,62 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJSONPathLookup(t *testing.T) {
+	data, err := DecodeJSON([]byte(`{
+		"state": "FINISHED",
+		"commit": {"author": "hansihamster", "createdAt": 1742103798000000001},
+		"runs": [
+			{"id": "run-1", "type": "PROPOSED", "delta": 0},
+			{"id": "run-2", "type": "APPLY", "delta": 3}
+		]
+	}`))
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name          string
+		expression    string
+		expected      interface{}
+		expectedFound bool
+		expectedError bool
+	}{
+		{name: "dollar syntax", expression: "$.commit.author", expected: "hansihamster", expectedFound: true},
+		{name: "template syntax", expression: "{.commit.author}", expected: "hansihamster", expectedFound: true},
+		{name: "bare path", expression: "state", expected: "FINISHED", expectedFound: true},
+		{name: "exact large integer", expression: "{.commit.createdAt}", expected: int64(1742103798000000001), expectedFound: true},
+		{name: "string filter", expression: `$.runs[?(@.type == "APPLY")].id`, expected: "run-2", expectedFound: true},
+		{name: "numeric filter", expression: `{.runs[?(@.delta > 0)].id}`, expected: "run-2", expectedFound: true},
+		{name: "wildcard", expression: "$.runs[*].id", expected: []interface{}{"run-1", "run-2"}, expectedFound: true},
+		{name: "recursive descent", expression: "$..author", expected: "hansihamster", expectedFound: true},
+		{name: "no match", expression: "$.commit.url", expectedFound: false},
+		{name: "syntax error", expression: "{.runs[}", expectedError: true},
+		{name: "template with several expressions", expression: "{.state} {.commit.author}", expectedError: true},
+		{name: "empty", expression: " ", expectedError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path, err := CompileJSONPath(tt.expression)
+			if tt.expectedError {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			value, found := path.Lookup(data)
+			assert.Equal(t, tt.expectedFound, found)
+			assert.Equal(t, tt.expected, value)
+		})
+	}
+}
+
+func TestDecodeJSONTrailingData(t *testing.T) {
+	_, err := DecodeJSON([]byte(`true story`))
+	assert.Error(t, err)
+	data, err := DecodeJSON([]byte(`1.5`))
+	assert.NoError(t, err)
+	assert.Equal(t, 1.5, data)
+}
@@ -0,0 +1,158 @@
+package api
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"go.yaml.in/yaml/v3"
+)
+
+// DefaultAPIKey is the key of old example configs. It is refused by NewKeyStore.
+const DefaultAPIKey = "extreme-secret-key"
+
+var (
+	// ErrUnknownKey is returned by Authenticate for keys not in the store.
+	ErrUnknownKey = errors.New("unknown API key")
+	// ErrKeyExpired is returned by Authenticate for keys past their expiry.
+	ErrKeyExpired = errors.New("API key expired")
+	// ErrKeyForbidden is returned by Authenticate for keys not allowed on the endpoint.
+	ErrKeyForbidden = errors.New("API key not allowed on this endpoint")
+)
+
+// APIKey is a named key clients send as bearer token. The key is set inline or read
+// from KeyFile. Endpoints restricts the key to these endpoints, e.g. "push" (default: all).
+// A key with ExpiresAt is refused from that time on.
+type APIKey struct {
+	Name      string    `yaml:"name"`
+	Key       string    `yaml:"key"`
+	KeyFile   string    `yaml:"keyFile"`
+	Endpoints []string  `yaml:"endpoints"`
+	ExpiresAt time.Time `yaml:"expiresAt"`
+}
+
+type storedKey struct {
+	name      string
+	hash      [sha256.Size]byte
+	endpoints map[string]struct{}
+	expiresAt time.Time
+}
+
+// KeyStore authenticates requests against a set of API keys. Only hashes of the keys are kept.
+type KeyStore struct {
+	keys []storedKey
+}
+
+// LoadAPIKeys reads keys from a YAML file with a top-level "keys" list.
+func LoadAPIKeys(path string) ([]APIKey, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading keys file: %v", err)
+	}
+	var file struct {
+		Keys []APIKey `yaml:"keys"`
+	}
+	if err := yaml.Unmarshal(content, &file); err != nil {
+		return nil, fmt.Errorf("parsing keys file %s: %v", path, err)
+	}
+	return file.Keys, nil
+}
+
+// NewKeyStore validates the keys. Keys need a unique name and a value other than
+// DefaultAPIKey. All invalid keys are reported together.
+func NewKeyStore(keys []APIKey) (*KeyStore, error) {
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no API keys configured")
+	}
+	var errs []error
+	store := &KeyStore{}
+	names := make(map[string]struct{}, len(keys))
+	for i, key := range keys {
+		stored, err := storeKey(key)
+		if err == nil {
+			if _, ok := names[key.Name]; ok {
+				err = fmt.Errorf("duplicate name '%s'", key.Name)
+			}
+			names[key.Name] = struct{}{}
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("key %d: %v", i, err))
+			continue
+		}
+		store.keys = append(store.keys, stored)
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return store, nil
+}
+
+func storeKey(key APIKey) (storedKey, error) {
+	if key.Name == "" {
+		return storedKey{}, fmt.Errorf("missing name")
+	}
+	if key.Key != "" && key.KeyFile != "" {
+		return storedKey{}, fmt.Errorf("key '%s' has both key and keyFile", key.Name)
+	}
+	value := key.Key
+	if key.KeyFile != "" {
+		content, err := os.ReadFile(key.KeyFile)
+		if err != nil {
+			return storedKey{}, fmt.Errorf("key '%s': %v", key.Name, err)
+		}
+		value = strings.TrimSpace(string(content))
+	}
+	if value == "" {
+		return storedKey{}, fmt.Errorf("key '%s' is empty", key.Name)
+	}
+	if value == DefaultAPIKey {
+		return storedKey{}, fmt.Errorf("key '%s' uses the default key %s, set a secret key", key.Name, DefaultAPIKey)
+	}
+	return storedKey{
+		name:      key.Name,
+		hash:      sha256.Sum256([]byte(value)),
+		endpoints: toSet(key.Endpoints),
+		expiresAt: key.ExpiresAt,
+	}, nil
+}
+
+// Authenticate returns the name of the key matching token. Every key is compared in
+// constant time, so the response time does not reveal how much of a key matched.
+// The name is also returned for expired and forbidden keys.
+func (s *KeyStore) Authenticate(token, endpoint string, now time.Time) (string, error) {
+	hash := sha256.Sum256([]byte(token))
+	match := -1
+	for i := range s.keys {
+		if subtle.ConstantTimeCompare(hash[:], s.keys[i].hash[:]) == 1 {
+			match = i
+		}
+	}
+	if match < 0 {
+		return "", ErrUnknownKey
+	}
+	key := s.keys[match]
+	if !key.expiresAt.IsZero() && !now.Before(key.expiresAt) {
+		return key.name, ErrKeyExpired
+	}
+	if key.endpoints != nil {
+		if _, ok := key.endpoints[endpoint]; !ok {
+			return key.name, ErrKeyForbidden
+		}
+	}
+	return key.name, nil
+}
+
+// Expiring returns the names of keys expiring within d after now, to warn about them.
+func (s *KeyStore) Expiring(now time.Time, d time.Duration) []string {
+	var names []string
+	for _, key := range s.keys {
+		if !key.expiresAt.IsZero() && key.expiresAt.Before(now.Add(d)) {
+			names = append(names, key.name)
+		}
+	}
+	return names
+}
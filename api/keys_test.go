@@ -0,0 +1,97 @@
+package api
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyStoreAuthenticate(t *testing.T) {
+	now := time.Date(2025, 3, 16, 12, 0, 0, 0, time.UTC)
+	keyFile := filepath.Join(t.TempDir(), "key")
+	require.NoError(t, os.WriteFile(keyFile, []byte("from-file\n"), 0600))
+
+	store, err := NewKeyStore([]APIKey{
+		{Name: "spacelift", Key: "s3cr3t", Endpoints: []string{"push"}},
+		{Name: "monitoring", Key: "m0n1t0r", Endpoints: []string{"status"}},
+		{Name: "old", Key: "0ld", ExpiresAt: now},
+		{Name: "mounted", KeyFile: keyFile},
+	})
+	require.NoError(t, err)
+
+	tests := []struct {
+		token    string
+		endpoint string
+		name     string
+		err      error
+	}{
+		{"s3cr3t", "push", "spacelift", nil},
+		{"s3cr3t", "status", "spacelift", ErrKeyForbidden},
+		{"m0n1t0r", "status", "monitoring", nil},
+		{"0ld", "push", "old", ErrKeyExpired},
+		{"from-file", "push", "mounted", nil},
+		{"s3cr3", "push", "", ErrUnknownKey},
+		{"", "push", "", ErrUnknownKey},
+	}
+	for _, tt := range tests {
+		t.Run(tt.token+"@"+tt.endpoint, func(t *testing.T) {
+			name, err := store.Authenticate(tt.token, tt.endpoint, now)
+			assert.Equal(t, tt.name, name)
+			if tt.err == nil {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorIs(t, err, tt.err)
+			}
+		})
+	}
+
+	_, err = store.Authenticate("0ld", "push", now.Add(-time.Second))
+	assert.NoError(t, err, "valid until the expiry")
+	assert.Equal(t, []string{"old"}, store.Expiring(now.Add(-time.Hour), 24*time.Hour))
+}
+
+func TestNewKeyStoreReportsAllErrors(t *testing.T) {
+	_, err := NewKeyStore([]APIKey{
+		{Key: "nameless"},
+		{Name: "default", Key: DefaultAPIKey},
+		{Name: "empty"},
+		{Name: "both", Key: "a", KeyFile: "b"},
+		{Name: "missing", KeyFile: "/nonexistent"},
+		{Name: "ok", Key: "ok"},
+		{Name: "ok", Key: "again"},
+	})
+	for _, expected := range []string{"key 0: missing name", "key 1: key 'default' uses the default key", "key 2", "key 3", "key 4", "key 6: duplicate name 'ok'"} {
+		assert.ErrorContains(t, err, expected)
+	}
+	assert.NotContains(t, err.Error(), "key 5")
+
+	_, err = NewKeyStore(nil)
+	assert.ErrorContains(t, err, "no API keys configured")
+}
+
+func TestLoadAPIKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(`
+keys:
+  - name: spacelift
+    key: s3cr3t
+    endpoints: [push]
+    expiresAt: 2026-01-01T00:00:00Z
+`), 0600))
+
+	keys, err := LoadAPIKeys(path)
+	require.NoError(t, err)
+	assert.Equal(t, []APIKey{{
+		Name:      "spacelift",
+		Key:       "s3cr3t",
+		Endpoints: []string{"push"},
+		ExpiresAt: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC),
+	}}, keys)
+
+	_, err = LoadAPIKeys(filepath.Join(t.TempDir(), "missing.yaml"))
+	assert.ErrorContains(t, err, "reading keys file")
+}
@@ -0,0 +1,196 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"regexp"
+	"sort"
+	"time"
+)
+
+var metricNameRegex = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
+// Metric types. Sinks without typed metrics, like the Pushgateway, write every type as gauge.
+const (
+	// MetricGauge is the current value, e.g. a state or a timestamp.
+	MetricGauge = "gauge"
+	// MetricSum adds the value of every event, e.g. 1 to count runs.
+	MetricSum = "sum"
+	// MetricHistogram observes the value of every event, e.g. a run duration, in Buckets.
+	MetricHistogram = "histogram"
+)
+
+// DefaultBuckets are the histogram buckets without explicit ones, suitable for run
+// durations in seconds.
+var DefaultBuckets = []float64{10, 30, 60, 120, 300, 600, 1200, 1800, 3600, 7200}
+
+// Metric describes a metric produced for every event. Value is an expression for
+// the metric value (see Expression), the default is the current unix time.
+// KeepLabels restricts the labels to the listed ones, DropLabels removes labels.
+// Type is MetricGauge (default), MetricSum or MetricHistogram with Buckets
+// (default DefaultBuckets).
+type Metric struct {
+	Name       string
+	Help       string
+	Type       string
+	Buckets    []float64
+	Value      string
+	KeepLabels []string
+	DropLabels []string
+}
+
+// MetricSample is a single value of a metric with its labels. Timestamp is the time
+// the event was received, sinks that write timestamps use the current time without it.
+// Type and Buckets are taken from the Metric, an empty Type is a gauge.
+type MetricSample struct {
+	Name      string
+	Help      string
+	Type      string
+	Buckets   []float64
+	Labels    map[string]string
+	Value     float64
+	Timestamp time.Time
+}
+
+type compiledMetric struct {
+	Metric
+	value *Expression
+	keep  map[string]struct{}
+	drop  map[string]struct{}
+}
+
+// MetricBuilder turns events into samples. Metrics are compiled once by NewMetricBuilder.
+type MetricBuilder struct {
+	metrics []compiledMetric
+}
+
+// NewMetricBuilder compiles the given metrics, whose value expressions can use
+// variables (see PayloadVariables). All invalid metrics are reported together.
+func NewMetricBuilder(metrics []Metric, variables Variables) (*MetricBuilder, error) {
+	var errs []error
+	builder := &MetricBuilder{}
+	for i, metric := range metrics {
+		compiled, err := compileMetric(metric, variables)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("metric %d: %v", i, err))
+			continue
+		}
+		builder.metrics = append(builder.metrics, compiled)
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return builder, nil
+}
+
+func compileMetric(metric Metric, variables Variables) (compiledMetric, error) {
+	compiled := compiledMetric{Metric: metric}
+	if !metricNameRegex.MatchString(metric.Name) {
+		return compiled, fmt.Errorf("invalid metric name '%s'", metric.Name)
+	}
+	if len(metric.KeepLabels) > 0 && len(metric.DropLabels) > 0 {
+		return compiled, fmt.Errorf("metric '%s' has both keepLabels and dropLabels", metric.Name)
+	}
+	switch metric.Type {
+	case "", MetricGauge, MetricSum:
+		if len(metric.Buckets) > 0 {
+			return compiled, fmt.Errorf("metric '%s' has buckets but is no histogram", metric.Name)
+		}
+	case MetricHistogram:
+		if len(metric.Buckets) == 0 {
+			compiled.Buckets = DefaultBuckets
+		}
+		for i := 1; i < len(metric.Buckets); i++ {
+			if metric.Buckets[i] <= metric.Buckets[i-1] {
+				return compiled, fmt.Errorf("buckets of metric '%s' must be in increasing order", metric.Name)
+			}
+		}
+	default:
+		return compiled, fmt.Errorf("metric '%s' has unknown type '%s', expected gauge, sum or histogram", metric.Name, metric.Type)
+	}
+	if metric.Value != "" {
+		value, err := CompileValueExpression(metric.Value, variables)
+		if err != nil {
+			return compiled, err
+		}
+		compiled.value = value
+	}
+	compiled.keep = toSet(metric.KeepLabels)
+	compiled.drop = toSet(metric.DropLabels)
+	return compiled, nil
+}
+
+func toSet(values []string) map[string]struct{} {
+	if len(values) == 0 {
+		return nil
+	}
+	set := make(map[string]struct{}, len(values))
+	for _, v := range values {
+		set[v] = struct{}{}
+	}
+	return set
+}
+
+// Samples builds one sample per metric from the renamed labels. env are the expression
+// variables for the value expressions (see ExpressionEnv).
+func (b *MetricBuilder) Samples(labels map[string]interface{}, env map[string]interface{}) ([]MetricSample, error) {
+	values := LabelValues(labels)
+	samples := make([]MetricSample, 0, len(b.metrics))
+	for _, metric := range b.metrics {
+		sample := MetricSample{
+			Name:    metric.Name,
+			Help:    metric.Help,
+			Type:    metric.Type,
+			Buckets: metric.Buckets,
+			Labels:  make(map[string]string, len(values)),
+			Value:   float64(time.Now().Unix()),
+		}
+		for name, value := range values {
+			if metric.keep != nil {
+				if _, ok := metric.keep[name]; !ok {
+					continue
+				}
+			}
+			if _, ok := metric.drop[name]; ok {
+				continue
+			}
+			sample.Labels[name] = value
+		}
+		if metric.value != nil {
+			value, err := metric.value.Float(env)
+			if err != nil {
+				return nil, fmt.Errorf("metric '%s': %v", metric.Name, err)
+			}
+			sample.Value = value
+		}
+		samples = append(samples, sample)
+	}
+	return samples, nil
+}
+
+// LabelValues converts extracted values into label values. Values of unsupported
+// types, like lists and objects, are skipped with a warning.
+func LabelValues(labelPairs map[string]interface{}) map[string]string {
+	output := make(map[string]string)
+	for key, value := range labelPairs {
+		switch value.(type) {
+		case string, json.Number, int, int64, float64, bool, time.Time, time.Duration:
+			output[key] = FormatValue(value)
+		default:
+			log.Printf("Warning: Ignoring unsupported label type for key '%s'", key)
+		}
+	}
+	return output
+}
+
+// LabelNames returns the sorted label names of a sample.
+func (s MetricSample) LabelNames() []string {
+	names := make([]string, 0, len(s.Labels))
+	for name := range s.Labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
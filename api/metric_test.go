@@ -0,0 +1,72 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetricBuilderSamples(t *testing.T) {
+	builder, err := NewMetricBuilder([]Metric{
+		{Name: "spacelift_run", DropLabels: []string{"commit_message", "commit_hash"}},
+		{Name: "spacelift_run_commit", KeepLabels: []string{"stackId", "commit_hash"}, Value: "commit.createdAt / 1e9"},
+	}, Variables{"commit"})
+	assert.NoError(t, err)
+
+	labels := map[string]interface{}{
+		"stackId":        "stack",
+		"commit_message": "fix: everything",
+		"commit_hash":    "abc",
+		"attempts":       int64(2),
+		"tags":           []interface{}{"a"},
+	}
+	env := map[string]interface{}{"commit": map[string]interface{}{"createdAt": int64(1700000000000000000)}}
+
+	samples, err := builder.Samples(labels, env)
+	assert.NoError(t, err)
+	assert.Len(t, samples, 2)
+
+	assert.Equal(t, "spacelift_run", samples[0].Name)
+	assert.Equal(t, map[string]string{"stackId": "stack", "attempts": "2"}, samples[0].Labels)
+	assert.Greater(t, samples[0].Value, float64(0))
+
+	assert.Equal(t, "spacelift_run_commit", samples[1].Name)
+	assert.Equal(t, []string{"commit_hash", "stackId"}, samples[1].LabelNames())
+	assert.Equal(t, float64(1700000000), samples[1].Value)
+}
+
+func TestMetricBuilderTypes(t *testing.T) {
+	builder, err := NewMetricBuilder([]Metric{
+		{Name: "spacelift_runs", Type: MetricSum, Value: "1"},
+		{Name: "spacelift_run_duration_seconds", Type: MetricHistogram, Value: "42"},
+		{Name: "spacelift_run_delta_seconds", Type: MetricHistogram, Buckets: []float64{1, 5}, Value: "3"},
+	}, Variables{})
+	assert.NoError(t, err)
+	samples, err := builder.Samples(map[string]interface{}{}, map[string]interface{}{})
+	assert.NoError(t, err)
+
+	assert.Equal(t, MetricSum, samples[0].Type)
+	assert.Nil(t, samples[0].Buckets)
+	assert.Equal(t, MetricHistogram, samples[1].Type)
+	assert.Equal(t, DefaultBuckets, samples[1].Buckets)
+	assert.Equal(t, []float64{1, 5}, samples[2].Buckets)
+}
+
+func TestNewMetricBuilderReportsAllErrors(t *testing.T) {
+	_, err := NewMetricBuilder([]Metric{
+		{Name: "spacelift-run"},
+		{Name: "ok", KeepLabels: []string{"a"}, DropLabels: []string{"b"}},
+		{Name: "value", Value: "1 +"},
+		{Name: "valid"},
+		{Name: "type", Type: "summary"},
+		{Name: "gauge_buckets", Buckets: []float64{1}},
+		{Name: "unordered", Type: MetricHistogram, Buckets: []float64{2, 1}},
+		{Name: "histogram", Type: MetricHistogram},
+		{Name: "unknown", Value: "durationSeconds"},
+	}, Variables{"commit"})
+	for _, expected := range []string{"metric 0", "metric 1", "metric 2", "metric 4: metric 'type' has unknown type 'summary'", "metric 5", "metric 6", "metric 8: failed to compile expression 'durationSeconds': unknown variable 'durationSeconds'"} {
+		assert.ErrorContains(t, err, expected)
+	}
+	assert.NotContains(t, err.Error(), "metric 3")
+	assert.NotContains(t, err.Error(), "metric 7")
+}
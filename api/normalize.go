@@ -0,0 +1,112 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// hashSuffixLength is the length of the "-" and the 8 hex digits appended to truncated values.
+const hashSuffixLength = 9
+
+// Normalization describes how label values are cleaned up before they are pushed.
+// StripControl replaces newlines and tabs with a space and removes other control
+// characters, Trim removes leading and trailing whitespace, Lowercase lowercases the
+// value. Values longer than MaxLength bytes (0 = unlimited) are truncated and get a
+// hash of the full value appended, so different values stay different.
+type Normalization struct {
+	MaxLength    int
+	StripControl bool
+	Trim         bool
+	Lowercase    bool
+}
+
+// LabelNormalization applies Default to all labels; a label listed in Labels uses
+// its own Normalization instead of Default.
+type LabelNormalization struct {
+	Default Normalization
+	Labels  map[string]Normalization
+}
+
+// Validate reports a MaxLength too short for the hash suffix.
+func (n Normalization) Validate() error {
+	if n.MaxLength != 0 && n.MaxLength <= hashSuffixLength {
+		return fmt.Errorf("maxLength must be 0 or greater than %d, got %d", hashSuffixLength, n.MaxLength)
+	}
+	return nil
+}
+
+// Normalizer normalizes label values according to a LabelNormalization.
+type Normalizer struct {
+	config LabelNormalization
+}
+
+// NewNormalizer validates the normalization of every label. All errors are reported together.
+func NewNormalizer(config LabelNormalization) (*Normalizer, error) {
+	var errs []error
+	if err := config.Default.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("default: %v", err))
+	}
+	for _, label := range sortedKeys(config.Labels) {
+		if err := config.Labels[label].Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("label '%s': %v", label, err))
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return &Normalizer{config: config}, nil
+}
+
+// Apply returns a copy of labels with normalized values.
+func (n *Normalizer) Apply(labels map[string]string) map[string]string {
+	normalized := make(map[string]string, len(labels))
+	for label, value := range labels {
+		normalization, ok := n.config.Labels[label]
+		if !ok {
+			normalization = n.config.Default
+		}
+		normalized[label] = normalization.Apply(value)
+	}
+	return normalized
+}
+
+// Apply normalizes a single value.
+func (n Normalization) Apply(value string) string {
+	if n.StripControl {
+		value = strings.Map(func(r rune) rune {
+			switch {
+			case r == '\n' || r == '\r' || r == '\t':
+				return ' '
+			case unicode.IsControl(r):
+				return -1
+			}
+			return r
+		}, value)
+	}
+	if n.Trim {
+		value = strings.TrimSpace(value)
+	}
+	if n.Lowercase {
+		value = strings.ToLower(value)
+	}
+	if n.MaxLength > 0 && len(value) > n.MaxLength {
+		value = truncate(value, n.MaxLength)
+	}
+	return value
+}
+
+// truncate cuts value to at most maxLength bytes including a hash suffix of the full value.
+// The cut never splits a multi-byte character.
+func truncate(value string, maxLength int) string {
+	sum := sha256.Sum256([]byte(value))
+	cut := maxLength - hashSuffixLength
+	for cut > 0 && !utf8.RuneStart(value[cut]) {
+		cut--
+	}
+	return value[:cut] + "-" + hex.EncodeToString(sum[:4])
+}
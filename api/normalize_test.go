@@ -0,0 +1,68 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalizationApply(t *testing.T) {
+	tests := []struct {
+		name          string
+		normalization Normalization
+		value         string
+		expected      string
+	}{
+		{"no normalization", Normalization{}, " Fix\nBug ", " Fix\nBug "},
+		{"strip control", Normalization{StripControl: true}, "Fix\r\nBug\x00\x1b", "Fix  Bug"},
+		{"trim", Normalization{Trim: true}, "\t Fix Bug \n", "Fix Bug"},
+		{"lowercase", Normalization{Lowercase: true}, "INFRA-5032", "infra-5032"},
+		{"short value is not truncated", Normalization{MaxLength: 10}, "0123456789", "0123456789"},
+		{"truncate with hash", Normalization{MaxLength: 16}, "INFRA-5032: update foo terraform", "INFRA-5-8e576d3d"},
+		{"truncate keeps characters whole", Normalization{MaxLength: 12}, "äöüäöüä", "ä-14ed5ed3"},
+		{"all", Normalization{MaxLength: 20, StripControl: true, Trim: true, Lowercase: true}, " Fix\n", "fix"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := tt.normalization.Apply(tt.value)
+			assert.Equal(t, tt.expected, result)
+			if tt.normalization.MaxLength > 0 {
+				assert.LessOrEqual(t, len(result), tt.normalization.MaxLength)
+			}
+		})
+	}
+}
+
+func TestNormalizationTruncateKeepsUniqueness(t *testing.T) {
+	n := Normalization{MaxLength: 20}
+	a := n.Apply("INFRA-5032: update foo terraform")
+	b := n.Apply("INFRA-5032: update bar terraform")
+	assert.NotEqual(t, a, b)
+	assert.Equal(t, a[:11], b[:11])
+}
+
+func TestNormalizerPerLabel(t *testing.T) {
+	normalizer, err := NewNormalizer(LabelNormalization{
+		Default: Normalization{Trim: true},
+		Labels: map[string]Normalization{
+			"namespace": {Trim: true, Lowercase: true},
+			"stackid":   {Lowercase: true},
+		},
+	})
+	assert.NoError(t, err)
+
+	labels := map[string]string{"namespace": " NS ", "state": " FINISHED ", "stackId": "Infra "}
+	assert.Equal(t, map[string]string{"namespace": "ns", "state": "FINISHED", "stackId": "Infra"}, normalizer.Apply(labels), "label names are case-sensitive")
+	assert.Equal(t, " NS ", labels["namespace"], "input labels must not be modified")
+}
+
+func TestNewNormalizerReportsAllErrors(t *testing.T) {
+	_, err := NewNormalizer(LabelNormalization{
+		Default: Normalization{MaxLength: 5},
+		Labels:  map[string]Normalization{"commit_message": {MaxLength: 9}, "state": {MaxLength: 10}},
+	})
+	assert.ErrorContains(t, err, "default: maxLength must be 0 or greater than 9")
+	assert.ErrorContains(t, err, "label 'commit_message'")
+	assert.NotContains(t, err.Error(), "label 'state'")
+}
@@ -0,0 +1,251 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// OTLP encodings.
+const (
+	OTLPProtobuf = "protobuf"
+	OTLPJSON     = "json"
+)
+
+// otlpScope is the instrumentation scope of everything the service exports.
+var otlpScope = &commonpb.InstrumentationScope{Name: "spacelift-pushgateway"}
+
+// OTLPOptions configure an OTLP sink. Encoding is OTLPProtobuf (default) or OTLPJSON.
+// ResourceLabels are the labels that describe the resource, like stack or space,
+// and become resource attributes; the other labels become data point attributes.
+// ServiceName is the service.name resource attribute (default spacelift-pushgateway).
+// Waiting events are sent together in requests of up to MaxSamplesPerSend samples
+// (0: DefaultMaxSamplesPerSend). HealthURL is checked by Health, e.g. the health
+// check extension of the collector; without it the sink is always healthy.
+type OTLPOptions struct {
+	Encoding          string
+	ResourceLabels    []string
+	ServiceName       string
+	MaxSamplesPerSend int
+	HealthURL         string
+}
+
+// OTLP exports samples as OTLP/HTTP metrics, e.g. to an OpenTelemetry Collector.
+// Gauges become gauges, sums and histograms are exported with delta temporality,
+// every event adds its value or observation.
+type OTLP struct {
+	url     string
+	client  *http.Client
+	options OTLPOptions
+	// resourceLabels is options.ResourceLabels as set
+	resourceLabels map[string]struct{}
+}
+
+// NewOTLP sends to url, e.g. http://collector:4318/v1/metrics, with client, which
+// adds headers and authentication.
+func NewOTLP(url string, client *http.Client, options OTLPOptions) (*OTLP, error) {
+	switch options.Encoding {
+	case "":
+		options.Encoding = OTLPProtobuf
+	case OTLPProtobuf, OTLPJSON:
+	default:
+		return nil, fmt.Errorf("unknown encoding '%s', expected protobuf or json", options.Encoding)
+	}
+	if options.ServiceName == "" {
+		options.ServiceName = "spacelift-pushgateway"
+	}
+	if options.MaxSamplesPerSend <= 0 {
+		options.MaxSamplesPerSend = DefaultMaxSamplesPerSend
+	}
+	return &OTLP{
+		url:            url,
+		client:         client,
+		options:        options,
+		resourceLabels: toSet(options.ResourceLabels),
+	}, nil
+}
+
+// MaxBatchSamples makes OTLP a BatchingSink.
+func (o *OTLP) MaxBatchSamples() int {
+	return o.options.MaxSamplesPerSend
+}
+
+// Emit sends the samples in a single export request. Requests the collector
+// rejects with a 4xx status other than 429 are Permanent errors.
+func (o *OTLP) Emit(ctx context.Context, samples []MetricSample) error {
+	request := &colmetricspb.ExportMetricsServiceRequest{ResourceMetrics: o.resourceMetrics(samples, time.Now())}
+	return postOTLP(ctx, o.client, o.url, o.options.Encoding, request, "OTLP metrics")
+}
+
+// Health checks that the health URL answers with a 2xx status.
+func (o *OTLP) Health(ctx context.Context) error {
+	return checkHealthURL(ctx, o.client, o.options.HealthURL, "OTLP collector")
+}
+
+// postOTLP encodes an export request and sends it.
+func postOTLP(ctx context.Context, client *http.Client, url, encoding string, request proto.Message, destination string) error {
+	var (
+		body []byte
+		err  error
+	)
+	header := http.Header{}
+	if encoding == OTLPJSON {
+		header.Set("Content-Type", "application/json")
+		// OTLP/JSON requires enums as numbers
+		body, err = protojson.MarshalOptions{UseEnumNumbers: true}.Marshal(request)
+	} else {
+		header.Set("Content-Type", "application/x-protobuf")
+		body, err = proto.Marshal(request)
+	}
+	if err != nil {
+		return Permanent(fmt.Errorf("encoding %s: %v", destination, err))
+	}
+	return postBody(ctx, client, url, header, body, destination)
+}
+
+// resourceMetrics groups the samples by their resource labels. Samples without a
+// timestamp get now.
+func (o *OTLP) resourceMetrics(samples []MetricSample, now time.Time) []*metricspb.ResourceMetrics {
+	var (
+		resources []*metricspb.ResourceMetrics
+		byKey     = make(map[string]*metricspb.ResourceMetrics)
+		metrics   = make(map[string]map[string]*metricspb.Metric)
+	)
+	for _, sample := range samples {
+		resourceLabels, pointLabels := o.splitLabels(sample.Labels)
+		key := labelsKey(resourceLabels)
+		resource, ok := byKey[key]
+		if !ok {
+			attributes := append([]*commonpb.KeyValue{stringAttribute("service.name", o.options.ServiceName)}, attributes(resourceLabels)...)
+			resource = &metricspb.ResourceMetrics{
+				Resource:     &resourcepb.Resource{Attributes: attributes},
+				ScopeMetrics: []*metricspb.ScopeMetrics{{Scope: otlpScope}},
+			}
+			byKey[key] = resource
+			metrics[key] = make(map[string]*metricspb.Metric)
+			resources = append(resources, resource)
+		}
+
+		timestamp := sample.Timestamp
+		if timestamp.IsZero() {
+			timestamp = now
+		}
+		metric, ok := metrics[key][sample.Name]
+		if !ok {
+			metric = newOTLPMetric(sample)
+			metrics[key][sample.Name] = metric
+			resource.ScopeMetrics[0].Metrics = append(resource.ScopeMetrics[0].Metrics, metric)
+		}
+		addDataPoint(metric, sample, attributes(pointLabels), uint64(timestamp.UnixNano()))
+	}
+	return resources
+}
+
+// splitLabels separates the resource labels from the data point labels.
+func (o *OTLP) splitLabels(labels map[string]string) (resource, point map[string]string) {
+	resource = make(map[string]string)
+	point = make(map[string]string)
+	for name, value := range labels {
+		if _, ok := o.resourceLabels[name]; ok {
+			resource[name] = value
+		} else {
+			point[name] = value
+		}
+	}
+	return resource, point
+}
+
+func newOTLPMetric(sample MetricSample) *metricspb.Metric {
+	metric := &metricspb.Metric{Name: sample.Name, Description: sample.Help}
+	switch sample.Type {
+	case MetricSum:
+		metric.Data = &metricspb.Metric_Sum{Sum: &metricspb.Sum{
+			AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA,
+			IsMonotonic:            true,
+		}}
+	case MetricHistogram:
+		metric.Data = &metricspb.Metric_Histogram{Histogram: &metricspb.Histogram{
+			AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA,
+		}}
+	default:
+		metric.Data = &metricspb.Metric_Gauge{Gauge: &metricspb.Gauge{}}
+	}
+	return metric
+}
+
+// addDataPoint adds the value of a sample to metric. A histogram data point holds
+// the single observation of the event.
+func addDataPoint(metric *metricspb.Metric, sample MetricSample, attributes []*commonpb.KeyValue, timestamp uint64) {
+	number := &metricspb.NumberDataPoint{
+		Attributes:        attributes,
+		StartTimeUnixNano: timestamp,
+		TimeUnixNano:      timestamp,
+		Value:             &metricspb.NumberDataPoint_AsDouble{AsDouble: sample.Value},
+	}
+	switch data := metric.Data.(type) {
+	case *metricspb.Metric_Gauge:
+		number.StartTimeUnixNano = 0
+		data.Gauge.DataPoints = append(data.Gauge.DataPoints, number)
+	case *metricspb.Metric_Sum:
+		data.Sum.DataPoints = append(data.Sum.DataPoints, number)
+	case *metricspb.Metric_Histogram:
+		buckets := sample.Buckets
+		if len(buckets) == 0 {
+			buckets = DefaultBuckets
+		}
+		counts := make([]uint64, len(buckets)+1)
+		counts[sort.SearchFloat64s(buckets, sample.Value)]++
+		value := sample.Value
+		data.Histogram.DataPoints = append(data.Histogram.DataPoints, &metricspb.HistogramDataPoint{
+			Attributes:        attributes,
+			StartTimeUnixNano: timestamp,
+			TimeUnixNano:      timestamp,
+			Count:             1,
+			Sum:               &value,
+			Min:               &value,
+			Max:               &value,
+			ExplicitBounds:    buckets,
+			BucketCounts:      counts,
+		})
+	}
+}
+
+// attributes converts labels into string attributes sorted by name.
+func attributes(labels map[string]string) []*commonpb.KeyValue {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	kvs := make([]*commonpb.KeyValue, 0, len(names))
+	for _, name := range names {
+		kvs = append(kvs, stringAttribute(name, labels[name]))
+	}
+	return kvs
+}
+
+func stringAttribute(key, value string) *commonpb.KeyValue {
+	return &commonpb.KeyValue{Key: key, Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: value}}}
+}
+
+// labelsKey identifies a label set.
+func labelsKey(labels map[string]string) string {
+	var key strings.Builder
+	for _, kv := range attributes(labels) {
+		key.WriteString(kv.Key)
+		key.WriteByte(0)
+		key.WriteString(kv.Value.GetStringValue())
+		key.WriteByte(0)
+	}
+	return key.String()
+}
@@ -0,0 +1,117 @@
+package api
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// otlpCollector decodes the export requests it receives.
+func otlpCollector(t *testing.T, requests *[]*colmetricspb.ExportMetricsServiceRequest) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		request := &colmetricspb.ExportMetricsServiceRequest{}
+		switch r.Header.Get("Content-Type") {
+		case "application/json":
+			assert.Contains(t, string(body), `"aggregationTemporality":1`, "enums are numbers")
+			require.NoError(t, protojson.Unmarshal(body, request))
+		case "application/x-protobuf":
+			require.NoError(t, proto.Unmarshal(body, request))
+		default:
+			t.Errorf("unexpected content type %s", r.Header.Get("Content-Type"))
+		}
+		*requests = append(*requests, request)
+	}))
+}
+
+// stringAttributes converts string attributes into a map.
+func stringAttributes(kvs []*commonpb.KeyValue) map[string]string {
+	attributes := make(map[string]string, len(kvs))
+	for _, kv := range kvs {
+		attributes[kv.Key] = kv.Value.GetStringValue()
+	}
+	return attributes
+}
+
+func TestOTLPEmit(t *testing.T) {
+	received := time.Date(2025, 3, 16, 12, 0, 0, 0, time.UTC)
+	samples := []MetricSample{
+		{Name: "spacelift_run_state", Help: "Current state", Labels: map[string]string{"stack": "infra", "state": "FINISHED"}, Value: 1, Timestamp: received},
+		{Name: "spacelift_runs_total", Type: MetricSum, Labels: map[string]string{"stack": "infra", "state": "FINISHED"}, Value: 1, Timestamp: received},
+		{Name: "spacelift_run_duration_seconds", Type: MetricHistogram, Buckets: []float64{60, 300}, Labels: map[string]string{"stack": "infra"}, Value: 60, Timestamp: received},
+		{Name: "spacelift_run_state", Labels: map[string]string{"stack": "network", "state": "FAILED"}, Value: 1, Timestamp: received},
+	}
+
+	for _, encoding := range []string{OTLPProtobuf, OTLPJSON} {
+		t.Run(encoding, func(t *testing.T) {
+			var requests []*colmetricspb.ExportMetricsServiceRequest
+			collector := otlpCollector(t, &requests)
+			defer collector.Close()
+
+			sink, err := NewOTLP(collector.URL, collector.Client(), OTLPOptions{Encoding: encoding, ResourceLabels: []string{"stack"}})
+			require.NoError(t, err)
+			require.NoError(t, sink.Emit(context.Background(), samples))
+			require.Len(t, requests, 1)
+
+			resources := requests[0].ResourceMetrics
+			require.Len(t, resources, 2, "one resource per stack")
+			assert.Equal(t, map[string]string{"service.name": "spacelift-pushgateway", "stack": "infra"}, stringAttributes(resources[0].Resource.Attributes))
+			assert.Equal(t, map[string]string{"service.name": "spacelift-pushgateway", "stack": "network"}, stringAttributes(resources[1].Resource.Attributes))
+			assert.Equal(t, "spacelift-pushgateway", resources[0].ScopeMetrics[0].Scope.Name)
+
+			metrics := resources[0].ScopeMetrics[0].Metrics
+			require.Len(t, metrics, 3)
+
+			gauge := metrics[0]
+			assert.Equal(t, "spacelift_run_state", gauge.Name)
+			assert.Equal(t, "Current state", gauge.Description)
+			require.Len(t, gauge.GetGauge().DataPoints, 1)
+			point := gauge.GetGauge().DataPoints[0]
+			assert.Equal(t, map[string]string{"state": "FINISHED"}, stringAttributes(point.Attributes))
+			assert.Equal(t, 1.0, point.GetAsDouble())
+			assert.Equal(t, uint64(received.UnixNano()), point.TimeUnixNano)
+
+			sum := metrics[1].GetSum()
+			require.NotNil(t, sum)
+			assert.True(t, sum.IsMonotonic)
+			assert.Equal(t, metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA, sum.AggregationTemporality)
+			assert.Equal(t, 1.0, sum.DataPoints[0].GetAsDouble())
+
+			histogram := metrics[2].GetHistogram()
+			require.NotNil(t, histogram)
+			require.Len(t, histogram.DataPoints, 1)
+			observation := histogram.DataPoints[0]
+			assert.Equal(t, uint64(1), observation.Count)
+			assert.Equal(t, 60.0, observation.GetSum())
+			assert.Equal(t, []float64{60, 300}, observation.ExplicitBounds)
+			assert.Equal(t, []uint64{1, 0, 0}, observation.BucketCounts, "the upper bound is inclusive")
+		})
+	}
+}
+
+func TestOTLPErrors(t *testing.T) {
+	_, err := NewOTLP("http://localhost:4318/v1/metrics", http.DefaultClient, OTLPOptions{Encoding: "xml"})
+	assert.ErrorContains(t, err, "unknown encoding 'xml'")
+
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "invalid metric", http.StatusBadRequest)
+	}))
+	defer collector.Close()
+	sink, err := NewOTLP(collector.URL, collector.Client(), OTLPOptions{})
+	require.NoError(t, err)
+	err = sink.Emit(context.Background(), []MetricSample{{Name: "spacelift_run"}})
+	assert.ErrorContains(t, err, "invalid metric")
+	assert.True(t, IsPermanent(err))
+}
@@ -1,13 +1,18 @@
 package api
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/push"
 	log "github.com/sirupsen/logrus"
 	"io"
 
+	"net"
 	"net/http"
+	"strings"
 	"time"
 )
 
@@ -16,22 +21,37 @@ type PushGateway struct {
 	targetMetric     string
 	targetMetricHelp string
 	jobName          string
+	client           *http.Client
 }
 
 func NewPushGateway(pushGatewayURL string, targetMetric string, targetMetricHelp string, jobName string) *PushGateway {
+	return NewPushGatewayWithClient(pushGatewayURL, targetMetric, targetMetricHelp, jobName, &http.Client{Timeout: 5 * time.Second})
+}
+
+// NewPushGatewayWithClient uses client for pushes and status checks, e.g. to add
+// authentication or a custom CA.
+func NewPushGatewayWithClient(pushGatewayURL string, targetMetric string, targetMetricHelp string, jobName string, client *http.Client) *PushGateway {
 	return &PushGateway{
 		pushGatewayURL:   pushGatewayURL,
 		targetMetric:     targetMetric,
 		jobName:          jobName,
 		targetMetricHelp: targetMetricHelp,
-		//fieldsToExtract: fieldsToExtract,
+		client:           client,
 	}
 }
+
 func (p *PushGateway) CheckPushGatewayStatus() error {
-	client := &http.Client{Timeout: 5 * time.Second}
+	return p.Health(context.Background())
+}
 
+// Health checks that the Pushgateway answers on /metrics.
+func (p *PushGateway) Health(ctx context.Context) error {
 	// Anfrage an den /metrics-Endpoint senden
-	resp, err := client.Get(fmt.Sprintf("%s/metrics", p.pushGatewayURL))
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/metrics", p.pushGatewayURL), nil)
+	if err != nil {
+		return fmt.Errorf("invalid Pushgateway URL: %v", err)
+	}
+	resp, err := p.client.Do(request)
 	if err != nil {
 		return fmt.Errorf("failed to connect to Pushgateway: %v", err)
 	}
@@ -50,6 +70,11 @@ func (p *PushGateway) CheckPushGatewayStatus() error {
 }
 
 func (p *PushGateway) ValidateLabels(labels map[string]interface{}) (bool, []error) {
+	return ValidateLabels(labels)
+}
+
+// ValidateLabels checks that the keys are valid Prometheus label names.
+func ValidateLabels(labels map[string]interface{}) (bool, []error) {
 	var errors []error
 	var hasErrors = false
 	for i, l := range keys(labels) {
@@ -81,37 +106,93 @@ func keys(labels map[string]interface{}) []string {
 	return keys
 }
 
+// PushMetrics pushes the target metric with the given labels, using the current unix time as value.
 func (p *PushGateway) PushMetrics(labelPairs map[string]interface{}) error {
-	output := make(map[string]string)
-	for key, value := range labelPairs {
-		switch v := value.(type) {
-		case string:
-			output[key] = v
-		case int, int64, float64:
-			output[key] = fmt.Sprintf("%v", v) // Zahlen in String umwandeln
-		case bool:
-			output[key] = fmt.Sprintf("%t", v) // Boolesche Werte in "true"/"false" umwandeln
-		case time.Time:
-			output[key] = v.Format(time.RFC3339) // Zeitstempel als RFC3339-String speichern
-		default:
-			log.Printf("Warning: Ignoring unsupported label type for key '%s'", key)
+	return p.PushMetricsWithValue(labelPairs, float64(time.Now().Unix()))
+}
+
+// PushMetricsWithValue pushes the target metric with the given labels and value.
+func (p *PushGateway) PushMetricsWithValue(labelPairs map[string]interface{}, value float64) error {
+	return p.PushSamples([]MetricSample{{
+		Name:   p.targetMetric,
+		Help:   p.targetMetricHelp,
+		Labels: LabelValues(labelPairs),
+		Value:  value,
+	}})
+}
+
+// PushSamples pushes all samples in a single request. The Pushgateway replaces all
+// metrics of the job with every push, so samples of one event must be pushed together.
+func (p *PushGateway) PushSamples(samples []MetricSample) error {
+	return p.Emit(context.Background(), samples)
+}
+
+// Emit pushes the samples of one event, see PushSamples. Samples the Pushgateway
+// cannot collect and responses with a 4xx status other than 429 are marked as
+// Permanent errors.
+func (p *PushGateway) Emit(ctx context.Context, samples []MetricSample) error {
+	client := &statusRecorder{client: p.client}
+	pusher := push.New(p.pushGatewayURL, p.jobName).Client(client)
+	for _, sample := range samples {
+		metric := prometheus.NewGauge(prometheus.GaugeOpts{
+			Name:        sample.Name,
+			Help:        sample.Help,
+			ConstLabels: sample.Labels,
+		})
+		metric.Set(sample.Value)
+		pusher = pusher.Collector(metric)
+	}
+
+	if err := pusher.PushContext(ctx); err != nil {
+		status := client.status
+		if status != nil {
+			err = status
 		}
+		err = fmt.Errorf("failed to push to Pushgateway: %w", err)
+		if PushErrorType(err) == "invalid" || status != nil && status.Code/100 == 4 && status.Code != http.StatusTooManyRequests {
+			return Permanent(err)
+		}
+		return err
 	}
 
-	metric := prometheus.NewGauge(prometheus.GaugeOpts{
-		Name:        p.targetMetric,
-		Help:        p.targetMetricHelp,
-		ConstLabels: output,
-	})
+	return nil
+}
 
-	metric.Set(float64(time.Now().Unix()))
+// statusRecorder is the HTTP client of a single push. It keeps an unsuccessful
+// response as StatusError, the push library reports it as plain text only.
+type statusRecorder struct {
+	client push.HTTPDoer
+	status *StatusError
+}
 
-	err := push.New(p.pushGatewayURL, p.jobName).
-		Collector(metric).
-		Push()
-	if err != nil {
-		return fmt.Errorf("failed to push to Pushgateway: %v", err)
+func (r *statusRecorder) Do(request *http.Request) (*http.Response, error) {
+	resp, err := r.client.Do(request)
+	if err != nil || resp.StatusCode/100 == 2 {
+		return resp, err
 	}
+	message, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	resp.Body = io.NopCloser(bytes.NewReader(message))
+	r.status = &StatusError{Destination: "Pushgateway push", Code: resp.StatusCode, Message: strings.TrimSpace(string(message))}
+	return resp, nil
+}
 
-	return nil
+// PushErrorType classifies an error returned by a sink as "timeout", "connection",
+// "status" (the receiver rejected the push, see StatusError) or "invalid" (the
+// samples could not be encoded or collected).
+func PushErrorType(err error) string {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return "timeout"
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		if netErr.Timeout() {
+			return "timeout"
+		}
+		return "connection"
+	}
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return "status"
+	}
+	return "invalid"
 }
@@ -0,0 +1,105 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPushSamplesErrorTypes(t *testing.T) {
+	samples := []MetricSample{{Name: "spacelift_run", Labels: map[string]string{"state": "FINISHED"}, Value: 1}}
+
+	ok := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ok.Close()
+	assert.NoError(t, NewPushGateway(ok.URL, "", "", "job").PushSamples(samples))
+
+	rejecting := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "pushed metrics are invalid", http.StatusBadRequest)
+	}))
+	defer rejecting.Close()
+	err := NewPushGateway(rejecting.URL, "", "", "job").PushSamples(samples)
+	assert.Equal(t, "status", PushErrorType(err))
+	var statusErr *StatusError
+	if assert.ErrorAs(t, err, &statusErr) {
+		assert.Equal(t, http.StatusBadRequest, statusErr.Code)
+		assert.Equal(t, "pushed metrics are invalid", statusErr.Message)
+	}
+	assert.True(t, IsPermanent(err), "a rejected push is not retried")
+
+	for _, code := range []int{http.StatusUnauthorized, http.StatusTooManyRequests, http.StatusServiceUnavailable} {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(code)
+		}))
+		err := NewPushGateway(server.URL, "", "", "job").PushSamples(samples)
+		server.Close()
+		assert.Equal(t, "status", PushErrorType(err), code)
+		assert.Equal(t, code == http.StatusUnauthorized, IsPermanent(err), code)
+	}
+
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	err = NewPushGateway(closed.URL, "", "", "job").PushSamples(samples)
+	assert.Equal(t, "connection", PushErrorType(err))
+	assert.False(t, IsPermanent(err))
+
+	invalid := append(samples, MetricSample{Name: "spacelift_run", Labels: map[string]string{"other": "x"}, Value: 1})
+	err = NewPushGateway(ok.URL, "", "", "job").PushSamples(invalid)
+	assert.Equal(t, "invalid", PushErrorType(err))
+}
+
+func TestPushErrorType(t *testing.T) {
+	tests := []struct {
+		err      error
+		expected string
+	}{
+		{fmt.Errorf("failed to send: %w", &url.Error{Op: "Post", URL: "http://localhost", Err: context.DeadlineExceeded}), "timeout"},
+		{fmt.Errorf("failed to send: %w", context.DeadlineExceeded), "timeout"},
+		{&net.OpError{Op: "write", Net: "udp", Err: syscall.ECONNREFUSED}, "connection"},
+		{Permanent(&StatusError{Destination: "remote write", Code: http.StatusBadRequest}), "status"},
+		{errors.Join(fmt.Errorf("target 0: invalid"), &StatusError{Destination: "webhook target 1", Code: http.StatusBadGateway}), "status"},
+		{Permanent(fmt.Errorf("encoding event: unsupported value")), "invalid"},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.expected, PushErrorType(tt.err), tt.err.Error())
+	}
+}
+
+type headerTransport struct {
+	header string
+}
+
+func (t headerTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	request = request.Clone(request.Context())
+	request.Header.Set("Authorization", t.header)
+	return http.DefaultTransport.RoundTrip(request)
+}
+
+func TestPushGatewayUsesClient(t *testing.T) {
+	var authorized []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		authorized = append(authorized, r.Method)
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: headerTransport{header: "Bearer token"}}
+	gw := NewPushGatewayWithClient(server.URL, "spacelift_run", "", "job", client)
+	assert.NoError(t, gw.CheckPushGatewayStatus())
+	assert.NoError(t, gw.PushSamples([]MetricSample{{Name: "spacelift_run", Value: 1}}))
+	assert.Equal(t, []string{http.MethodGet, http.MethodPut}, authorized)
+
+	assert.ErrorContains(t, NewPushGateway(server.URL, "spacelift_run", "", "job").CheckPushGatewayStatus(), "401")
+}
@@ -0,0 +1,264 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// ErrQueueFull is returned by Enqueue when the queue has no room left.
+	ErrQueueFull = errors.New("push queue is full")
+	// ErrQueueClosed is returned by Enqueue after Close was called.
+	ErrQueueClosed = errors.New("push queue is closed")
+)
+
+// PushFunc pushes the samples of one event.
+type PushFunc func(samples []MetricSample) error
+
+// EmitFunc emits one event within ctx. Batched events are merged into one event
+// holding the samples of all of them.
+type EmitFunc func(ctx context.Context, ev Event) error
+
+// DefaultPushTimeout bounds a push attempt if QueueOptions.Timeout is not set.
+const DefaultPushTimeout = 30 * time.Second
+
+// PushResultFunc is called after every push with its error and duration.
+type PushResultFunc func(samples []MetricSample, err error, duration time.Duration)
+
+// Retry repeats failed pushes up to MaxAttempts times in total (default 1, no retries).
+// The backoff between attempts starts at InitialBackoff (default 1s) and doubles up
+// to MaxBackoff (default 30s). Errors marked with Permanent are not retried.
+type Retry struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+// backoff returns the wait before the given retry, starting with 1.
+func (r Retry) backoff(retry int) time.Duration {
+	initial, max := r.InitialBackoff, r.MaxBackoff
+	if initial <= 0 {
+		initial = time.Second
+	}
+	if max <= 0 {
+		max = 30 * time.Second
+	}
+	backoff := initial
+	for i := 1; i < retry && backoff < max; i++ {
+		backoff *= 2
+	}
+	return min(backoff, max)
+}
+
+// QueueOptions configure a PushQueue. Size bounds the number of waiting events.
+// With MaxBatchSamples, events waiting in the queue are merged into pushes of up to
+// that many samples; an event is never split. Retry configures retries of failed pushes.
+// Timeout bounds every attempt (default DefaultPushTimeout).
+type QueueOptions struct {
+	Size            int
+	Workers         int
+	MaxBatchSamples int
+	Retry           Retry
+	Timeout         time.Duration
+}
+
+// PushQueue pushes events in the background. Events are pushed in order when the
+// queue has a single worker.
+type PushQueue struct {
+	emit     EmitFunc
+	onResult PushResultFunc
+	options  QueueOptions
+	items    chan Event
+	pending  atomic.Int64
+	// ctx is canceled when Close gives up, so workers stop their pushes and do not
+	// wait for retries
+	ctx   context.Context
+	abort context.CancelFunc
+
+	mu     sync.RWMutex
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// NewPushQueue starts workers pushing queued events with push. size bounds the
+// number of waiting events. onResult may be nil.
+func NewPushQueue(push PushFunc, size, workers int, onResult PushResultFunc) *PushQueue {
+	emit := func(ctx context.Context, ev Event) error {
+		return push(ev.Samples)
+	}
+	return NewPushQueueWithOptions(emit, QueueOptions{Size: size, Workers: workers}, onResult)
+}
+
+// NewPushQueueWithOptions is NewPushQueue for whole events, with batching and
+// retries. onResult is called once per event, with the error of the last attempt
+// of its push.
+func NewPushQueueWithOptions(emit EmitFunc, options QueueOptions, onResult PushResultFunc) *PushQueue {
+	if options.Workers < 1 {
+		options.Workers = 1
+	}
+	if options.Timeout <= 0 {
+		options.Timeout = DefaultPushTimeout
+	}
+	ctx, abort := context.WithCancel(context.Background())
+	q := &PushQueue{
+		emit:     emit,
+		onResult: onResult,
+		options:  options,
+		items:    make(chan Event, options.Size),
+		ctx:      ctx,
+		abort:    abort,
+	}
+	for i := 0; i < options.Workers; i++ {
+		q.wg.Add(1)
+		go q.work()
+	}
+	return q
+}
+
+func (q *PushQueue) work() {
+	defer q.wg.Done()
+	var next *Event
+	for {
+		var events []Event
+		if next != nil {
+			events, next = []Event{*next}, nil
+		} else {
+			ev, ok := <-q.items
+			if !ok {
+				return
+			}
+			events = []Event{ev}
+		}
+		events, next = q.batch(events)
+
+		batch := events[0]
+		if len(events) > 1 {
+			batch = Event{}
+			for _, ev := range events {
+				batch.Samples = append(batch.Samples, ev.Samples...)
+			}
+		}
+		start := time.Now()
+		err := q.pushWithRetries(batch)
+		duration := time.Since(start)
+		for _, ev := range events {
+			if q.onResult != nil {
+				q.onResult(ev.Samples, err, duration)
+			}
+			if ev.Done != nil {
+				ev.Done(err)
+			}
+			q.pending.Add(-1)
+		}
+	}
+}
+
+// batch adds waiting events to events while their samples fit into MaxBatchSamples.
+// It does not wait for events. The first event not fitting is returned as next.
+func (q *PushQueue) batch(events []Event) (batch []Event, next *Event) {
+	if q.options.MaxBatchSamples <= 0 {
+		return events, nil
+	}
+	count := len(events[0].Samples)
+	for count < q.options.MaxBatchSamples {
+		select {
+		case ev, ok := <-q.items:
+			if !ok {
+				return events, nil
+			}
+			if count+len(ev.Samples) > q.options.MaxBatchSamples {
+				return events, &ev
+			}
+			events = append(events, ev)
+			count += len(ev.Samples)
+		default:
+			return events, nil
+		}
+	}
+	return events, nil
+}
+
+// pushWithRetries emits ev until an attempt succeeds, fails permanently, the
+// attempts are used up or Close gives up.
+func (q *PushQueue) pushWithRetries(ev Event) error {
+	err := q.attempt(ev)
+	retry := q.options.Retry
+	for attempt := 2; err != nil && attempt <= retry.MaxAttempts && !IsPermanent(err); attempt++ {
+		backoff := retry.backoff(attempt - 1)
+		log.Warnf("Push failed, retrying in %s (attempt %d of %d): %v", backoff, attempt, retry.MaxAttempts, err)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-q.ctx.Done():
+			timer.Stop()
+			return err
+		}
+		err = q.attempt(ev)
+	}
+	return err
+}
+
+// attempt emits ev once, bounded by the timeout.
+func (q *PushQueue) attempt(ev Event) error {
+	ctx, cancel := context.WithTimeout(q.ctx, q.options.Timeout)
+	defer cancel()
+	return q.emit(ctx, ev)
+}
+
+// Enqueue adds the samples of one event without blocking.
+func (q *PushQueue) Enqueue(samples []MetricSample) error {
+	return q.EnqueueEvent(Event{Samples: samples})
+}
+
+// EnqueueEvent adds an event without blocking.
+func (q *PushQueue) EnqueueEvent(ev Event) error {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if q.closed {
+		return ErrQueueClosed
+	}
+	q.pending.Add(1)
+	select {
+	case q.items <- ev:
+		return nil
+	default:
+		q.pending.Add(-1)
+		return ErrQueueFull
+	}
+}
+
+// Len returns the number of events not pushed yet, including the ones being pushed.
+func (q *PushQueue) Len() int {
+	return int(q.pending.Load())
+}
+
+// Close stops accepting events and waits until all queued events are pushed or ctx
+// is done. It then cancels the running pushes.
+func (q *PushQueue) Close(ctx context.Context) error {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.items)
+	}
+	q.mu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		q.abort()
+		return nil
+	case <-ctx.Done():
+		q.abort()
+		return fmt.Errorf("%d events not pushed: %v", q.Len(), ctx.Err())
+	}
+}
@@ -0,0 +1,128 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPushQueueDrainsOnClose(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		pushed []string
+	)
+	queue := NewPushQueue(func(samples []MetricSample) error {
+		time.Sleep(time.Millisecond)
+		mu.Lock()
+		pushed = append(pushed, samples[0].Name)
+		mu.Unlock()
+		return nil
+	}, 10, 1, nil)
+
+	for _, name := range []string{"a", "b", "c"} {
+		assert.NoError(t, queue.Enqueue([]MetricSample{{Name: name}}))
+	}
+	assert.NoError(t, queue.Close(context.Background()))
+	assert.Equal(t, []string{"a", "b", "c"}, pushed)
+	assert.Equal(t, 0, queue.Len())
+	assert.ErrorIs(t, queue.Enqueue([]MetricSample{{Name: "d"}}), ErrQueueClosed)
+}
+
+func TestPushQueueFull(t *testing.T) {
+	release := make(chan struct{})
+	queue := NewPushQueue(func(samples []MetricSample) error {
+		<-release
+		return nil
+	}, 1, 1, nil)
+
+	assert.NoError(t, queue.Enqueue(nil))
+	// The worker takes the first event, the second one waits in the queue
+	assert.Eventually(t, func() bool { return queue.Enqueue(nil) == nil }, time.Second, time.Millisecond)
+	assert.ErrorIs(t, queue.Enqueue(nil), ErrQueueFull)
+	assert.Equal(t, 2, queue.Len())
+
+	close(release)
+	assert.NoError(t, queue.Close(context.Background()))
+}
+
+func TestPushQueueCloseTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	var results int
+	queue := NewPushQueue(func(samples []MetricSample) error {
+		<-release
+		return nil
+	}, 1, 1, func(samples []MetricSample, err error, duration time.Duration) {
+		results++
+	})
+	assert.NoError(t, queue.Enqueue(nil))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorContains(t, queue.Close(ctx), "1 events not pushed")
+	assert.Equal(t, 0, results)
+}
+
+func TestPushQueueCallsDonePerEvent(t *testing.T) {
+	release := make(chan struct{})
+	var emits int
+	queue := NewPushQueueWithOptions(func(ctx context.Context, ev Event) error {
+		<-release
+		emits++
+		return errors.New("receiver down")
+	}, QueueOptions{Size: 10, MaxBatchSamples: 10}, nil)
+
+	var (
+		mu   sync.Mutex
+		done []string
+	)
+	for _, name := range []string{"a", "b", "c"} {
+		assert.NoError(t, queue.EnqueueEvent(Event{
+			Samples: []MetricSample{{Name: name}},
+			Done: func(err error) {
+				mu.Lock()
+				defer mu.Unlock()
+				done = append(done, name+": "+err.Error())
+			},
+		}))
+	}
+	close(release)
+	assert.NoError(t, queue.Close(context.Background()))
+	assert.LessOrEqual(t, emits, 3, "waiting events may be batched")
+	assert.ElementsMatch(t, []string{"a: receiver down", "b: receiver down", "c: receiver down"}, done)
+}
+
+func TestPushQueueTimesOutPushes(t *testing.T) {
+	pushed := make(chan error, 1)
+	queue := NewPushQueueWithOptions(func(ctx context.Context, ev Event) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}, QueueOptions{Size: 1, Timeout: 10 * time.Millisecond}, func(samples []MetricSample, err error, duration time.Duration) {
+		pushed <- err
+	})
+	assert.NoError(t, queue.Enqueue(nil))
+	assert.ErrorIs(t, <-pushed, context.DeadlineExceeded)
+	assert.NoError(t, queue.Close(context.Background()))
+}
+
+func TestPushQueueCloseCancelsPushes(t *testing.T) {
+	started, pushed := make(chan struct{}), make(chan error, 1)
+	queue := NewPushQueueWithOptions(func(ctx context.Context, ev Event) error {
+		close(started)
+		<-ctx.Done()
+		return ctx.Err()
+	}, QueueOptions{Size: 1, Timeout: time.Hour}, func(samples []MetricSample, err error, duration time.Duration) {
+		pushed <- err
+	})
+	assert.NoError(t, queue.Enqueue(nil))
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorContains(t, queue.Close(ctx), "1 events not pushed")
+	assert.ErrorIs(t, <-pushed, context.Canceled, "the running push is canceled")
+}
@@ -0,0 +1,91 @@
+package api
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// RateLimit is a token bucket: Rate requests per second on average with bursts of
+// up to Burst requests. A Rate of 0 disables the limit.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// RateLimiter keeps a token bucket per client, e.g. per API key or source IP.
+// Buckets of idle clients are evicted once they would be full again, so memory
+// is bounded by the clients active within Burst/Rate seconds.
+type RateLimiter struct {
+	limit RateLimit
+
+	mu          sync.Mutex
+	buckets     map[string]*bucket
+	lastCleanup time.Time
+}
+
+type bucket struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// NewRateLimiter returns a limiter for limit. A Burst below 1 is set to 1.
+func NewRateLimiter(limit RateLimit) *RateLimiter {
+	if limit.Burst < 1 {
+		limit.Burst = 1
+	}
+	return &RateLimiter{limit: limit, buckets: make(map[string]*bucket)}
+}
+
+// Allow takes a token from the bucket of client. If the bucket is empty, it returns
+// false and the time until the next token is available.
+func (l *RateLimiter) Allow(client string, now time.Time) (bool, time.Duration) {
+	if l.limit.Rate <= 0 {
+		return true, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.cleanup(now)
+
+	b, ok := l.buckets[client]
+	if !ok {
+		b = &bucket{limiter: rate.NewLimiter(rate.Limit(l.limit.Rate), l.limit.Burst)}
+		l.buckets[client] = b
+	}
+	b.lastSeen = now
+
+	reservation := b.limiter.ReserveN(now, 1)
+	if delay := reservation.DelayFrom(now); delay > 0 {
+		reservation.CancelAt(now)
+		return false, delay
+	}
+	return true, 0
+}
+
+// refillTime is the time an empty bucket needs to be full again.
+func (l *RateLimiter) refillTime() time.Duration {
+	return time.Duration(math.Ceil(float64(l.limit.Burst) / l.limit.Rate * float64(time.Second)))
+}
+
+// cleanup evicts full buckets, at most once per refill time.
+func (l *RateLimiter) cleanup(now time.Time) {
+	refill := l.refillTime()
+	if now.Sub(l.lastCleanup) < refill {
+		return
+	}
+	l.lastCleanup = now
+	for client, b := range l.buckets {
+		if now.Sub(b.lastSeen) >= refill {
+			delete(l.buckets, client)
+		}
+	}
+}
+
+// Len returns the number of tracked clients.
+func (l *RateLimiter) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.buckets)
+}
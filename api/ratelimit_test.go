@@ -0,0 +1,54 @@
+package api
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiterAllow(t *testing.T) {
+	now := time.Date(2025, 3, 16, 12, 0, 0, 0, time.UTC)
+	limiter := NewRateLimiter(RateLimit{Rate: 2, Burst: 3})
+
+	for i := 0; i < 3; i++ {
+		allowed, _ := limiter.Allow("spacelift", now)
+		assert.True(t, allowed, "burst request %d", i)
+	}
+	allowed, retryAfter := limiter.Allow("spacelift", now)
+	assert.False(t, allowed)
+	assert.Equal(t, 500*time.Millisecond, retryAfter)
+
+	allowed, _ = limiter.Allow("other", now)
+	assert.True(t, allowed, "clients have separate buckets")
+
+	// A rejected request does not consume a token
+	allowed, _ = limiter.Allow("spacelift", now.Add(500*time.Millisecond))
+	assert.True(t, allowed)
+	allowed, _ = limiter.Allow("spacelift", now.Add(500*time.Millisecond))
+	assert.False(t, allowed)
+}
+
+func TestRateLimiterEvictsIdleClients(t *testing.T) {
+	now := time.Date(2025, 3, 16, 12, 0, 0, 0, time.UTC)
+	limiter := NewRateLimiter(RateLimit{Rate: 1, Burst: 2})
+
+	limiter.Allow("a", now)
+	limiter.Allow("b", now.Add(time.Second))
+	assert.Equal(t, 2, limiter.Len())
+
+	// After the refill time of 2s, the bucket of a is full and evicted
+	limiter.Allow("c", now.Add(2*time.Second))
+	assert.Equal(t, 2, limiter.Len())
+	allowed, _ := limiter.Allow("a", now.Add(2*time.Second))
+	assert.True(t, allowed)
+}
+
+func TestRateLimiterDisabled(t *testing.T) {
+	limiter := NewRateLimiter(RateLimit{})
+	for i := 0; i < 100; i++ {
+		allowed, _ := limiter.Allow("spacelift", time.Now())
+		assert.True(t, allowed)
+	}
+	assert.Equal(t, 0, limiter.Len())
+}
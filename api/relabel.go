@@ -0,0 +1,163 @@
+package api
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Relabel rewrites label values after renaming, modelled after Prometheus' relabel_config.
+// The values of SourceLabels are joined with Separator (default ";") and matched
+// against Regex (default "(.*)", always anchored). Actions:
+//   - "replace" (default): set TargetLabel to Replacement (default "$1") expanded with
+//     the capture groups of Regex. Nothing happens if Regex does not match; an empty
+//     result removes TargetLabel.
+//   - "keep": drop the event if Regex does not match.
+//   - "drop": drop the event if Regex matches.
+//   - "labelmap": copy every label whose name matches Regex to the name Replacement expanded with the match.
+//   - "hashmod": set TargetLabel to the hash of the joined value modulo Modulus.
+//   - "lowercase": set TargetLabel to the lowercased joined value.
+type Relabel struct {
+	SourceLabels []string
+	Separator    string
+	Regex        string
+	TargetLabel  string
+	Replacement  string
+	Modulus      uint64
+	Action       string
+}
+
+type compiledRelabel struct {
+	Relabel
+	regex *regexp.Regexp
+}
+
+// Relabeler applies relabel rules. Rules are compiled once by NewRelabeler.
+type Relabeler struct {
+	rules []compiledRelabel
+}
+
+// NewRelabeler compiles the given rules and fills in defaults. All invalid rules are reported together.
+func NewRelabeler(rules []Relabel) (*Relabeler, error) {
+	var errs []error
+	relabeler := &Relabeler{}
+	for i, rule := range rules {
+		compiled, err := compileRelabel(rule)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("relabel %d: %v", i, err))
+			continue
+		}
+		relabeler.rules = append(relabeler.rules, compiled)
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return relabeler, nil
+}
+
+func compileRelabel(rule Relabel) (compiledRelabel, error) {
+	if rule.Separator == "" {
+		rule.Separator = ";"
+	}
+	if rule.Regex == "" {
+		rule.Regex = "(.*)"
+	}
+	if rule.Replacement == "" {
+		rule.Replacement = "$1"
+	}
+	if rule.Action == "" {
+		rule.Action = "replace"
+	}
+	compiled := compiledRelabel{Relabel: rule}
+
+	switch rule.Action {
+	case "replace", "hashmod", "lowercase":
+		if rule.TargetLabel == "" {
+			return compiled, fmt.Errorf("action %s needs a targetLabel", rule.Action)
+		}
+		if rule.Action == "hashmod" && rule.Modulus == 0 {
+			return compiled, fmt.Errorf("action hashmod needs a modulus")
+		}
+	case "keep", "drop":
+		if len(rule.SourceLabels) == 0 {
+			return compiled, fmt.Errorf("action %s needs sourceLabels", rule.Action)
+		}
+	case "labelmap":
+	default:
+		return compiled, fmt.Errorf("unknown action '%s'", rule.Action)
+	}
+
+	re, err := regexp.Compile("^(?:" + rule.Regex + ")$")
+	if err != nil {
+		return compiled, fmt.Errorf("failed to compile regex '%s': %v", rule.Regex, err)
+	}
+	compiled.regex = re
+	return compiled, nil
+}
+
+// Apply runs all rules on a copy of labels. keep is false if a keep or drop rule rejected the event.
+func (r *Relabeler) Apply(labels map[string]interface{}) (result map[string]interface{}, keep bool) {
+	result = make(map[string]interface{}, len(labels))
+	for key, value := range labels {
+		result[key] = value
+	}
+	for _, rule := range r.rules {
+		if !rule.apply(result) {
+			return nil, false
+		}
+	}
+	return result, true
+}
+
+// apply runs a single rule on labels in place and reports whether the event is kept.
+func (r compiledRelabel) apply(labels map[string]interface{}) bool {
+	values := make([]string, 0, len(r.SourceLabels))
+	for _, name := range r.SourceLabels {
+		value := ""
+		if v, ok := labels[name]; ok && v != nil {
+			value = FormatValue(v)
+		}
+		values = append(values, value)
+	}
+	joined := strings.Join(values, r.Separator)
+
+	switch r.Action {
+	case "keep":
+		return r.regex.MatchString(joined)
+	case "drop":
+		return !r.regex.MatchString(joined)
+	case "replace":
+		match := r.regex.FindStringSubmatchIndex(joined)
+		if match == nil {
+			return true
+		}
+		target := string(r.regex.ExpandString(nil, r.TargetLabel, joined, match))
+		value := string(r.regex.ExpandString(nil, r.Replacement, joined, match))
+		if value == "" {
+			delete(labels, target)
+		} else {
+			labels[target] = value
+		}
+	case "labelmap":
+		mapped := make(map[string]interface{})
+		for name, value := range labels {
+			match := r.regex.FindStringSubmatchIndex(name)
+			if match == nil {
+				continue
+			}
+			mapped[string(r.regex.ExpandString(nil, r.Replacement, name, match))] = value
+		}
+		for name, value := range mapped {
+			labels[name] = value
+		}
+	case "hashmod":
+		sum := md5.Sum([]byte(joined))
+		labels[r.TargetLabel] = fmt.Sprintf("%d", binary.BigEndian.Uint64(sum[8:])%r.Modulus)
+	case "lowercase":
+		labels[r.TargetLabel] = strings.ToLower(joined)
+	}
+	return true
+}
@@ -0,0 +1,131 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRelabeler(t *testing.T) {
+	labels := map[string]interface{}{
+		"stackId":     "foo-ns-foo-prod",
+		"state":       "FINISHED",
+		"namespace":   "NS",
+		"label_env":   "prod",
+		"label_owner": "infra",
+	}
+
+	tests := []struct {
+		name         string
+		rules        []Relabel
+		expected     map[string]interface{}
+		expectedKeep bool
+	}{
+		{
+			name: "replace with capture groups",
+			rules: []Relabel{{
+				SourceLabels: []string{"stackId"},
+				Regex:        `(.*)-(prod|dev)`,
+				TargetLabel:  "stage",
+				Replacement:  "${2}_stage",
+			}},
+			expected:     map[string]interface{}{"stage": "prod_stage"},
+			expectedKeep: true,
+		},
+		{
+			name: "replace without match keeps labels",
+			rules: []Relabel{{
+				SourceLabels: []string{"stackId"},
+				Regex:        `bar-(.*)`,
+				TargetLabel:  "stage",
+			}},
+			expected:     map[string]interface{}{},
+			expectedKeep: true,
+		},
+		{
+			name: "replace with empty result removes the label",
+			rules: []Relabel{{
+				SourceLabels: []string{"missing"},
+				TargetLabel:  "namespace",
+			}},
+			expected:     map[string]interface{}{"namespace": nil},
+			expectedKeep: true,
+		},
+		{
+			name: "joined source labels",
+			rules: []Relabel{{
+				SourceLabels: []string{"namespace", "state"},
+				Separator:    "/",
+				TargetLabel:  "ns_state",
+			}},
+			expected:     map[string]interface{}{"ns_state": "NS/FINISHED"},
+			expectedKeep: true,
+		},
+		{
+			name:         "keep matching",
+			rules:        []Relabel{{Action: "keep", SourceLabels: []string{"state"}, Regex: "FINISHED|FAILED"}},
+			expected:     map[string]interface{}{},
+			expectedKeep: true,
+		},
+		{
+			name:         "keep not matching",
+			rules:        []Relabel{{Action: "keep", SourceLabels: []string{"state"}, Regex: "FINISH"}},
+			expectedKeep: false,
+		},
+		{
+			name:         "drop matching",
+			rules:        []Relabel{{Action: "drop", SourceLabels: []string{"namespace"}, Regex: "NS"}},
+			expectedKeep: false,
+		},
+		{
+			name:         "labelmap",
+			rules:        []Relabel{{Action: "labelmap", Regex: "label_(.+)"}},
+			expected:     map[string]interface{}{"env": "prod", "owner": "infra", "label_env": "prod"},
+			expectedKeep: true,
+		},
+		{
+			name:         "hashmod",
+			rules:        []Relabel{{Action: "hashmod", SourceLabels: []string{"stackId"}, TargetLabel: "shard", Modulus: 8}},
+			expected:     map[string]interface{}{"shard": "1"},
+			expectedKeep: true,
+		},
+		{
+			name:         "lowercase",
+			rules:        []Relabel{{Action: "lowercase", SourceLabels: []string{"namespace"}, TargetLabel: "namespace"}},
+			expected:     map[string]interface{}{"namespace": "ns"},
+			expectedKeep: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			relabeler, err := NewRelabeler(tt.rules)
+			assert.NoError(t, err)
+			result, keep := relabeler.Apply(labels)
+			assert.Equal(t, tt.expectedKeep, keep)
+			for key, value := range tt.expected {
+				if value == nil {
+					assert.NotContains(t, result, key)
+					continue
+				}
+				assert.Equal(t, value, result[key], key)
+			}
+		})
+	}
+	assert.Equal(t, "NS", labels["namespace"], "input labels must not be modified")
+}
+
+func TestNewRelabelerReportsAllErrors(t *testing.T) {
+	_, err := NewRelabeler([]Relabel{
+		{Action: "replace"},
+		{Action: "keep"},
+		{Action: "hashmod", TargetLabel: "shard"},
+		{Action: "explode"},
+		{Action: "lowercase", TargetLabel: "x", Regex: "("},
+		{Action: "labelmap", Regex: "label_(.+)"},
+	})
+	for _, expected := range []string{"relabel 0", "relabel 1", "relabel 2", "relabel 3", "relabel 4"} {
+		assert.ErrorContains(t, err, expected)
+	}
+	assert.NotContains(t, err.Error(), "relabel 5")
+}
@@ -0,0 +1,139 @@
+package api
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/golang/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// DefaultMaxSamplesPerSend is the batch size of a RemoteWrite without an explicit one.
+const DefaultMaxSamplesPerSend = 500
+
+// Metric type GAUGE of the remote write MetricMetadata.
+const remoteWriteGauge = 2
+
+// RemoteWrite writes samples with the Prometheus remote write protocol (version 1),
+// e.g. to Mimir, Thanos or Prometheus itself. Samples are sent as gauges with the
+// time their event was received.
+type RemoteWrite struct {
+	url               string
+	healthURL         string
+	maxSamplesPerSend int
+	client            *http.Client
+}
+
+// NewRemoteWrite sends to url with client, which adds headers and authentication.
+// Waiting events are sent together in requests of up to maxSamplesPerSend samples
+// (0: DefaultMaxSamplesPerSend). healthURL is checked by Health, e.g. the /ready
+// endpoint of the receiver; without it the sink is always healthy.
+func NewRemoteWrite(url string, client *http.Client, maxSamplesPerSend int, healthURL string) *RemoteWrite {
+	if maxSamplesPerSend <= 0 {
+		maxSamplesPerSend = DefaultMaxSamplesPerSend
+	}
+	return &RemoteWrite{
+		url:               url,
+		healthURL:         healthURL,
+		maxSamplesPerSend: maxSamplesPerSend,
+		client:            client,
+	}
+}
+
+// MaxBatchSamples makes RemoteWrite a BatchingSink.
+func (r *RemoteWrite) MaxBatchSamples() int {
+	return r.maxSamplesPerSend
+}
+
+// Emit sends the samples in a single snappy compressed WriteRequest. Requests the
+// receiver rejects with a 4xx status other than 429 are Permanent errors.
+func (r *RemoteWrite) Emit(ctx context.Context, samples []MetricSample) error {
+	header := http.Header{}
+	header.Set("Content-Type", "application/x-protobuf")
+	header.Set("Content-Encoding", "snappy")
+	header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	body := snappy.Encode(nil, encodeWriteRequest(samples, time.Now()))
+	return postBody(ctx, r.client, r.url, header, body, "remote write")
+}
+
+// Health checks that the health URL answers with a 2xx status.
+func (r *RemoteWrite) Health(ctx context.Context) error {
+	return checkHealthURL(ctx, r.client, r.healthURL, "remote write receiver")
+}
+
+// encodeWriteRequest encodes a prometheus.WriteRequest with one series per sample and
+// the help texts as metadata. Samples without a timestamp get now.
+//
+//	message WriteRequest   { repeated TimeSeries timeseries = 1; repeated MetricMetadata metadata = 3; }
+//	message TimeSeries     { repeated Label labels = 1; repeated Sample samples = 2; }
+//	message Label          { string name = 1; string value = 2; }
+//	message Sample         { double value = 1; int64 timestamp = 2; }
+//	message MetricMetadata { MetricType type = 1; string metric_family_name = 2; string help = 4; }
+func encodeWriteRequest(samples []MetricSample, now time.Time) []byte {
+	var request []byte
+	help := make(map[string]string)
+	for _, sample := range samples {
+		timestamp := sample.Timestamp
+		if timestamp.IsZero() {
+			timestamp = now
+		}
+		var series []byte
+		for _, label := range sortedLabels(sample) {
+			var l []byte
+			l = protowire.AppendTag(l, 1, protowire.BytesType)
+			l = protowire.AppendString(l, label[0])
+			l = protowire.AppendTag(l, 2, protowire.BytesType)
+			l = protowire.AppendString(l, label[1])
+			series = protowire.AppendTag(series, 1, protowire.BytesType)
+			series = protowire.AppendBytes(series, l)
+		}
+		var s []byte
+		s = protowire.AppendTag(s, 1, protowire.Fixed64Type)
+		s = protowire.AppendFixed64(s, math.Float64bits(sample.Value))
+		s = protowire.AppendTag(s, 2, protowire.VarintType)
+		s = protowire.AppendVarint(s, uint64(timestamp.UnixMilli()))
+		series = protowire.AppendTag(series, 2, protowire.BytesType)
+		series = protowire.AppendBytes(series, s)
+
+		request = protowire.AppendTag(request, 1, protowire.BytesType)
+		request = protowire.AppendBytes(request, series)
+		if _, ok := help[sample.Name]; !ok || sample.Help != "" {
+			help[sample.Name] = sample.Help
+		}
+	}
+
+	names := make([]string, 0, len(help))
+	for name := range help {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		var m []byte
+		m = protowire.AppendTag(m, 1, protowire.VarintType)
+		m = protowire.AppendVarint(m, remoteWriteGauge)
+		m = protowire.AppendTag(m, 2, protowire.BytesType)
+		m = protowire.AppendString(m, name)
+		if help[name] != "" {
+			m = protowire.AppendTag(m, 4, protowire.BytesType)
+			m = protowire.AppendString(m, help[name])
+		}
+		request = protowire.AppendTag(request, 3, protowire.BytesType)
+		request = protowire.AppendBytes(request, m)
+	}
+	return request
+}
+
+// sortedLabels returns the labels of a sample including __name__, sorted by name
+// as remote write requires.
+func sortedLabels(sample MetricSample) [][2]string {
+	labels := make([][2]string, 0, len(sample.Labels)+1)
+	labels = append(labels, [2]string{"__name__", sample.Name})
+	for name, value := range sample.Labels {
+		labels = append(labels, [2]string{name, value})
+	}
+	sort.Slice(labels, func(i, j int) bool { return labels[i][0] < labels[j][0] })
+	return labels
+}
@@ -0,0 +1,230 @@
+package api
+
+import (
+	"context"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// writtenSeries is a decoded remote write series with a single sample.
+type writtenSeries struct {
+	Labels    map[string]string
+	Value     float64
+	Timestamp int64
+}
+
+// writeRequest is a decoded remote write request.
+type writeRequest struct {
+	Series []writtenSeries
+	// Help maps metric names to the help text of their metadata
+	Help map[string]string
+}
+
+// fields calls fn for every field of a protobuf message.
+func fields(t *testing.T, message []byte, fn func(number protowire.Number, typ protowire.Type, value []byte)) {
+	for len(message) > 0 {
+		number, typ, n := protowire.ConsumeTag(message)
+		require.GreaterOrEqual(t, n, 0, "invalid tag")
+		message = message[n:]
+		n = protowire.ConsumeFieldValue(number, typ, message)
+		require.GreaterOrEqual(t, n, 0, "invalid field %d", number)
+		fn(number, typ, message[:n])
+		message = message[n:]
+	}
+}
+
+func bytesValue(value []byte) []byte {
+	v, _ := protowire.ConsumeBytes(value)
+	return v
+}
+
+func decodeWriteRequest(t *testing.T, body []byte) writeRequest {
+	decoded, err := snappy.Decode(nil, body)
+	require.NoError(t, err)
+	request := writeRequest{Help: map[string]string{}}
+	fields(t, decoded, func(number protowire.Number, typ protowire.Type, value []byte) {
+		switch number {
+		case 1:
+			series := writtenSeries{Labels: map[string]string{}}
+			var lastName string
+			fields(t, bytesValue(value), func(number protowire.Number, typ protowire.Type, value []byte) {
+				switch number {
+				case 1:
+					var name, labelValue string
+					fields(t, bytesValue(value), func(number protowire.Number, typ protowire.Type, value []byte) {
+						if number == 1 {
+							name = string(bytesValue(value))
+						} else {
+							labelValue = string(bytesValue(value))
+						}
+					})
+					assert.Less(t, lastName, name, "labels must be sorted")
+					lastName = name
+					series.Labels[name] = labelValue
+				case 2:
+					fields(t, bytesValue(value), func(number protowire.Number, typ protowire.Type, value []byte) {
+						if number == 1 {
+							bits, _ := protowire.ConsumeFixed64(value)
+							series.Value = math.Float64frombits(bits)
+						} else {
+							timestamp, _ := protowire.ConsumeVarint(value)
+							series.Timestamp = int64(timestamp)
+						}
+					})
+				}
+			})
+			request.Series = append(request.Series, series)
+		case 3:
+			var name, help string
+			var metricType uint64
+			fields(t, bytesValue(value), func(number protowire.Number, typ protowire.Type, value []byte) {
+				switch number {
+				case 1:
+					metricType, _ = protowire.ConsumeVarint(value)
+				case 2:
+					name = string(bytesValue(value))
+				case 4:
+					help = string(bytesValue(value))
+				}
+			})
+			assert.Equal(t, uint64(remoteWriteGauge), metricType)
+			request.Help[name] = help
+		}
+	})
+	return request
+}
+
+// remoteWriteReceiver records the decoded requests and answers with status.
+type remoteWriteReceiver struct {
+	mu       sync.Mutex
+	requests []writeRequest
+	status   int
+}
+
+func (r *remoteWriteReceiver) handler(t *testing.T) http.HandlerFunc {
+	return func(w http.ResponseWriter, request *http.Request) {
+		assert.Equal(t, "snappy", request.Header.Get("Content-Encoding"))
+		assert.Equal(t, "application/x-protobuf", request.Header.Get("Content-Type"))
+		assert.Equal(t, "0.1.0", request.Header.Get("X-Prometheus-Remote-Write-Version"))
+		body, err := io.ReadAll(request.Body)
+		require.NoError(t, err)
+
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.requests = append(r.requests, decodeWriteRequest(t, body))
+		if r.status != 0 {
+			w.WriteHeader(r.status)
+			w.Write([]byte("out of order sample"))
+		}
+	}
+}
+
+func TestRemoteWriteEmit(t *testing.T) {
+	receiver := &remoteWriteReceiver{}
+	server := httptest.NewServer(receiver.handler(t))
+	defer server.Close()
+
+	received := time.Date(2025, 3, 16, 12, 0, 0, 0, time.UTC)
+	sink := NewRemoteWrite(server.URL, server.Client(), 0, "")
+	require.NoError(t, sink.Emit(context.Background(), []MetricSample{
+		{Name: "spacelift_run", Help: "Spacelift runs", Labels: map[string]string{"stack": "infra", "state": "FINISHED"}, Value: 1, Timestamp: received},
+		{Name: "spacelift_run_duration_seconds", Labels: map[string]string{"stack": "infra"}, Value: 42.5, Timestamp: received},
+	}))
+
+	require.Len(t, receiver.requests, 1)
+	assert.Equal(t, writeRequest{
+		Series: []writtenSeries{
+			{Labels: map[string]string{"__name__": "spacelift_run", "stack": "infra", "state": "FINISHED"}, Value: 1, Timestamp: received.UnixMilli()},
+			{Labels: map[string]string{"__name__": "spacelift_run_duration_seconds", "stack": "infra"}, Value: 42.5, Timestamp: received.UnixMilli()},
+		},
+		Help: map[string]string{"spacelift_run": "Spacelift runs", "spacelift_run_duration_seconds": ""},
+	}, receiver.requests[0])
+}
+
+func TestRemoteWriteErrors(t *testing.T) {
+	tests := []struct {
+		status    int
+		permanent bool
+	}{
+		{http.StatusBadRequest, true},
+		{http.StatusTooManyRequests, false},
+		{http.StatusServiceUnavailable, false},
+	}
+	for _, tt := range tests {
+		t.Run(http.StatusText(tt.status), func(t *testing.T) {
+			receiver := &remoteWriteReceiver{status: tt.status}
+			server := httptest.NewServer(receiver.handler(t))
+			defer server.Close()
+
+			err := NewRemoteWrite(server.URL, server.Client(), 0, "").Emit(context.Background(), []MetricSample{{Name: "spacelift_run"}})
+			assert.ErrorContains(t, err, "out of order sample")
+			assert.Equal(t, tt.permanent, IsPermanent(err))
+			assert.Equal(t, "status", PushErrorType(err))
+		})
+	}
+}
+
+func TestRemoteWriteBatchesWaitingEvents(t *testing.T) {
+	receiver := &remoteWriteReceiver{}
+	block := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-block
+		receiver.handler(t)(w, r)
+	}))
+	defer server.Close()
+
+	var results int
+	route := NewSinkRoute("remote", NewRemoteWrite(server.URL, server.Client(), 3, ""), nil, QueueOptions{Size: 10}, func(samples []MetricSample, err error, duration time.Duration) {
+		assert.NoError(t, err)
+		results++
+	})
+	// The first event fills a batch, the waiting events are batched by up to 3 samples
+	events := [][]MetricSample{
+		{{Name: "a"}, {Name: "a_2"}, {Name: "a_3"}},
+		{{Name: "b"}},
+		{{Name: "c"}, {Name: "c_2"}},
+		{{Name: "d"}},
+		{{Name: "e"}, {Name: "e_2"}},
+	}
+	for _, samples := range events {
+		require.NoError(t, route.Queue.Enqueue(samples))
+	}
+	close(block)
+	require.NoError(t, route.Queue.Close(context.Background()))
+
+	var batches [][]string
+	for _, request := range receiver.requests {
+		var names []string
+		for _, series := range request.Series {
+			names = append(names, series.Labels["__name__"])
+		}
+		batches = append(batches, names)
+	}
+	assert.Equal(t, 5, results, "one result per event")
+	assert.Equal(t, [][]string{{"a", "a_2", "a_3"}, {"b", "c", "c_2"}, {"d", "e", "e_2"}}, batches)
+}
+
+func TestRemoteWriteHealth(t *testing.T) {
+	status := http.StatusServiceUnavailable
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/ready", r.URL.Path)
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	assert.NoError(t, NewRemoteWrite(server.URL, server.Client(), 0, "").Health(context.Background()), "no health URL")
+	sink := NewRemoteWrite(server.URL, server.Client(), 0, server.URL+"/ready")
+	assert.ErrorContains(t, sink.Health(context.Background()), "503")
+	status = http.StatusOK
+	assert.NoError(t, sink.Health(context.Background()))
+}
@@ -1,50 +1,261 @@
 package api
 
 import (
+	"errors"
 	"fmt"
 	"regexp"
+	"sort"
 	"strings"
 )
 
+// Rename renames keys. Match selects how Key is compared against a key:
+//   - "regex" (default): every match of the regular expression Key is replaced with To.
+//     To may reference capture groups as $1 or ${name}; use ${1} when the group is
+//     followed by letters, digits or underscores, e.g. "${1}_id". Note that the regex
+//     is not anchored, use ^ and $ to match whole keys only.
+//   - "exact": a key equal to Key is replaced with To.
+//   - "prefix": a key starting with Key gets that prefix replaced with To.
+//
+// Rules are applied in order, each on the result of the previous one. With
+// StopOnMatch, no further rules are applied once this rule matched.
 type Rename struct {
-	Key string
-	To  string
+	Key         string
+	To          string
+	Match       string
+	StopOnMatch bool
 }
 
-// RenameKeys renames keys in a map[string]interface{} according to the regex patterns in renames
-func RenameKeys(m map[string]interface{}, renames []Rename) (map[string]interface{}, error) {
-	// Create a new map to store the renamed keys
-	renamedMap := make(map[string]interface{})
+// Collision policies for keys that end up with the same name after renaming.
+const (
+	// CollisionError fails the rename.
+	CollisionError = "error"
+	// CollisionFirst keeps the value of the key renamed by the earliest rule.
+	CollisionFirst = "first"
+	// CollisionJoin joins all values with a separator, in rule order.
+	CollisionJoin = "join"
+)
+
+// CollisionPolicy configures how RenameKeysWithPolicy resolves collisions.
+// Policy defaults to CollisionError, Separator to ",".
+type CollisionPolicy struct {
+	Policy    string
+	Separator string
+}
+
+// Validate reports unknown policies.
+func (p CollisionPolicy) Validate() error {
+	switch p.Policy {
+	case "", CollisionError, CollisionFirst, CollisionJoin:
+		return nil
+	}
+	return fmt.Errorf("unknown collision policy '%s', expected error, first or join", p.Policy)
+}
+
+// Collision describes source keys that were renamed to the same key.
+// Sources are ordered by the first rule that matched them; keys no rule matched
+// come last. Ties are ordered by name.
+type Collision struct {
+	Key     string
+	Sources []string
+}
+
+func (c Collision) String() string {
+	return fmt.Sprintf("%s <- %s", c.Key, strings.Join(c.Sources, ", "))
+}
+
+// CollisionErr is returned by RenameKeysWithPolicy for the CollisionError policy.
+type CollisionErr struct {
+	Collisions []Collision
+}
+
+func (e *CollisionErr) Error() string {
+	descriptions := make([]string, 0, len(e.Collisions))
+	for _, c := range e.Collisions {
+		descriptions = append(descriptions, c.String())
+	}
+	return fmt.Sprintf("rename collision: %s", strings.Join(descriptions, "; "))
+}
+
+type compiledRename struct {
+	Rename
+	regex *regexp.Regexp
+}
+
+// Renamer renames keys according to a list of rules. The rules are validated and
+// compiled once by NewRenamer, so Apply does no regex compilation per request.
+type Renamer struct {
+	rules  []compiledRename
+	policy CollisionPolicy
+}
 
-	// Iterate over each key in the original map
-	for oldKey, value := range m {
-		// Rename the key using the renameKey function
-		newKey, err := renameKey(oldKey, renames)
+// NewRenamer compiles the rename rules. All invalid rules and an invalid policy are reported together.
+func NewRenamer(renames []Rename, policy CollisionPolicy) (*Renamer, error) {
+	var errs []error
+	if err := policy.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	renamer := &Renamer{policy: policy}
+	for i, r := range renames {
+		compiled, err := compileRename(r)
 		if err != nil {
-			return nil, fmt.Errorf("error renaming key '%s': %v", oldKey, err)
+			errs = append(errs, fmt.Errorf("rename %d: %v", i, err))
+			continue
 		}
-		// Add the renamed key to the new map
-		renamedMap[newKey] = value
+		renamer.rules = append(renamer.rules, compiled)
 	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return renamer, nil
+}
 
-	return renamedMap, nil
+func compileRename(r Rename) (compiledRename, error) {
+	compiled := compiledRename{Rename: r}
+	if strings.TrimSpace(r.Key) == "" {
+		return compiled, fmt.Errorf("empty regex for Key")
+	}
+	if strings.TrimSpace(r.To) == "" {
+		return compiled, fmt.Errorf("empty To Value!")
+	}
+	switch r.Match {
+	case "", "regex":
+		// Compile the regex for the key to be replaced
+		re, err := regexp.Compile(r.Key)
+		if err != nil {
+			return compiled, fmt.Errorf("failed to compile regex for key '%s': %v", r.Key, err)
+		}
+		compiled.regex = re
+	case "exact", "prefix":
+	default:
+		return compiled, fmt.Errorf("unknown match '%s' for key '%s', expected exact, regex or prefix", r.Match, r.Key)
+	}
+	return compiled, nil
+}
+
+// RenameKeys renames keys in a map[string]interface{} according to the regex patterns in renames.
+// Keys renamed to the same name are an error.
+func RenameKeys(m map[string]interface{}, renames []Rename) (map[string]interface{}, error) {
+	renamedMap, _, err := RenameKeysWithPolicy(m, renames, CollisionPolicy{})
+	return renamedMap, err
+}
+
+// RenameKeysWithPolicy renames keys like RenameKeys and resolves keys renamed to the
+// same name according to policy. The rules are compiled on every call, use a Renamer
+// to rename many maps with the same rules.
+func RenameKeysWithPolicy(m map[string]interface{}, renames []Rename, policy CollisionPolicy) (map[string]interface{}, []Collision, error) {
+	renamer, err := NewRenamer(renames, policy)
+	if err != nil {
+		return nil, nil, err
+	}
+	return renamer.Apply(m)
+}
+
+// Apply returns a copy of m with renamed keys. Keys renamed to the same name are
+// resolved according to the collision policy; the collisions are returned sorted by key.
+func (r *Renamer) Apply(m map[string]interface{}) (map[string]interface{}, []Collision, error) {
+	type source struct {
+		key  string
+		rank int
+	}
+	// Collect the source keys for every new key
+	sources := make(map[string][]source)
+	for _, oldKey := range sortedKeys(m) {
+		newKey, rank := r.renameKey(oldKey)
+		sources[newKey] = append(sources[newKey], source{key: oldKey, rank: rank})
+	}
+
+	renamedMap := make(map[string]interface{}, len(sources))
+	var collisions []Collision
+	for _, newKey := range sortedKeys(sources) {
+		candidates := sources[newKey]
+		if len(candidates) == 1 {
+			renamedMap[newKey] = m[candidates[0].key]
+			continue
+		}
+
+		sort.Slice(candidates, func(i, j int) bool {
+			if candidates[i].rank != candidates[j].rank {
+				return candidates[i].rank < candidates[j].rank
+			}
+			return candidates[i].key < candidates[j].key
+		})
+		collision := Collision{Key: newKey}
+		for _, c := range candidates {
+			collision.Sources = append(collision.Sources, c.key)
+		}
+		collisions = append(collisions, collision)
+
+		switch r.policy.Policy {
+		case CollisionFirst:
+			renamedMap[newKey] = m[collision.Sources[0]]
+		case CollisionJoin:
+			separator := r.policy.Separator
+			if separator == "" {
+				separator = ","
+			}
+			values := make([]string, 0, len(collision.Sources))
+			for _, key := range collision.Sources {
+				values = append(values, FormatValue(m[key]))
+			}
+			renamedMap[newKey] = strings.Join(values, separator)
+		}
+	}
+
+	if len(collisions) > 0 && (r.policy.Policy == "" || r.policy.Policy == CollisionError) {
+		return nil, collisions, &CollisionErr{Collisions: collisions}
+	}
+	return renamedMap, collisions, nil
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
 }
 
 func renameKey(subject string, renames []Rename) (string, error) {
-	for _, r := range renames {
-		if strings.TrimSpace(r.Key) == "" {
-			return subject, fmt.Errorf("empty regex for Key")
+	renamer, err := NewRenamer(renames, CollisionPolicy{})
+	if err != nil {
+		return subject, err
+	}
+	renamed, _ := renamer.renameKey(subject)
+	return renamed, nil
+}
+
+// renameKey renames subject and returns the index of the first rule that matched it,
+// or the number of rules if no rule matched.
+func (r *Renamer) renameKey(subject string) (string, int) {
+	rank := len(r.rules)
+	for i, rule := range r.rules {
+		var matched bool
+		switch rule.Match {
+		case "", "regex":
+			// Replace all occurrences of the regex match in the subject with the "To" value
+			matched = rule.regex.MatchString(subject)
+			if matched {
+				subject = rule.regex.ReplaceAllString(subject, rule.To)
+			}
+		case "exact":
+			matched = subject == rule.Key
+			if matched {
+				subject = rule.To
+			}
+		case "prefix":
+			matched = strings.HasPrefix(subject, rule.Key)
+			if matched {
+				subject = rule.To + strings.TrimPrefix(subject, rule.Key)
+			}
 		}
-		if strings.TrimSpace(r.To) == "" {
-			return subject, fmt.Errorf("empty To Value!")
+
+		if matched && rank == len(r.rules) {
+			rank = i
 		}
-		// Compile the regex for the key to be replaced
-		re, err := regexp.Compile(r.Key)
-		if err != nil {
-			return subject, fmt.Errorf("failed to compile regex for key '%s': %v", r.Key, err)
+		if matched && rule.StopOnMatch {
+			break
 		}
-		// Replace all occurrences of the regex match in the subject with the "To" value
-		subject = re.ReplaceAllString(subject, r.To)
 	}
-	return subject, nil
+	return subject, rank
 }
@@ -1,7 +1,9 @@
 package api
 
 import (
+	"errors"
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -55,6 +57,85 @@ func TestRenameKey(t *testing.T) {
 			expected:      "hiworld", // Only "hello" will be replaced with "hi"
 			expectedError: false,
 		},
+		{
+			name:          "Unanchored regex dot matches any char",
+			subject:       "commit_author_url",
+			renames:       []Rename{{Key: "commit.author", To: "author"}},
+			expected:      "author_url",
+			expectedError: false,
+		},
+		{
+			name:          "Exact match",
+			subject:       "commit.author",
+			renames:       []Rename{{Key: "commit.author", To: "commit_author", Match: "exact"}},
+			expected:      "commit_author",
+			expectedError: false,
+		},
+		{
+			name:          "Exact match does not touch similar keys",
+			subject:       "commit_author_url",
+			renames:       []Rename{{Key: "commit.author", To: "commit_author", Match: "exact"}},
+			expected:      "commit_author_url",
+			expectedError: false,
+		},
+		{
+			name:          "Prefix match",
+			subject:       "labels.environment",
+			renames:       []Rename{{Key: "labels.", To: "label_", Match: "prefix"}},
+			expected:      "label_environment",
+			expectedError: false,
+		},
+		{
+			name:          "Capture groups",
+			subject:       "commit.createdAt",
+			renames:       []Rename{{Key: `^(\w+)\.(\w+)$`, To: "${2}_of_$1"}},
+			expected:      "createdAt_of_commit",
+			expectedError: false,
+		},
+		{
+			name:          "Named capture group",
+			subject:       "labels.class",
+			renames:       []Rename{{Key: `^labels\.(?P<name>.+)$`, To: "label_${name}"}},
+			expected:      "label_class",
+			expectedError: false,
+		},
+		{
+			name:    "Rules are chained",
+			subject: "commit.url",
+			renames: []Rename{
+				{Key: "commit.", To: "commit_", Match: "prefix"},
+				{Key: "_url$", To: "_link"},
+			},
+			expected:      "commit_link",
+			expectedError: false,
+		},
+		{
+			name:    "Stop on match",
+			subject: "commit.url",
+			renames: []Rename{
+				{Key: "commit.", To: "commit_", Match: "prefix", StopOnMatch: true},
+				{Key: "_url$", To: "_link"},
+			},
+			expected:      "commit_url",
+			expectedError: false,
+		},
+		{
+			name:    "Stop on match only if matched",
+			subject: "branch",
+			renames: []Rename{
+				{Key: "commit.", To: "commit_", Match: "prefix", StopOnMatch: true},
+				{Key: "^branch$", To: "git_branch"},
+			},
+			expected:      "git_branch",
+			expectedError: false,
+		},
+		{
+			name:          "Unknown match",
+			subject:       "branch",
+			renames:       []Rename{{Key: "branch", To: "git_branch", Match: "glob"}},
+			expected:      "branch",
+			expectedError: true,
+		},
 	}
 
 	for _, tt := range tests {
@@ -181,3 +262,197 @@ func TestRenameKeys(t *testing.T) {
 		})
 	}
 }
+
+func TestRenameKeysWithPolicy(t *testing.T) {
+	input := map[string]interface{}{
+		"labels.class": "platform",
+		"class":        "legacy",
+		"tags.class":   "infra",
+		"state":        "FINISHED",
+	}
+	renames := []Rename{
+		{Key: "tags.class", To: "class", Match: "exact"},
+		{Key: "labels.class", To: "class", Match: "exact"},
+	}
+
+	tests := []struct {
+		name               string
+		policy             CollisionPolicy
+		expected           map[string]interface{}
+		expectedCollisions []Collision
+		expectedError      bool
+	}{
+		{
+			name:               "error is the default",
+			policy:             CollisionPolicy{},
+			expectedCollisions: []Collision{{Key: "class", Sources: []string{"tags.class", "labels.class", "class"}}},
+			expectedError:      true,
+		},
+		{
+			name:   "prefer first by rule order",
+			policy: CollisionPolicy{Policy: CollisionFirst},
+			expected: map[string]interface{}{
+				"class": "infra",
+				"state": "FINISHED",
+			},
+			expectedCollisions: []Collision{{Key: "class", Sources: []string{"tags.class", "labels.class", "class"}}},
+		},
+		{
+			name:   "join in rule order",
+			policy: CollisionPolicy{Policy: CollisionJoin, Separator: "|"},
+			expected: map[string]interface{}{
+				"class": "infra|platform|legacy",
+				"state": "FINISHED",
+			},
+			expectedCollisions: []Collision{{Key: "class", Sources: []string{"tags.class", "labels.class", "class"}}},
+		},
+		{
+			name:          "unknown policy",
+			policy:        CollisionPolicy{Policy: "last"},
+			expectedError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Run several times, map iteration order must not change the result
+			for i := 0; i < 20; i++ {
+				result, collisions, err := RenameKeysWithPolicy(input, renames, tt.policy)
+				if (err != nil) != tt.expectedError {
+					t.Fatalf("expected error %v, but got error %v", tt.expectedError, err)
+				}
+				if !reflect.DeepEqual(collisions, tt.expectedCollisions) {
+					t.Fatalf("expected collisions %v, got %v", tt.expectedCollisions, collisions)
+				}
+				if !tt.expectedError && !reflect.DeepEqual(result, tt.expected) {
+					t.Fatalf("expected %v, got %v", tt.expected, result)
+				}
+			}
+		})
+	}
+}
+
+func TestRenameKeysCollisionError(t *testing.T) {
+	_, err := RenameKeys(map[string]interface{}{"a_x": 1, "b_x": 2}, []Rename{{Key: "^[ab]_", To: "c_"}})
+	var collisionErr *CollisionErr
+	if !errors.As(err, &collisionErr) {
+		t.Fatalf("expected a CollisionErr, got %v", err)
+	}
+	if err.Error() != "rename collision: c_x <- a_x, b_x" {
+		t.Errorf("unexpected message %q", err.Error())
+	}
+}
+
+func TestNewRenamerReportsAllErrors(t *testing.T) {
+	_, err := NewRenamer([]Rename{
+		{Key: "hello(", To: "gopher"},
+		{Key: "^ok$", To: "fine"},
+		{Key: " ", To: "x"},
+		{Key: "x", To: ""},
+		{Key: "x", To: "y", Match: "glob"},
+	}, CollisionPolicy{Policy: "last"})
+	if err == nil {
+		t.Fatal("Expected an error but got none")
+	}
+	for _, expected := range []string{"rename 0", "rename 2", "rename 3", "rename 4", "collision policy"} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("Expected error to mention %q, got: %v", expected, err)
+		}
+	}
+	if strings.Contains(err.Error(), "rename 1") {
+		t.Errorf("Did not expect rule 1 to be reported: %v", err)
+	}
+}
+
+func TestRenamerApply(t *testing.T) {
+	renamer, err := NewRenamer([]Rename{{Key: "commit.", To: "commit_", Match: "prefix"}}, CollisionPolicy{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	input := map[string]interface{}{"commit.hash": "e9ea5a5", "state": "FINISHED"}
+	// The renamer is reused for many maps
+	for i := 0; i < 3; i++ {
+		result, collisions, err := renamer.Apply(input)
+		if err != nil || len(collisions) > 0 {
+			t.Fatalf("Unexpected error %v or collisions %v", err, collisions)
+		}
+		expected := map[string]interface{}{"commit_hash": "e9ea5a5", "state": "FINISHED"}
+		if !reflect.DeepEqual(result, expected) {
+			t.Fatalf("Expected: %v, Got: %v", expected, result)
+		}
+	}
+	if _, ok := input["commit_hash"]; ok {
+		t.Error("Apply must not modify its input")
+	}
+}
+
+// benchmarkFields and benchmarkRenames resemble the example config.yaml.
+var (
+	benchmarkFields = map[string]interface{}{
+		"branch":           "master",
+		"name":             "foo",
+		"namespace":        "NS",
+		"projectRoot":      "stacks/foo-prod",
+		"repository":       "tg-foo",
+		"stackId":          "foo-ns-foo-prod",
+		"state":            "FINISHED",
+		"commit.author":    "hansihamster",
+		"commit.branch":    "update-foooo-terraform",
+		"commit.createdAt": "2025-03-16T05:43:18Z",
+		"commit.hash":      "e9ea5a543fce1b2d52207153f2d580431933b927",
+		"commit.issueId":   "INFRA-5032",
+		"commit.message":   "INFRA-5032: update foooo terraform",
+		"commit.url":       "https://github.com/projects/foo/repos/foo/commits/e9ea5a543fce1b2d52207153f2d580431933b927",
+		"labels.class":     "platform",
+	}
+	benchmarkRenames = []Rename{
+		{Key: "labels.class", To: "class"},
+		{Key: "commit.author", To: "commit_author"},
+		{Key: "commit.branch", To: "commit_branch"},
+		{Key: "commit.createdAt", To: "commit_created_at"},
+		{Key: "commit.hash", To: "commit_hash"},
+		{Key: "commit.issueId", To: "commit_issueId"},
+		{Key: "commit.message", To: "commit_message"},
+		{Key: "commit.url", To: "commit_url"},
+	}
+)
+
+// BenchmarkRenameKeys compiles the rules on every call, like every request did before Renamer.
+func BenchmarkRenameKeys(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		if _, err := RenameKeys(benchmarkFields, benchmarkRenames); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkRenamerApply is the per-request cost with rules compiled at config load.
+func BenchmarkRenamerApply(b *testing.B) {
+	renamer, err := NewRenamer(benchmarkRenames, CollisionPolicy{})
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := renamer.Apply(benchmarkFields); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkRenamerApplyExact uses exact and prefix rules, which need no regex at all.
+func BenchmarkRenamerApplyExact(b *testing.B) {
+	renamer, err := NewRenamer([]Rename{
+		{Key: "labels.class", To: "class", Match: "exact"},
+		{Key: "commit.", To: "commit_", Match: "prefix", StopOnMatch: true},
+	}, CollisionPolicy{})
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := renamer.Apply(benchmarkFields); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Sink is a destination for the samples of events, e.g. a Pushgateway.
+type Sink interface {
+	// Emit writes the samples of one event.
+	Emit(ctx context.Context, samples []MetricSample) error
+	// Health returns an error if the destination is not reachable.
+	Health(ctx context.Context) error
+}
+
+// BatchingSink is a Sink that takes the samples of several events in one Emit.
+// Its queue merges waiting events into batches of up to MaxBatchSamples samples.
+type BatchingSink interface {
+	Sink
+	MaxBatchSamples() int
+}
+
+// EventSink is a Sink that takes whole events, e.g. to use the extracted fields
+// besides the samples. Its queue calls EmitEvent instead of Emit and never merges
+// events.
+type EventSink interface {
+	Sink
+	EmitEvent(ctx context.Context, ev Event) error
+}
+
+// closingSink is a Sink with resources to release once its queue is drained.
+type closingSink interface {
+	Close(ctx context.Context) error
+}
+
+// permanentError marks an error retrying cannot fix.
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+// Permanent marks err as not worth retrying, e.g. samples the destination rejects.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err: err}
+}
+
+// IsPermanent reports whether err was marked with Permanent.
+func IsPermanent(err error) bool {
+	var permanent *permanentError
+	return errors.As(err, &permanent)
+}
+
+// Event is a processed webhook event as handed to the sinks: the extracted fields,
+// the renamed labels, the expression environment and the samples built from them,
+// with the time the event was received and the name of the API key that sent it.
+// Done, if set, is called by every queue the event was added to once its push
+// finished, with the error of the last attempt.
+type Event struct {
+	Fields   map[string]interface{}
+	Labels   map[string]interface{}
+	Env      map[string]interface{}
+	Samples  []MetricSample
+	Received time.Time
+	Key      string
+	Done     func(err error)
+}
+
+// SinkRoute connects a sink to the fan-out. Filter selects the events for the
+// sink (nil: all), Queue emits them in the background.
+type SinkRoute struct {
+	Name   string
+	Sink   Sink
+	Filter *EventFilter
+	Queue  *PushQueue
+}
+
+// NewSinkRoute creates the queue of a sink. Only queues of a BatchingSink merge
+// events, options.MaxBatchSamples is taken from the sink. onResult may be nil.
+func NewSinkRoute(name string, sink Sink, filter *EventFilter, options QueueOptions, onResult PushResultFunc) *SinkRoute {
+	emit := func(ctx context.Context, ev Event) error {
+		return sink.Emit(ctx, ev.Samples)
+	}
+	options.MaxBatchSamples = 0
+	switch sink := sink.(type) {
+	case EventSink:
+		emit = sink.EmitEvent
+	case BatchingSink:
+		options.MaxBatchSamples = sink.MaxBatchSamples()
+	}
+	return &SinkRoute{
+		Name:   name,
+		Sink:   sink,
+		Filter: filter,
+		Queue:  NewPushQueueWithOptions(emit, options, onResult),
+	}
+}
+
+// Close closes the queue and waits until it is drained or ctx is done, then closes
+// the sink if it has a Close method.
+func (r *SinkRoute) Close(ctx context.Context) error {
+	err := r.Queue.Close(ctx)
+	if closing, ok := r.Sink.(closingSink); ok {
+		err = errors.Join(err, closing.Close(ctx))
+	}
+	return err
+}
+
+// Dispatched lists what happened to an event per sink.
+type Dispatched struct {
+	// Queued are the sinks the event was queued for.
+	Queued []string
+	// Filtered maps the sinks whose filter dropped the event to the rejecting rule.
+	Filtered map[string]Rejection
+	// Failed maps the sinks that could not take the event to the error.
+	Failed map[string]error
+}
+
+// Fanout hands every event to all sinks. Each sink has its own filter and queue, so
+// a slow or failing sink does not hold up the others.
+type Fanout struct {
+	routes []*SinkRoute
+}
+
+// NewFanout returns a fan-out to the given sinks, whose names must be unique.
+func NewFanout(routes ...*SinkRoute) (*Fanout, error) {
+	if len(routes) == 0 {
+		return nil, fmt.Errorf("no sinks configured")
+	}
+	names := make(map[string]struct{}, len(routes))
+	for _, route := range routes {
+		if _, ok := names[route.Name]; ok {
+			return nil, fmt.Errorf("duplicate sink name '%s'", route.Name)
+		}
+		names[route.Name] = struct{}{}
+	}
+	return &Fanout{routes: routes}, nil
+}
+
+// Routes returns the sinks in configuration order.
+func (f *Fanout) Routes() []*SinkRoute {
+	return f.routes
+}
+
+// Dispatch queues the event for every sink whose filter accepts it. The error is
+// set if a sink that wanted the event could not take it, even if other sinks
+// queued it; it wraps the errors of the sinks, e.g. ErrQueueFull.
+func (f *Fanout) Dispatch(ev Event) (Dispatched, error) {
+	dispatched := Dispatched{Filtered: make(map[string]Rejection), Failed: make(map[string]error)}
+	for _, route := range f.routes {
+		if route.Filter != nil {
+			accepted, rejection, err := route.Filter.Accept(ev.Fields, ev.Env)
+			if err != nil {
+				dispatched.Failed[route.Name] = err
+				continue
+			}
+			if !accepted {
+				dispatched.Filtered[route.Name] = rejection
+				continue
+			}
+		}
+		if err := route.Queue.EnqueueEvent(ev); err != nil {
+			dispatched.Failed[route.Name] = err
+			continue
+		}
+		dispatched.Queued = append(dispatched.Queued, route.Name)
+	}
+	if len(dispatched.Failed) == 0 {
+		return dispatched, nil
+	}
+	var errs []error
+	for _, route := range f.routes {
+		if err, ok := dispatched.Failed[route.Name]; ok {
+			errs = append(errs, fmt.Errorf("sink %s: %w", route.Name, err))
+		}
+	}
+	return dispatched, errors.Join(errs...)
+}
+
+// Len returns the number of events not emitted yet per sink.
+func (f *Fanout) Len() map[string]int {
+	pending := make(map[string]int, len(f.routes))
+	for _, route := range f.routes {
+		pending[route.Name] = route.Queue.Len()
+	}
+	return pending
+}
+
+// Close closes the queues of all sinks and waits until they are drained or ctx is
+// done. Sinks with a Close method are closed after their queue.
+func (f *Fanout) Close(ctx context.Context) error {
+	errs := make([]error, len(f.routes))
+	done := make(chan struct{})
+	for i, route := range f.routes {
+		go func() {
+			if err := route.Close(ctx); err != nil {
+				errs[i] = fmt.Errorf("sink %s: %v", route.Name, err)
+			}
+			done <- struct{}{}
+		}()
+	}
+	for range f.routes {
+		<-done
+	}
+	return errors.Join(errs...)
+}
+
+// HealthCheck adapts Sink.Health to a HealthChecker, each check is bounded by
+// timeout (0: no timeout besides the sink's own).
+func HealthCheck(sink Sink, timeout time.Duration) func() error {
+	return func() error {
+		if timeout <= 0 {
+			return sink.Health(context.Background())
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		return sink.Health(ctx)
+	}
+}
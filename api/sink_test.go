@@ -0,0 +1,201 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingSink records the names of the emitted samples. It fails the first
+// failures emits with err. With block set, emits wait until block is closed.
+type recordingSink struct {
+	mu       sync.Mutex
+	emitted  []string
+	attempts int
+	failures int
+	err      error
+	started  chan struct{}
+	block    chan struct{}
+}
+
+func (s *recordingSink) Emit(ctx context.Context, samples []MetricSample) error {
+	if s.block != nil {
+		s.started <- struct{}{}
+		<-s.block
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attempts++
+	if s.attempts <= s.failures {
+		return s.err
+	}
+	for _, sample := range samples {
+		s.emitted = append(s.emitted, sample.Name)
+	}
+	return nil
+}
+
+func (s *recordingSink) Health(ctx context.Context) error {
+	return nil
+}
+
+func TestFanoutDispatch(t *testing.T) {
+	all := &recordingSink{}
+	failed := &recordingSink{}
+	filter, err := NewEventFilter([]Filter{{Field: "state", In: []string{"FAILED"}}}, nil)
+	require.NoError(t, err)
+
+	fanout, err := NewFanout(
+		NewSinkRoute("all", all, nil, QueueOptions{Size: 10, Workers: 1}, nil),
+		NewSinkRoute("failed", failed, filter, QueueOptions{Size: 10, Workers: 1}, nil),
+	)
+	require.NoError(t, err)
+
+	dispatched, err := fanout.Dispatch(Event{Fields: map[string]interface{}{"state": "FINISHED"}, Samples: []MetricSample{{Name: "finished"}}})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"all"}, dispatched.Queued)
+	assert.Equal(t, map[string]Rejection{"failed": {Rule: "0", Reason: "include state in [FAILED]"}}, dispatched.Filtered)
+
+	dispatched, err = fanout.Dispatch(Event{Fields: map[string]interface{}{"state": "FAILED"}, Samples: []MetricSample{{Name: "failed"}}})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"all", "failed"}, dispatched.Queued)
+
+	require.NoError(t, fanout.Close(context.Background()))
+	assert.Equal(t, []string{"finished", "failed"}, all.emitted)
+	assert.Equal(t, []string{"failed"}, failed.emitted)
+}
+
+// eventSink records the emitted events and whether it was closed.
+type eventSink struct {
+	recordingSink
+	events []Event
+	closed bool
+}
+
+func (s *eventSink) EmitEvent(ctx context.Context, ev Event) error {
+	s.events = append(s.events, ev)
+	return nil
+}
+
+func (s *eventSink) Close(ctx context.Context) error {
+	s.closed = true
+	return nil
+}
+
+func TestFanoutHandsWholeEventsToEventSinks(t *testing.T) {
+	sink := &eventSink{}
+	fanout, err := NewFanout(NewSinkRoute("events", sink, nil, QueueOptions{Size: 10, Workers: 1}, nil))
+	require.NoError(t, err)
+
+	ev := Event{Fields: map[string]interface{}{"state": "FAILED"}, Labels: map[string]interface{}{"state": "FAILED"}, Samples: []MetricSample{{Name: "failed"}}}
+	_, err = fanout.Dispatch(ev)
+	require.NoError(t, err)
+	require.NoError(t, fanout.Close(context.Background()))
+	assert.Equal(t, []Event{ev}, sink.events)
+	assert.Empty(t, sink.emitted, "Emit is not used")
+	assert.True(t, sink.closed, "closed after its queue")
+}
+
+func TestFanoutQueuesAreIndependent(t *testing.T) {
+	slow := &recordingSink{started: make(chan struct{}, 2), block: make(chan struct{})}
+	fast := &recordingSink{}
+	fanout, err := NewFanout(
+		NewSinkRoute("slow", slow, nil, QueueOptions{Size: 1, Workers: 1}, nil),
+		NewSinkRoute("fast", fast, nil, QueueOptions{Size: 10, Workers: 1}, nil),
+	)
+	require.NoError(t, err)
+
+	// The slow sink's worker takes the first event and its queue holds the second
+	_, err = fanout.Dispatch(Event{Samples: []MetricSample{{Name: "event"}}})
+	require.NoError(t, err)
+	<-slow.started
+	_, err = fanout.Dispatch(Event{Samples: []MetricSample{{Name: "event"}}})
+	require.NoError(t, err)
+	assert.Equal(t, 2, fanout.Len()["slow"])
+
+	dispatched, err := fanout.Dispatch(Event{Samples: []MetricSample{{Name: "event"}}})
+	assert.ErrorIs(t, err, ErrQueueFull)
+	assert.ErrorContains(t, err, "sink slow")
+	assert.Equal(t, []string{"fast"}, dispatched.Queued, "queued for the fast sink anyway")
+	assert.ErrorIs(t, dispatched.Failed["slow"], ErrQueueFull)
+	assert.Eventually(t, func() bool { return fanout.Len()["fast"] == 0 }, time.Second, time.Millisecond)
+
+	close(slow.block)
+	require.NoError(t, fanout.Close(context.Background()))
+	assert.Len(t, slow.emitted, 2)
+	assert.Len(t, fast.emitted, 3)
+}
+
+func TestFanoutDispatchFailsIfNoSinkTakesTheEvent(t *testing.T) {
+	sink := &recordingSink{}
+	fanout, err := NewFanout(NewSinkRoute("only", sink, nil, QueueOptions{Size: 1, Workers: 1}, nil))
+	require.NoError(t, err)
+	require.NoError(t, fanout.Close(context.Background()))
+
+	_, err = fanout.Dispatch(Event{})
+	assert.ErrorIs(t, err, ErrQueueClosed)
+	assert.ErrorContains(t, err, "sink only")
+}
+
+func TestNewFanoutRefusesDuplicateNames(t *testing.T) {
+	_, err := NewFanout(NewSinkRoute("a", &recordingSink{}, nil, QueueOptions{Size: 1, Workers: 1}, nil), NewSinkRoute("a", &recordingSink{}, nil, QueueOptions{Size: 1, Workers: 1}, nil))
+	assert.ErrorContains(t, err, "duplicate sink name 'a'")
+
+	_, err = NewFanout()
+	assert.ErrorContains(t, err, "no sinks configured")
+}
+
+func TestPushQueueRetries(t *testing.T) {
+	retry := Retry{MaxAttempts: 3, InitialBackoff: time.Millisecond}
+	tests := []struct {
+		name     string
+		failures int
+		err      error
+		attempts int
+		failed   bool
+	}{
+		{"succeeds after retries", 2, errors.New("unavailable"), 3, false},
+		{"attempts used up", 5, errors.New("unavailable"), 3, true},
+		{"permanent error", 5, Permanent(errors.New("invalid")), 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink := &recordingSink{failures: tt.failures, err: tt.err}
+			var results []error
+			route := NewSinkRoute("test", sink, nil, QueueOptions{Size: 1, Workers: 1, Retry: retry}, func(samples []MetricSample, err error, duration time.Duration) {
+				results = append(results, err)
+			})
+			require.NoError(t, route.Queue.Enqueue([]MetricSample{{Name: "event"}}))
+			require.NoError(t, route.Queue.Close(context.Background()))
+
+			assert.Equal(t, tt.attempts, sink.attempts)
+			require.Len(t, results, 1, "one result per event")
+			assert.Equal(t, tt.failed, results[0] != nil)
+		})
+	}
+}
+
+func TestPushQueueCloseAbortsRetries(t *testing.T) {
+	sink := &recordingSink{failures: 100, err: errors.New("unavailable")}
+	route := NewSinkRoute("test", sink, nil, QueueOptions{Size: 1, Workers: 1, Retry: Retry{MaxAttempts: 100, InitialBackoff: time.Hour}}, nil)
+	require.NoError(t, route.Queue.Enqueue(nil))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorContains(t, route.Queue.Close(ctx), "1 events not pushed")
+	assert.Eventually(t, func() bool { return route.Queue.Len() == 0 }, time.Second, time.Millisecond, "the worker gives up waiting")
+}
+
+func TestRetryBackoff(t *testing.T) {
+	retry := Retry{InitialBackoff: time.Second, MaxBackoff: 5 * time.Second}
+	var backoffs []time.Duration
+	for i := 1; i <= 5; i++ {
+		backoffs = append(backoffs, retry.backoff(i))
+	}
+	assert.Equal(t, []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}, backoffs)
+}
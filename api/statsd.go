@@ -0,0 +1,157 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// StatsD flavors.
+const (
+	FlavorDogStatsD = "dogstatsd"
+	FlavorStatsD    = "statsd"
+)
+
+// DefaultMaxPacketSize keeps StatsD packets below the usual MTU of 1500 bytes.
+const DefaultMaxPacketSize = 1432
+
+var (
+	// statsdNameEscaper replaces the separators of the StatsD format in names.
+	statsdNameEscaper = strings.NewReplacer(":", "_", "|", "_", "@", "_", "#", "_", ",", "_", "\n", "_")
+	// statsdTagEscaper replaces the separators of DogStatsD tags in tags.
+	statsdTagEscaper = strings.NewReplacer("|", "_", "#", "_", ",", "_", "\n", "_")
+	// statsdPathEscaper replaces dots, spaces and separators in label values that
+	// become part of the name.
+	statsdPathEscaper = strings.NewReplacer(".", "_", ":", "_", "|", "_", "@", "_", "#", "_", ",", "_", " ", "_", "\n", "_")
+)
+
+// StatsDOptions configure a StatsD sink. Flavor is FlavorDogStatsD (default), which
+// sends the labels as tags, or FlavorStatsD, which has no tags and appends the label
+// values to the metric name, sorted by label name: spacelift_run.infra.FINISHED.
+// Prefix is prepended to the metric names, e.g. "spacelift.". Samples are sent in
+// packets of up to MaxPacketSize bytes (0: DefaultMaxPacketSize).
+type StatsDOptions struct {
+	Flavor        string
+	Prefix        string
+	MaxPacketSize int
+}
+
+// StatsD sends samples over UDP to a StatsD server or the DogStatsD server of
+// the Datadog agent. Gauges are sent as gauges, sums as counters and histograms as
+// histograms (DogStatsD) or timers (StatsD).
+type StatsD struct {
+	conn    net.Conn
+	options StatsDOptions
+}
+
+// NewStatsD sends to address, e.g. localhost:8125.
+func NewStatsD(address string, options StatsDOptions) (*StatsD, error) {
+	switch options.Flavor {
+	case "":
+		options.Flavor = FlavorDogStatsD
+	case FlavorDogStatsD, FlavorStatsD:
+	default:
+		return nil, fmt.Errorf("unknown flavor '%s', expected dogstatsd or statsd", options.Flavor)
+	}
+	if options.MaxPacketSize <= 0 {
+		options.MaxPacketSize = DefaultMaxPacketSize
+	}
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address '%s': %v", address, err)
+	}
+	return &StatsD{conn: conn, options: options}, nil
+}
+
+// MaxBatchSamples makes StatsD a BatchingSink, waiting events share packets.
+func (s *StatsD) MaxBatchSamples() int {
+	return DefaultMaxSamplesPerSend
+}
+
+// Emit sends the samples, as many per packet as fit. UDP does not report lost
+// packets, errors only mean the packet could not be sent.
+func (s *StatsD) Emit(ctx context.Context, samples []MetricSample) error {
+	var packet []byte
+	for _, sample := range samples {
+		for _, line := range s.lines(sample) {
+			if len(packet) > 0 && len(packet)+1+len(line) > s.options.MaxPacketSize {
+				if err := s.send(packet); err != nil {
+					return err
+				}
+				packet = packet[:0]
+			}
+			if len(packet) > 0 {
+				packet = append(packet, '\n')
+			}
+			packet = append(packet, line...)
+		}
+	}
+	if len(packet) == 0 {
+		return nil
+	}
+	return s.send(packet)
+}
+
+func (s *StatsD) send(packet []byte) error {
+	if _, err := s.conn.Write(packet); err != nil {
+		return fmt.Errorf("failed to send to StatsD: %w", err)
+	}
+	return nil
+}
+
+// Health always succeeds, UDP has no way to check the server.
+func (s *StatsD) Health(ctx context.Context) error {
+	return nil
+}
+
+// Close closes the socket once the queue is drained.
+func (s *StatsD) Close(ctx context.Context) error {
+	return s.conn.Close()
+}
+
+// lines formats a sample. Plain StatsD treats a negative gauge as a decrement, so
+// the gauge is reset to 0 first. NaN and infinite values cannot be sent.
+func (s *StatsD) lines(sample MetricSample) []string {
+	if math.IsNaN(sample.Value) || math.IsInf(sample.Value, 0) {
+		log.Warnf("Skipping sample %s with value %v, StatsD does not support it", sample.Name, sample.Value)
+		return nil
+	}
+	name := s.options.Prefix + sample.Name
+	var tags []string
+	for _, label := range sample.LabelNames() {
+		value := sample.Labels[label]
+		if s.options.Flavor == FlavorStatsD {
+			if value != "" {
+				name += "." + statsdPathEscaper.Replace(value)
+			}
+			continue
+		}
+		tags = append(tags, statsdTagEscaper.Replace(label+":"+value))
+	}
+	name = statsdNameEscaper.Replace(name)
+
+	suffix := ""
+	if len(tags) > 0 {
+		suffix = "|#" + strings.Join(tags, ",")
+	}
+	value := strconv.FormatFloat(sample.Value, 'f', -1, 64)
+	switch sample.Type {
+	case MetricSum:
+		return []string{name + ":" + value + "|c" + suffix}
+	case MetricHistogram:
+		if s.options.Flavor == FlavorStatsD {
+			return []string{name + ":" + value + "|ms"}
+		}
+		return []string{name + ":" + value + "|h" + suffix}
+	default:
+		if s.options.Flavor == FlavorStatsD && sample.Value < 0 {
+			return []string{name + ":0|g", name + ":" + value + "|g"}
+		}
+		return []string{name + ":" + value + "|g" + suffix}
+	}
+}
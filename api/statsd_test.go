@@ -0,0 +1,110 @@
+package api
+
+import (
+	"context"
+	"math"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// statsdServer returns a UDP listener and a function reading the next packet.
+func statsdServer(t *testing.T) (string, func() string) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return conn.LocalAddr().String(), func() string {
+		buffer := make([]byte, 65536)
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+		n, _, err := conn.ReadFrom(buffer)
+		require.NoError(t, err)
+		return string(buffer[:n])
+	}
+}
+
+func TestStatsDLines(t *testing.T) {
+	labels := map[string]string{"stack": "infra", "state": "FINISHED"}
+	tests := []struct {
+		name     string
+		options  StatsDOptions
+		sample   MetricSample
+		expected []string
+	}{
+		{
+			name:     "dogstatsd gauge",
+			sample:   MetricSample{Name: "spacelift_run", Labels: labels, Value: 1},
+			expected: []string{"spacelift_run:1|g|#stack:infra,state:FINISHED"},
+		},
+		{
+			name:     "dogstatsd counter with prefix",
+			options:  StatsDOptions{Prefix: "ci."},
+			sample:   MetricSample{Name: "spacelift_runs_total", Type: MetricSum, Labels: labels, Value: 1},
+			expected: []string{"ci.spacelift_runs_total:1|c|#stack:infra,state:FINISHED"},
+		},
+		{
+			name:     "dogstatsd histogram",
+			sample:   MetricSample{Name: "spacelift_run_duration_seconds", Type: MetricHistogram, Value: 42.5},
+			expected: []string{"spacelift_run_duration_seconds:42.5|h"},
+		},
+		{
+			name:     "dogstatsd tag escaping",
+			sample:   MetricSample{Name: "spacelift_run", Labels: map[string]string{"commit_message": "fix #1, a|b"}, Value: 1},
+			expected: []string{"spacelift_run:1|g|#commit_message:fix _1_ a_b"},
+		},
+		{
+			name:     "statsd label values in the name",
+			options:  StatsDOptions{Flavor: FlavorStatsD},
+			sample:   MetricSample{Name: "spacelift_run", Labels: map[string]string{"stack": "infra.prod", "state": "FINISHED", "branch": ""}, Value: 1},
+			expected: []string{"spacelift_run.infra_prod.FINISHED:1|g"},
+		},
+		{
+			name:     "statsd timer",
+			options:  StatsDOptions{Flavor: FlavorStatsD},
+			sample:   MetricSample{Name: "spacelift_run_duration_seconds", Type: MetricHistogram, Labels: map[string]string{"stack": "infra"}, Value: 42.5},
+			expected: []string{"spacelift_run_duration_seconds.infra:42.5|ms"},
+		},
+		{
+			name:     "statsd negative gauge",
+			options:  StatsDOptions{Flavor: FlavorStatsD},
+			sample:   MetricSample{Name: "spacelift_drift", Value: -2},
+			expected: []string{"spacelift_drift:0|g", "spacelift_drift:-2|g"},
+		},
+		{
+			name:   "NaN is skipped",
+			sample: MetricSample{Name: "spacelift_run", Value: math.NaN()},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink, err := NewStatsD("127.0.0.1:8125", tt.options)
+			require.NoError(t, err)
+			defer sink.Close(context.Background())
+			assert.Equal(t, tt.expected, sink.lines(tt.sample))
+		})
+	}
+}
+
+func TestStatsDEmitSplitsPackets(t *testing.T) {
+	address, read := statsdServer(t)
+	sink, err := NewStatsD(address, StatsDOptions{MaxPacketSize: 40})
+	require.NoError(t, err)
+	defer sink.Close(context.Background())
+
+	require.NoError(t, sink.Emit(context.Background(), []MetricSample{
+		{Name: "a", Labels: map[string]string{"stack": "infra"}, Value: 1},
+		{Name: "b", Labels: map[string]string{"stack": "infra"}, Value: 2},
+		{Name: "c", Labels: map[string]string{"stack": "network"}, Value: 3},
+	}))
+	assert.Equal(t, "a:1|g|#stack:infra\nb:2|g|#stack:infra", read())
+	assert.Equal(t, "c:3|g|#stack:network", read(), "the third line does not fit into 40 bytes")
+}
+
+func TestNewStatsDErrors(t *testing.T) {
+	_, err := NewStatsD("127.0.0.1:8125", StatsDOptions{Flavor: "graphite"})
+	assert.ErrorContains(t, err, "unknown flavor 'graphite'")
+	_, err = NewStatsD("localhost", StatsDOptions{})
+	assert.ErrorContains(t, err, "invalid address 'localhost'")
+}
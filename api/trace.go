@@ -0,0 +1,381 @@
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+)
+
+// DefaultTerminalStates end the trace of a run.
+var DefaultTerminalStates = []string{"FINISHED", "FAILED", "DISCARDED", "STOPPED", "CANCELED"}
+
+// RunTracerOptions configure a RunTracer. RunIDPath and StatePath are the JSONPaths
+// of the run ID (default {.run.id}) and the run state (default {.state}) in the
+// transformed payload, so the run ID does not need to be extracted as a label;
+// events without them are ignored. Attributes are the labels added to the spans
+// (default all). A run reaching one of TerminalStates (default DefaultTerminalStates) is
+// exported, its status is an error for ErrorStates (default FAILED). Runs without
+// an event for Timeout (default 1h) are exported as timed out. At most MaxRuns
+// (default 10000) runs are traced at once; as many exported runs are remembered for
+// Timeout, so redelivered events of a run do not start a new trace. Encoding, ServiceName and HealthURL are
+// the same as in OTLPOptions.
+type RunTracerOptions struct {
+	Encoding       string
+	ServiceName    string
+	HealthURL      string
+	RunIDPath      string
+	StatePath      string
+	Attributes     []string
+	TerminalStates []string
+	ErrorStates    []string
+	Timeout        time.Duration
+	MaxRuns        int
+}
+
+// RunTracer correlates the state changes of a run by its run ID and exports them as
+// a trace over OTLP/HTTP: a root span for the whole run with one child span per
+// phase, e.g. PLANNING or APPLYING. Phases are timed by the arrival of the events.
+type RunTracer struct {
+	url      string
+	client   *http.Client
+	options  RunTracerOptions
+	runID    *JSONPath
+	state    *JSONPath
+	terminal map[string]struct{}
+	errors   map[string]struct{}
+
+	mu   sync.Mutex
+	runs map[string]*tracedRun
+	// exported maps the IDs of exported runs to the time of the export, exportedIDs
+	// holds them in that order
+	exported    map[string]time.Time
+	exportedIDs []string
+
+	stop    chan struct{}
+	stopped sync.WaitGroup
+}
+
+// tracedRun is a run whose trace is not exported yet.
+type tracedRun struct {
+	id         string
+	phases     []runPhase
+	attributes map[string]string
+	// last is the arrival of the latest event, for the timeout
+	last time.Time
+	// final is the terminal state, once reached at end
+	final string
+	end   time.Time
+}
+
+// runPhase is a state of a run, entered at start.
+type runPhase struct {
+	state string
+	start time.Time
+}
+
+// NewRunTracer exports to url, e.g. http://collector:4318/v1/traces, with client,
+// which adds headers and authentication. It checks for timed out runs until Close.
+func NewRunTracer(url string, client *http.Client, options RunTracerOptions) (*RunTracer, error) {
+	switch options.Encoding {
+	case "":
+		options.Encoding = OTLPProtobuf
+	case OTLPProtobuf, OTLPJSON:
+	default:
+		return nil, fmt.Errorf("unknown encoding '%s', expected protobuf or json", options.Encoding)
+	}
+	if options.Timeout < 0 {
+		return nil, fmt.Errorf("timeout must not be negative")
+	}
+	if options.ServiceName == "" {
+		options.ServiceName = "spacelift-pushgateway"
+	}
+	if options.RunIDPath == "" {
+		options.RunIDPath = "{.run.id}"
+	}
+	if options.StatePath == "" {
+		options.StatePath = "{.state}"
+	}
+	runID, err := CompileJSONPath(options.RunIDPath)
+	if err != nil {
+		return nil, fmt.Errorf("runId: %v", err)
+	}
+	state, err := CompileJSONPath(options.StatePath)
+	if err != nil {
+		return nil, fmt.Errorf("state: %v", err)
+	}
+	if len(options.TerminalStates) == 0 {
+		options.TerminalStates = DefaultTerminalStates
+	}
+	if len(options.ErrorStates) == 0 {
+		options.ErrorStates = []string{"FAILED"}
+	}
+	if options.Timeout == 0 {
+		options.Timeout = time.Hour
+	}
+	if options.MaxRuns <= 0 {
+		options.MaxRuns = 10000
+	}
+	t := &RunTracer{
+		url:      url,
+		client:   client,
+		options:  options,
+		runID:    runID,
+		state:    state,
+		terminal: toSet(options.TerminalStates),
+		errors:   toSet(options.ErrorStates),
+		runs:     make(map[string]*tracedRun),
+		exported: make(map[string]time.Time),
+		stop:     make(chan struct{}),
+	}
+	t.stopped.Add(1)
+	go t.expireRuns(max(options.Timeout/10, time.Second))
+	return t, nil
+}
+
+// Emit ignores samples, the tracer needs the labels of the whole event.
+func (t *RunTracer) Emit(ctx context.Context, samples []MetricSample) error {
+	return nil
+}
+
+// EmitEvent records the state of a run and exports its trace once the state is
+// terminal. A failed export is repeated when the terminal event is emitted again,
+// e.g. by a retry of the queue; events of a run exported already are ignored.
+func (t *RunTracer) EmitEvent(ctx context.Context, ev Event) error {
+	document := ev.Env["event"]
+	runID, state := traceValue(t.runID, document), traceValue(t.state, document)
+	if runID == "" || state == "" {
+		log.Debugf("Event without %s and %s is not traced", t.options.RunIDPath, t.options.StatePath)
+		return nil
+	}
+	received := ev.Received
+	if received.IsZero() {
+		received = time.Now()
+	}
+
+	request := t.record(runID, state, LabelValues(ev.Labels), received)
+	if request == nil {
+		return nil
+	}
+	if err := postOTLP(ctx, t.client, t.url, t.options.Encoding, request, "OTLP traces"); err != nil {
+		return err
+	}
+	t.mu.Lock()
+	delete(t.runs, runID)
+	t.markExported(runID, received)
+	t.mu.Unlock()
+	return nil
+}
+
+// markExported remembers an exported run, forgetting the oldest one if MaxRuns
+// runs are remembered already. t.mu must be held.
+func (t *RunTracer) markExported(runID string, at time.Time) {
+	if _, ok := t.exported[runID]; ok {
+		return
+	}
+	if len(t.exportedIDs) >= t.options.MaxRuns {
+		delete(t.exported, t.exportedIDs[0])
+		t.exportedIDs = t.exportedIDs[1:]
+	}
+	t.exported[runID] = at
+	t.exportedIDs = append(t.exportedIDs, runID)
+}
+
+// traceValue returns the scalar value of path in the payload, or "" if it is
+// missing or not a scalar.
+func traceValue(path *JSONPath, document interface{}) string {
+	value, found := path.Lookup(document)
+	if !found {
+		return ""
+	}
+	switch value.(type) {
+	case string, json.Number, int64, float64, bool:
+		return FormatValue(value)
+	default:
+		return ""
+	}
+}
+
+// record adds the state to its run and returns the export request if the run is
+// finished.
+func (t *RunTracer) record(runID, state string, labels map[string]string, received time.Time) *coltracepb.ExportTraceServiceRequest {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	run, ok := t.runs[runID]
+	if !ok {
+		if _, exported := t.exported[runID]; exported {
+			log.Debugf("Ignoring state %s of run %s, its trace was exported", state, runID)
+			return nil
+		}
+		if len(t.runs) >= t.options.MaxRuns {
+			log.Warnf("Run %s is not traced, %d runs are traced already", runID, len(t.runs))
+			return nil
+		}
+		run = &tracedRun{id: runID, attributes: make(map[string]string)}
+		t.runs[runID] = run
+	}
+	if run.final != "" {
+		if state == run.final {
+			return t.exportRequest(run, run.end, false)
+		}
+		log.Debugf("Ignoring state %s of finished run %s", state, runID)
+		return nil
+	}
+
+	run.last = received
+	for name, value := range labels {
+		if len(t.options.Attributes) == 0 || slices.Contains(t.options.Attributes, name) {
+			run.attributes[name] = value
+		}
+	}
+	if !slices.ContainsFunc(run.phases, func(phase runPhase) bool { return phase.state == state }) {
+		run.phases = append(run.phases, runPhase{state: state, start: received})
+		sort.SliceStable(run.phases, func(i, j int) bool { return run.phases[i].start.Before(run.phases[j].start) })
+	}
+	if _, ok := t.terminal[state]; !ok {
+		return nil
+	}
+	run.final, run.end = state, received
+	return t.exportRequest(run, received, false)
+}
+
+// expireRuns exports the runs without an event for the timeout every interval.
+func (t *RunTracer) expireRuns(interval time.Duration) {
+	defer t.stopped.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.stop:
+			return
+		case now := <-ticker.C:
+			t.Expire(context.Background(), now)
+		}
+	}
+}
+
+// Expire exports the runs without an event for the timeout as timed out, ending
+// at now. Finished runs whose export failed are dropped, exported runs are
+// forgotten after the timeout.
+func (t *RunTracer) Expire(ctx context.Context, now time.Time) {
+	var requests []*coltracepb.ExportTraceServiceRequest
+	t.mu.Lock()
+	for len(t.exportedIDs) > 0 && now.Sub(t.exported[t.exportedIDs[0]]) >= t.options.Timeout {
+		delete(t.exported, t.exportedIDs[0])
+		t.exportedIDs = t.exportedIDs[1:]
+	}
+	for id, run := range t.runs {
+		if now.Sub(run.last) < t.options.Timeout {
+			continue
+		}
+		delete(t.runs, id)
+		if run.final != "" {
+			log.Warnf("Dropping trace of run %s, it could not be exported", id)
+			continue
+		}
+		requests = append(requests, t.exportRequest(run, now, true))
+		t.markExported(id, now)
+	}
+	t.mu.Unlock()
+
+	for _, request := range requests {
+		if err := postOTLP(ctx, t.client, t.url, t.options.Encoding, request, "OTLP traces"); err != nil {
+			log.Errorf("Failed to export timed out run: %v", err)
+		}
+	}
+}
+
+// Health checks that the health URL answers with a 2xx status.
+func (t *RunTracer) Health(ctx context.Context) error {
+	return checkHealthURL(ctx, t.client, t.options.HealthURL, "OTLP collector")
+}
+
+// Close stops checking for timed out runs. Runs that are not finished are not
+// exported.
+func (t *RunTracer) Close(ctx context.Context) error {
+	close(t.stop)
+	t.stopped.Wait()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.runs) > 0 {
+		log.Warnf("%d unfinished runs are not traced", len(t.runs))
+	}
+	return nil
+}
+
+// exportRequest builds the trace of a run ending at end. Trace and span IDs are
+// derived from the run ID, so repeated exports of a run produce the same trace.
+func (t *RunTracer) exportRequest(run *tracedRun, end time.Time, timedOut bool) *coltracepb.ExportTraceServiceRequest {
+	traceID := traceHash(run.id, 16)
+	rootID := traceHash(run.id+"/run", 8)
+
+	state := run.final
+	if state == "" {
+		state = run.phases[len(run.phases)-1].state
+	}
+	root := &tracepb.Span{
+		TraceId:           traceID,
+		SpanId:            rootID,
+		Name:              "run",
+		Kind:              tracepb.Span_SPAN_KIND_INTERNAL,
+		StartTimeUnixNano: uint64(run.phases[0].start.UnixNano()),
+		EndTimeUnixNano:   uint64(end.UnixNano()),
+		Attributes: append(attributes(run.attributes),
+			stringAttribute("spacelift.run.id", run.id),
+			stringAttribute("spacelift.run.state", state),
+			&commonpb.KeyValue{Key: "spacelift.run.timed_out", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_BoolValue{BoolValue: timedOut}}},
+		),
+		Status: &tracepb.Status{},
+	}
+	if _, failed := t.errors[run.final]; failed {
+		root.Status = &tracepb.Status{Code: tracepb.Status_STATUS_CODE_ERROR, Message: fmt.Sprintf("run %s", run.final)}
+	} else if run.final != "" {
+		root.Status = &tracepb.Status{Code: tracepb.Status_STATUS_CODE_OK}
+	}
+
+	spans := []*tracepb.Span{root}
+	for i, phase := range run.phases {
+		if phase.state == run.final {
+			continue
+		}
+		phaseEnd := end
+		if i+1 < len(run.phases) {
+			phaseEnd = run.phases[i+1].start
+		}
+		spans = append(spans, &tracepb.Span{
+			TraceId:           traceID,
+			SpanId:            traceHash(fmt.Sprintf("%s/%d/%s", run.id, i, phase.state), 8),
+			ParentSpanId:      rootID,
+			Name:              phase.state,
+			Kind:              tracepb.Span_SPAN_KIND_INTERNAL,
+			StartTimeUnixNano: uint64(phase.start.UnixNano()),
+			EndTimeUnixNano:   uint64(phaseEnd.UnixNano()),
+			Attributes: append(attributes(run.attributes),
+				stringAttribute("spacelift.run.id", run.id),
+				stringAttribute("spacelift.run.state", phase.state),
+			),
+		})
+	}
+
+	return &coltracepb.ExportTraceServiceRequest{ResourceSpans: []*tracepb.ResourceSpans{{
+		Resource:   &resourcepb.Resource{Attributes: []*commonpb.KeyValue{stringAttribute("service.name", t.options.ServiceName)}},
+		ScopeSpans: []*tracepb.ScopeSpans{{Scope: otlpScope, Spans: spans}},
+	}}}
+}
+
+// traceHash derives an ID of size bytes from value.
+func traceHash(value string, size int) []byte {
+	sum := sha256.Sum256([]byte(value))
+	return sum[:size]
+}
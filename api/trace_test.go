@@ -0,0 +1,230 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// traceCollector records the spans it receives and answers with status.
+type traceCollector struct {
+	mu       sync.Mutex
+	requests []*coltracepb.ExportTraceServiceRequest
+	status   int
+}
+
+func (c *traceCollector) handler(t *testing.T) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		request := &coltracepb.ExportTraceServiceRequest{}
+		require.NoError(t, proto.Unmarshal(body, request))
+
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.requests = append(c.requests, request)
+		if c.status != 0 {
+			w.WriteHeader(c.status)
+		}
+	}
+}
+
+func (c *traceCollector) spans(t *testing.T, request int) []*tracepb.Span {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	require.Greater(t, len(c.requests), request)
+	resources := c.requests[request].ResourceSpans
+	require.Len(t, resources, 1)
+	assert.Equal(t, map[string]string{"service.name": "spacelift-pushgateway"}, stringAttributes(resources[0].Resource.Attributes))
+	return resources[0].ScopeSpans[0].Spans
+}
+
+func runEvent(runID, state string, received time.Time) Event {
+	document := map[string]interface{}{"run": map[string]interface{}{"id": runID}, "state": state}
+	return Event{
+		Labels:   map[string]interface{}{"state": state, "stackId": "infra", "commit_hash": "abc123"},
+		Env:      ExpressionEnv(document, nil),
+		Received: received,
+	}
+}
+
+func newTestTracer(t *testing.T, url string, options RunTracerOptions) *RunTracer {
+	tracer, err := NewRunTracer(url, http.DefaultClient, options)
+	require.NoError(t, err)
+	t.Cleanup(func() { tracer.Close(context.Background()) })
+	return tracer
+}
+
+func TestRunTracerExportsFinishedRuns(t *testing.T) {
+	collector := &traceCollector{}
+	server := httptest.NewServer(collector.handler(t))
+	defer server.Close()
+	tracer := newTestTracer(t, server.URL, RunTracerOptions{Attributes: []string{"stackId", "commit_hash"}})
+
+	start := time.Date(2025, 3, 16, 12, 0, 0, 0, time.UTC)
+	states := []string{"QUEUED", "PREPARING", "PLANNING", "UNCONFIRMED", "APPLYING", "FAILED"}
+	for i, state := range states {
+		require.NoError(t, tracer.EmitEvent(context.Background(), runEvent("run-1", state, start.Add(time.Duration(i)*time.Minute))))
+		if i < len(states)-1 {
+			assert.Empty(t, collector.requests, "exported before the run finished")
+		}
+	}
+	require.NoError(t, tracer.EmitEvent(context.Background(), Event{Env: ExpressionEnv(map[string]interface{}{"state": "FINISHED"}, nil)}), "events without run ID are ignored")
+
+	require.Len(t, collector.requests, 1)
+	spans := collector.spans(t, 0)
+	require.Len(t, spans, 6, "root and one span per phase")
+	root := spans[0]
+	assert.Equal(t, "run", root.Name)
+	assert.Empty(t, root.ParentSpanId)
+	assert.Len(t, root.TraceId, 16)
+	assert.Equal(t, uint64(start.UnixNano()), root.StartTimeUnixNano)
+	assert.Equal(t, uint64(start.Add(5*time.Minute).UnixNano()), root.EndTimeUnixNano)
+	assert.Equal(t, tracepb.Status_STATUS_CODE_ERROR, root.Status.Code)
+	assert.Equal(t, map[string]string{
+		"stackId":                 "infra",
+		"commit_hash":             "abc123",
+		"spacelift.run.id":        "run-1",
+		"spacelift.run.state":     "FAILED",
+		"spacelift.run.timed_out": "",
+	}, stringAttributes(root.Attributes))
+
+	for i, span := range spans[1:] {
+		assert.Equal(t, states[i], span.Name)
+		assert.Equal(t, root.TraceId, span.TraceId)
+		assert.Equal(t, root.SpanId, span.ParentSpanId)
+		assert.Equal(t, uint64(start.Add(time.Duration(i)*time.Minute).UnixNano()), span.StartTimeUnixNano)
+		assert.Equal(t, uint64(start.Add(time.Duration(i+1)*time.Minute).UnixNano()), span.EndTimeUnixNano)
+		assert.Equal(t, "infra", stringAttributes(span.Attributes)["stackId"])
+	}
+}
+
+func TestRunTracerOrdersPhasesAndIgnoresRepeatedStates(t *testing.T) {
+	collector := &traceCollector{}
+	server := httptest.NewServer(collector.handler(t))
+	defer server.Close()
+	tracer := newTestTracer(t, server.URL, RunTracerOptions{})
+
+	start := time.Date(2025, 3, 16, 12, 0, 0, 0, time.UTC)
+	for _, ev := range []Event{
+		runEvent("run-1", "PLANNING", start.Add(time.Minute)),
+		runEvent("run-1", "QUEUED", start),
+		runEvent("run-1", "PLANNING", start.Add(2*time.Minute)),
+		runEvent("run-1", "FINISHED", start.Add(3*time.Minute)),
+	} {
+		require.NoError(t, tracer.EmitEvent(context.Background(), ev))
+	}
+
+	spans := collector.spans(t, 0)
+	require.Len(t, spans, 3)
+	assert.Equal(t, tracepb.Status_STATUS_CODE_OK, spans[0].Status.Code)
+	assert.Equal(t, "QUEUED", spans[1].Name)
+	assert.Equal(t, "PLANNING", spans[2].Name)
+	assert.Equal(t, uint64(start.Add(time.Minute).UnixNano()), spans[2].StartTimeUnixNano)
+	assert.Equal(t, uint64(start.Add(3*time.Minute).UnixNano()), spans[2].EndTimeUnixNano)
+}
+
+func TestRunTracerRetriesFailedExports(t *testing.T) {
+	collector := &traceCollector{status: http.StatusServiceUnavailable}
+	server := httptest.NewServer(collector.handler(t))
+	defer server.Close()
+	tracer := newTestTracer(t, server.URL, RunTracerOptions{})
+
+	start := time.Date(2025, 3, 16, 12, 0, 0, 0, time.UTC)
+	require.NoError(t, tracer.EmitEvent(context.Background(), runEvent("run-1", "PLANNING", start)))
+	finished := runEvent("run-1", "FINISHED", start.Add(time.Minute))
+	err := tracer.EmitEvent(context.Background(), finished)
+	require.Error(t, err)
+	assert.False(t, IsPermanent(err))
+
+	collector.status = 0
+	require.NoError(t, tracer.EmitEvent(context.Background(), finished), "the retry exports the run again")
+	require.Len(t, collector.requests, 2)
+	assert.True(t, proto.Equal(collector.requests[0], collector.requests[1]), "the retry exports the same trace")
+	assert.Empty(t, tracer.runs)
+}
+
+func TestRunTracerIgnoresExportedRuns(t *testing.T) {
+	collector := &traceCollector{}
+	server := httptest.NewServer(collector.handler(t))
+	defer server.Close()
+	tracer := newTestTracer(t, server.URL, RunTracerOptions{MaxRuns: 2, Timeout: time.Hour})
+
+	start := time.Date(2025, 3, 16, 12, 0, 0, 0, time.UTC)
+	require.NoError(t, tracer.EmitEvent(context.Background(), runEvent("run-1", "PLANNING", start)))
+	require.NoError(t, tracer.EmitEvent(context.Background(), runEvent("run-1", "FINISHED", start.Add(time.Minute))))
+	require.NoError(t, tracer.EmitEvent(context.Background(), runEvent("run-1", "FINISHED", start.Add(2*time.Minute))), "redelivered")
+	require.NoError(t, tracer.EmitEvent(context.Background(), runEvent("run-1", "APPLYING", start.Add(2*time.Minute))), "late")
+	assert.Len(t, collector.requests, 1, "the run is exported once")
+	assert.Empty(t, tracer.runs)
+
+	for _, id := range []string{"run-2", "run-3"} {
+		require.NoError(t, tracer.EmitEvent(context.Background(), runEvent(id, "FINISHED", start.Add(2*time.Minute))))
+	}
+	assert.Equal(t, []string{"run-2", "run-3"}, tracer.exportedIDs, "at most MaxRuns runs are remembered")
+	assert.NotContains(t, tracer.exported, "run-1")
+
+	tracer.Expire(context.Background(), start.Add(2*time.Minute+time.Hour))
+	assert.Empty(t, tracer.exported, "exported runs are forgotten after the timeout")
+	assert.Empty(t, tracer.exportedIDs)
+}
+
+func TestRunTracerExpiresRuns(t *testing.T) {
+	collector := &traceCollector{}
+	server := httptest.NewServer(collector.handler(t))
+	defer server.Close()
+	tracer := newTestTracer(t, server.URL, RunTracerOptions{Timeout: time.Hour})
+
+	start := time.Date(2025, 3, 16, 12, 0, 0, 0, time.UTC)
+	require.NoError(t, tracer.EmitEvent(context.Background(), runEvent("run-1", "QUEUED", start)))
+	require.NoError(t, tracer.EmitEvent(context.Background(), runEvent("run-1", "APPLYING", start.Add(time.Minute))))
+	require.NoError(t, tracer.EmitEvent(context.Background(), runEvent("run-2", "QUEUED", start.Add(30*time.Minute))))
+
+	now := start.Add(time.Minute + time.Hour)
+	tracer.Expire(context.Background(), now)
+	require.Len(t, collector.requests, 1, "only run-1 timed out")
+	spans := collector.spans(t, 0)
+	require.Len(t, spans, 3)
+	assert.Equal(t, tracepb.Status_STATUS_CODE_UNSET, spans[0].Status.Code)
+	for _, kv := range spans[0].Attributes {
+		if kv.Key == "spacelift.run.timed_out" {
+			assert.True(t, kv.Value.GetBoolValue())
+		}
+	}
+	assert.Equal(t, "APPLYING", stringAttributes(spans[0].Attributes)["spacelift.run.state"])
+	assert.Equal(t, uint64(now.UnixNano()), spans[2].EndTimeUnixNano)
+	assert.Len(t, tracer.runs, 1)
+}
+
+func TestRunTracerPaths(t *testing.T) {
+	collector := &traceCollector{}
+	server := httptest.NewServer(collector.handler(t))
+	defer server.Close()
+	tracer := newTestTracer(t, server.URL, RunTracerOptions{RunIDPath: "{.runId}", StatePath: "$.run.state"})
+
+	document := map[string]interface{}{"runId": json.Number("42"), "run": map[string]interface{}{"state": "FINISHED"}}
+	require.NoError(t, tracer.EmitEvent(context.Background(), Event{Env: ExpressionEnv(document, nil), Received: time.Now()}))
+	spans := collector.spans(t, 0)
+	assert.Equal(t, "42", stringAttributes(spans[0].Attributes)["spacelift.run.id"])
+	assert.Equal(t, "FINISHED", stringAttributes(spans[0].Attributes)["spacelift.run.state"])
+}
+
+func TestRunTracerErrors(t *testing.T) {
+	_, err := NewRunTracer("http://localhost:4318/v1/traces", http.DefaultClient, RunTracerOptions{Encoding: "xml"})
+	assert.ErrorContains(t, err, "unknown encoding 'xml'")
+	_, err = NewRunTracer("http://localhost:4318/v1/traces", http.DefaultClient, RunTracerOptions{Timeout: -time.Second})
+	assert.ErrorContains(t, err, "timeout must not be negative")
+	_, err = NewRunTracer("http://localhost:4318/v1/traces", http.DefaultClient, RunTracerOptions{RunIDPath: "{.run[}"})
+	assert.ErrorContains(t, err, "runId: ")
+}
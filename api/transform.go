@@ -3,62 +3,64 @@ package api
 import (
 	"encoding/json"
 	"fmt"
-	"github.com/yalp/jsonpath"
 	"strings"
 )
 
+// TransformJsonValues replaces every list of "key<separator>value" strings matched by
+// jsonPath with an object of the same key/value pairs, e.g. ["env:prod"] becomes {"env": "prod"}.
 func TransformJsonValues(data []byte, jsonPath string, separator string) ([]byte, error) {
+	path, err := CompileJSONPath(jsonPath)
+	if err != nil {
+		return nil, err
+	}
+
 	// Parse the JSON into a generic map
-	var jsonData interface{}
-	if err := json.Unmarshal(data, &jsonData); err != nil {
+	jsonData, err := DecodeJSON(data)
+	if err != nil {
 		return nil, fmt.Errorf("failed to unmarshal JSON: %v", err)
 	}
+	if _, ok := jsonData.(map[string]interface{}); !ok {
+		return nil, fmt.Errorf("expected JSON to be a map but found %T", jsonData)
+	}
 
-	// Extract the value at the given JSONPath
-	labelsData, err := jsonpath.Read(jsonData, jsonPath)
+	matches, err := path.Modify(jsonData, func(value interface{}) (interface{}, error) {
+		// Check if "labels" is of type slice
+		labels, found := value.([]interface{})
+		if !found {
+			return nil, fmt.Errorf("data at %s is not a slice", jsonPath)
+		}
+		return splitValues(labels, separator), nil
+	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to extract data from JSON using path %s: %v", jsonPath, err)
+		return nil, err
+	}
+	if matches == 0 {
+		return nil, fmt.Errorf("failed to extract data from JSON using path %s: no match", jsonPath)
 	}
 
-	// Check if "labels" is of type slice
-	labels, found := labelsData.([]interface{})
-	if !found {
-		return nil, fmt.Errorf("data at %s is not a slice", jsonPath)
+	// Marshal the modified jsonData back into JSON
+	transformedJSON, err := json.MarshalIndent(jsonData, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal transformed JSON: %v", err)
 	}
 
+	return transformedJSON, nil
+}
+
+// splitValues splits each string into a key-value pair at the first occurrence of the separator.
+func splitValues(labels []interface{}, separator string) map[string]interface{} {
 	// Initialize a map to hold the transformed label data
-	labelMap := make(map[string]string)
+	labelMap := make(map[string]interface{})
 
-	// Iterate over the labels and split each into key-value pairs based on the separator
 	for _, label := range labels {
 		labelStr, ok := label.(string)
 		if !ok {
 			continue // Skip non-string labels
 		}
-		// Split the string at the first occurrence of the separator
 		parts := strings.SplitN(labelStr, separator, 2)
 		if len(parts) == 2 {
 			labelMap[parts[0]] = parts[1]
 		}
 	}
-
-	// Replace the "labels" field with the transformed label map
-	jsonDataMap, ok := jsonData.(map[string]interface{})
-	if !ok {
-		return nil, fmt.Errorf("expected JSON to be a map but found %T", jsonData)
-	}
-
-	//@todo replace dynamic with jsonPath!
-	key := strings.ReplaceAll(jsonPath, "$", "")
-	key = strings.ReplaceAll(key, ".", "")
-
-	jsonDataMap[key] = labelMap
-
-	// Marshal the modified jsonData back into JSON
-	transformedJSON, err := json.MarshalIndent(jsonDataMap, "", "  ")
-	if err != nil {
-		return nil, fmt.Errorf("failed to marshal transformed JSON: %v", err)
-	}
-
-	return transformedJSON, nil
+	return labelMap
 }
@@ -90,6 +90,34 @@ func TestTransformLabelsJSON(t *testing.T) {
 }`),
 			expectedError: false,
 		},
+		{
+			name: "wildcard and template syntax",
+			inputJSON: []byte(`{
+				"runs": [
+					{"labels": ["env:prod"]},
+					{"labels": ["env:dev", "team:infra"]}
+				]
+			}`),
+			jsonPath:  "{.runs[*].labels}",
+			separator: ":",
+			expectedJSON: []byte(`{
+  "runs": [
+    {"labels": {"env": "prod"}},
+    {"labels": {"env": "dev", "team": "infra"}}
+  ]
+}`),
+			expectedError: false,
+		},
+		{
+			name: "labels not a list",
+			inputJSON: []byte(`{
+				"labels": "class:platform"
+			}`),
+			jsonPath:      "$.labels",
+			separator:     ":",
+			expectedJSON:  nil,
+			expectedError: true,
+		},
 		{
 			name: "invalid jsonpath",
 			inputJSON: []byte(`{
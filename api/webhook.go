@@ -0,0 +1,261 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// DefaultWebhookTemplate sends the extracted fields as a JSON object.
+const DefaultWebhookTemplate = "{{json .}}"
+
+// webhookDeliveryTTL bounds how long the targets an event was delivered to are
+// remembered for retries of the event.
+const webhookDeliveryTTL = time.Hour
+
+// webhookFuncs are the template functions besides the builtin ones.
+var webhookFuncs = template.FuncMap{
+	// json encodes a value, e.g. to quote a commit message in a JSON body
+	"json": func(value interface{}) (string, error) {
+		encoded, err := json.Marshal(value)
+		return string(encoded), err
+	},
+}
+
+// WebhookTarget is a URL an event is forwarded to if Condition (an expression, see
+// Expression; empty: always) matches. Template overrides the template of the sink.
+type WebhookTarget struct {
+	URL       string
+	Condition string
+	Template  string
+}
+
+// WebhookOptions configure a Webhook. Template is a Go text/template rendered with
+// the extracted fields, e.g. {{.state}} or {{index . "commit.message"}}, and the
+// json function (default DefaultWebhookTemplate). Bodies are sent with ContentType
+// (default application/json). With Secret, bodies are signed with HMAC-SHA256 in
+// SignatureHeader (default X-Signature-256) as sha256=<hex digest>. Conditions can
+// use Variables, see PayloadVariables.
+type WebhookOptions struct {
+	Targets         []WebhookTarget
+	Variables       Variables
+	Template        string
+	ContentType     string
+	Secret          []byte
+	SignatureHeader string
+}
+
+// Webhook forwards events to HTTP endpoints, e.g. Slack incoming webhooks.
+type Webhook struct {
+	client  *http.Client
+	options WebhookOptions
+	targets []webhookTarget
+
+	// delivered remembers the deliveries that succeeded or failed permanently, so a
+	// retry of an event only repeats the failed ones
+	mu        sync.Mutex
+	delivered map[string]time.Time
+}
+
+type webhookTarget struct {
+	url       string
+	condition *Expression
+	template  *template.Template
+}
+
+// NewWebhook compiles the templates and conditions. All invalid targets are
+// reported together.
+func NewWebhook(client *http.Client, options WebhookOptions) (*Webhook, error) {
+	if len(options.Targets) == 0 {
+		return nil, fmt.Errorf("no targets configured")
+	}
+	if options.Template == "" {
+		options.Template = DefaultWebhookTemplate
+	}
+	if options.ContentType == "" {
+		options.ContentType = "application/json"
+	}
+	if options.SignatureHeader == "" {
+		options.SignatureHeader = "X-Signature-256"
+	}
+	sinkTemplate, err := template.New("webhook").Funcs(webhookFuncs).Parse(options.Template)
+	if err != nil {
+		return nil, fmt.Errorf("invalid template: %v", err)
+	}
+
+	var errs []error
+	w := &Webhook{client: client, options: options, delivered: make(map[string]time.Time)}
+	for i, target := range options.Targets {
+		compiled, err := compileWebhookTarget(target, sinkTemplate, options.Variables)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("target %d: %v", i, err))
+			continue
+		}
+		w.targets = append(w.targets, compiled)
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return w, nil
+}
+
+func compileWebhookTarget(target WebhookTarget, sinkTemplate *template.Template, variables Variables) (webhookTarget, error) {
+	compiled := webhookTarget{url: target.URL, template: sinkTemplate}
+	if target.URL == "" {
+		return compiled, fmt.Errorf("missing url")
+	}
+	if target.Condition != "" {
+		condition, err := CompileCondition(target.Condition, variables)
+		if err != nil {
+			return compiled, err
+		}
+		compiled.condition = condition
+	}
+	if target.Template != "" {
+		targetTemplate, err := template.New("target").Funcs(webhookFuncs).Parse(target.Template)
+		if err != nil {
+			return compiled, fmt.Errorf("invalid template: %v", err)
+		}
+		compiled.template = targetTemplate
+	}
+	return compiled, nil
+}
+
+// Emit forwards samples without fields, Webhook is an EventSink.
+func (w *Webhook) Emit(ctx context.Context, samples []MetricSample) error {
+	return w.EmitEvent(ctx, Event{Samples: samples})
+}
+
+// EmitEvent posts the rendered event to every target whose condition matches. A
+// retry of the event skips the targets that already got it. The error is Permanent
+// if no failed delivery is worth retrying.
+func (w *Webhook) EmitEvent(ctx context.Context, ev Event) error {
+	data := ev.Fields
+	if data == nil {
+		data = map[string]interface{}{}
+	}
+	var (
+		errs       []error
+		retryable  bool
+		deliveries []string
+	)
+	for i, target := range w.targets {
+		if target.condition != nil {
+			matched, err := target.condition.Match(ev.Env)
+			if err != nil {
+				errs = append(errs, Permanent(fmt.Errorf("target %d: %v", i, err)))
+				continue
+			}
+			if !matched {
+				continue
+			}
+		}
+		var body bytes.Buffer
+		if err := target.template.Execute(&body, data); err != nil {
+			errs = append(errs, Permanent(fmt.Errorf("target %d: rendering template: %v", i, err)))
+			continue
+		}
+
+		delivery := deliveryKey(ev, target.url, body.Bytes())
+		if w.wasDelivered(delivery) {
+			deliveries = append(deliveries, delivery)
+			continue
+		}
+		err := postBody(ctx, w.client, target.url, w.header(body.Bytes()), body.Bytes(), fmt.Sprintf("webhook target %d", i))
+		if err != nil && !IsPermanent(err) {
+			retryable = true
+			errs = append(errs, err)
+			continue
+		}
+		deliveries = append(deliveries, delivery)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	// Only events that will be retried need their deliveries remembered
+	w.remember(deliveries, retryable)
+
+	err := errors.Join(errs...)
+	if err != nil && !retryable {
+		return Permanent(err)
+	}
+	return err
+}
+
+// header returns the headers of a request with body, signed if there is a secret.
+func (w *Webhook) header(body []byte) http.Header {
+	header := http.Header{}
+	header.Set("Content-Type", w.options.ContentType)
+	if len(w.options.Secret) > 0 {
+		header.Set(w.options.SignatureHeader, Sign(w.options.Secret, body))
+	}
+	return header
+}
+
+// Sign returns the HMAC-SHA256 signature of body as sha256=<hex digest>, the
+// format of the X-Hub-Signature-256 header of GitHub webhooks.
+func Sign(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// deliveryKey identifies the delivery of an event to a URL. Events without a
+// receive time cannot be told apart and are never skipped.
+func deliveryKey(ev Event, url string, body []byte) string {
+	if ev.Received.IsZero() {
+		return ""
+	}
+	sum := sha256.Sum256(fmt.Appendf(nil, "%d\x00%s\x00%s", ev.Received.UnixNano(), url, body))
+	return string(sum[:])
+}
+
+// wasDelivered reports whether the delivery succeeded or failed permanently in an
+// earlier attempt.
+func (w *Webhook) wasDelivered(key string) bool {
+	if key == "" {
+		return false
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	_, ok := w.delivered[key]
+	return ok
+}
+
+// remember records the finished deliveries of an event that will be retried, or
+// forgets them once the event is done. Deliveries of events whose retries ran out
+// are forgotten after webhookDeliveryTTL.
+func (w *Webhook) remember(keys []string, retried bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	now := time.Now()
+	for key, delivered := range w.delivered {
+		if now.Sub(delivered) > webhookDeliveryTTL {
+			delete(w.delivered, key)
+		}
+	}
+	for _, key := range keys {
+		if key == "" {
+			continue
+		}
+		if retried {
+			w.delivered[key] = now
+		} else {
+			delete(w.delivered, key)
+		}
+	}
+}
+
+// Health always succeeds, generic endpoints have no health check.
+func (w *Webhook) Health(ctx context.Context) error {
+	return nil
+}
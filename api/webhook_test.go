@@ -0,0 +1,147 @@
+package api
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// webhookReceiver records the bodies it receives, it fails the first failures
+// requests with status.
+type webhookReceiver struct {
+	mu       sync.Mutex
+	bodies   []string
+	headers  []http.Header
+	failures int
+	status   int
+}
+
+func (r *webhookReceiver) server(t *testing.T) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, request *http.Request) {
+		body, err := io.ReadAll(request.Body)
+		require.NoError(t, err)
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if r.failures > 0 {
+			r.failures--
+			http.Error(w, "try again later", r.status)
+			return
+		}
+		r.bodies = append(r.bodies, string(body))
+		r.headers = append(r.headers, request.Header)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func webhookEvent(state string) Event {
+	fields := map[string]interface{}{"stackId": "infra", "state": state, "commit.message": `Fix "network"`}
+	return Event{
+		Fields:   fields,
+		Env:      ExpressionEnv(map[string]interface{}{"stackId": "infra", "state": state}, fields),
+		Received: time.Now(),
+	}
+}
+
+func TestWebhookForwardsMatchingEvents(t *testing.T) {
+	slack := &webhookReceiver{}
+	slackServer := slack.server(t)
+	generic := &webhookReceiver{}
+	genericServer := generic.server(t)
+
+	sink, err := NewWebhook(http.DefaultClient, WebhookOptions{
+		Variables: Variables{"stackId", "state"},
+		Targets: []WebhookTarget{
+			{URL: slackServer.URL, Condition: `state == "FAILED"`, Template: `{"text": {{json (printf "Run of %s failed: %s" .stackId (index . "commit.message"))}}}`},
+			{URL: genericServer.URL},
+		},
+		Secret: []byte("secret"),
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, sink.EmitEvent(context.Background(), webhookEvent("FINISHED")))
+	require.NoError(t, sink.EmitEvent(context.Background(), webhookEvent("FAILED")))
+
+	require.Len(t, slack.bodies, 1, "only failed runs")
+	assert.JSONEq(t, `{"text": "Run of infra failed: Fix \"network\""}`, slack.bodies[0])
+	assert.Equal(t, "application/json", slack.headers[0].Get("Content-Type"))
+	assert.Equal(t, Sign([]byte("secret"), []byte(slack.bodies[0])), slack.headers[0].Get("X-Signature-256"))
+
+	require.Len(t, generic.bodies, 2, "all runs")
+	assert.JSONEq(t, `{"stackId": "infra", "state": "FINISHED", "commit.message": "Fix \"network\""}`, generic.bodies[0])
+}
+
+func TestSign(t *testing.T) {
+	// The example of the GitHub documentation on validating webhook deliveries
+	assert.Equal(t, "sha256=757107ea0eb2509fc211221cce984b8a37570b6d7586c22c46f4379c8b043e17", Sign([]byte("It's a Secret to Everybody"), []byte("Hello, World!")))
+}
+
+func TestWebhookRetriesOnlyFailedTargets(t *testing.T) {
+	healthy := &webhookReceiver{}
+	healthyServer := healthy.server(t)
+	flaky := &webhookReceiver{failures: 2, status: http.StatusServiceUnavailable}
+	flakyServer := flaky.server(t)
+
+	sink, err := NewWebhook(http.DefaultClient, WebhookOptions{Targets: []WebhookTarget{{URL: healthyServer.URL}, {URL: flakyServer.URL}}})
+	require.NoError(t, err)
+	var results []error
+	route := NewSinkRoute("webhook", sink, nil, QueueOptions{Size: 10, Retry: Retry{MaxAttempts: 3, InitialBackoff: time.Millisecond}}, func(samples []MetricSample, err error, duration time.Duration) {
+		results = append(results, err)
+	})
+
+	first, second := webhookEvent("FAILED"), webhookEvent("FAILED")
+	second.Received = first.Received.Add(time.Second)
+	require.NoError(t, route.Queue.EnqueueEvent(first))
+	require.NoError(t, route.Queue.EnqueueEvent(second))
+	require.NoError(t, route.Queue.Close(context.Background()))
+
+	assert.Equal(t, []error{nil, nil}, results)
+	assert.Len(t, healthy.bodies, 2, "one delivery per event although the first was retried")
+	assert.Len(t, flaky.bodies, 2)
+	assert.Empty(t, sink.delivered, "finished events are forgotten")
+}
+
+func TestWebhookPermanentErrors(t *testing.T) {
+	rejecting := &webhookReceiver{failures: 1, status: http.StatusBadRequest}
+	server := rejecting.server(t)
+
+	sink, err := NewWebhook(http.DefaultClient, WebhookOptions{Targets: []WebhookTarget{{URL: server.URL}}})
+	require.NoError(t, err)
+	err = sink.EmitEvent(context.Background(), webhookEvent("FAILED"))
+	assert.ErrorContains(t, err, "webhook target 0 failed with unexpected status code 400: try again later")
+	assert.True(t, IsPermanent(err))
+
+	sink, err = NewWebhook(http.DefaultClient, WebhookOptions{Targets: []WebhookTarget{{URL: server.URL, Template: `{{.state.name}}`}}})
+	require.NoError(t, err)
+	err = sink.EmitEvent(context.Background(), webhookEvent("FAILED"))
+	assert.ErrorContains(t, err, "target 0: rendering template")
+	assert.True(t, IsPermanent(err))
+}
+
+func TestNewWebhookErrors(t *testing.T) {
+	_, err := NewWebhook(http.DefaultClient, WebhookOptions{})
+	assert.ErrorContains(t, err, "no targets configured")
+
+	_, err = NewWebhook(http.DefaultClient, WebhookOptions{Targets: []WebhookTarget{{URL: "http://localhost"}}, Template: "{{.state"})
+	assert.ErrorContains(t, err, "invalid template")
+
+	_, err = NewWebhook(http.DefaultClient, WebhookOptions{Variables: Variables{"state"}, Targets: []WebhookTarget{
+		{},
+		{URL: "http://localhost", Condition: "state =="},
+		{URL: "http://localhost", Template: "{{json}"},
+		{URL: "http://localhost", Condition: `state == "FAILED"`},
+		{URL: "http://localhost", Condition: `stat == "FAILED"`},
+	}})
+	assert.ErrorContains(t, err, "target 0: missing url")
+	assert.ErrorContains(t, err, "target 1: failed to compile expression")
+	assert.ErrorContains(t, err, "target 2: invalid template")
+	assert.NotContains(t, err.Error(), "target 3")
+	assert.ErrorContains(t, err, "target 4: failed to compile expression 'stat == \"FAILED\"': unknown variable 'stat'")
+}
@@ -4,6 +4,8 @@ import (
 	"fmt"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"sort"
+	"strings"
 
 	"spacelift-pushgateway/api"
 )
@@ -17,29 +19,40 @@ var extractCmd = &cobra.Command{
 	Long:  `The extract command reads a JSON file and extracts specified fields.`,
 	Run: func(cmd *cobra.Command, args []string) {
 
+		p := currentPipeline()
 		jsonData := readJsonFile(filename)
 		var (
-			err error
+			document interface{}
+			err      error
 		)
 
 		if transformBeforeExtract {
-			for _, splits := range config.Json.ValueSplits {
-				jsonData, err = api.TransformJsonValues(jsonData, splits.Path, splits.Separator)
-				if err != nil {
-					log.Fatalf("Error transforming JSON: %v", err)
-				}
-			}
+			document, err = p.transform(jsonData)
+		} else {
+			document, err = api.DecodeJSON(jsonData)
 		}
-		results, err := api.ExtractMultipleJSONPaths(jsonData, config.Json.FieldsToExtract)
 		if err != nil {
-			log.Fatalf("Error extracting data: %v", err)
+			log.Fatalf("Error reading JSON: %v", err)
+		}
+		ev, err := p.evaluate(document)
+		if err != nil {
+			log.Fatal(err)
 		}
 		if rename {
-			results, err = api.RenameKeys(results, config.Json.Rename)
+			err := p.rename(ev)
+			if len(ev.collisions) > 0 {
+				fmt.Println("== Collisions ==")
+				for _, collision := range ev.collisions {
+					fmt.Println(collision)
+				}
+			}
+			if err != nil {
+				log.Fatalf("Error renaming keys: %v", err)
+			}
 		}
+		results := ev.labels
 
-		gw := api.NewPushGateway(config.Prometheus.PushGatewayUrl, config.Prometheus.TargetMetric, config.Prometheus.TargetMetricHelp, config.Prometheus.JobName)
-		hasErrors, errors := gw.ValidateLabels(results)
+		hasErrors, errors := api.ValidateLabels(results)
 		if hasErrors == true {
 			for _, err := range errors {
 				fmt.Println(err)
@@ -48,6 +61,33 @@ var extractCmd = &cobra.Command{
 			fmt.Println("== All Labels are valid")
 		}
 
+		if !ev.accepted {
+			fmt.Printf("== Event would be dropped by filter: %s\n", ev.rejection.Reason)
+		} else {
+			if err := p.build(ev); err != nil {
+				log.Fatalf("Error building metrics: %v", err)
+			}
+			values := api.LabelValues(results)
+			normalized := p.normalizer.Apply(values)
+			changed := make([]string, 0)
+			for key, value := range normalized {
+				if value != values[key] {
+					changed = append(changed, key)
+				}
+			}
+			if len(changed) > 0 {
+				sort.Strings(changed)
+				fmt.Println("== Normalized ==")
+				for _, key := range changed {
+					fmt.Printf("%s : %q\n", key, normalized[key])
+				}
+			}
+			fmt.Println("== Metrics ==")
+			for _, sample := range ev.samples {
+				fmt.Printf("%s %s {%s}\n", sample.Name, api.FormatValue(sample.Value), strings.Join(sample.LabelNames(), ", "))
+			}
+		}
+
 		fmt.Println("== Results ==")
 
 		maxKeyLength := 0
@@ -57,11 +97,13 @@ var extractCmd = &cobra.Command{
 			}
 		}
 		formatString := fmt.Sprintf("%%-%ds : %%s\n", maxKeyLength)
-		for path, value := range results {
-			if err != nil {
-				log.Errorf("Error renaming path %s key: %v", path, err)
-			}
-			fmt.Printf(formatString, path, value)
+		paths := make([]string, 0, len(results))
+		for path := range results {
+			paths = append(paths, path)
+		}
+		sort.Strings(paths)
+		for _, path := range paths {
+			fmt.Printf(formatString, path, api.FormatValue(results[path]))
 		}
 	},
 }
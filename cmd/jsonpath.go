@@ -0,0 +1,66 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"spacelift-pushgateway/api"
+)
+
+var jsonpathCmd = &cobra.Command{
+	Use:   "jsonpath",
+	Short: "Work with JSONPath expressions",
+	Long: `JSONPath expressions are used by valueSplits and fieldsToExtract.
+Both the $.a.b syntax and the {.a.b} template syntax are accepted.`,
+}
+
+var jsonpathTestCmd = &cobra.Command{
+	Use:   "test --file=filename expression",
+	Short: "Evaluates a JSONPath expression against a JSON file",
+	Long: `The test command evaluates a JSONPath expression against a JSON file and prints all matches.
+By default the configured valueSplits are applied first, so the expression sees the same document as fieldsToExtract.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		path, err := api.CompileJSONPath(args[0])
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		jsonData := readJsonFile(filename)
+		var document interface{}
+		if transformBeforeExtract {
+			document, err = currentPipeline().transform(jsonData)
+		} else {
+			document, err = api.DecodeJSON(jsonData)
+		}
+		if err != nil {
+			log.Fatalf("Error reading JSON: %v", err)
+		}
+
+		matches := path.Get(document)
+		if len(matches) == 0 {
+			fmt.Println("== No matches")
+			return
+		}
+		fmt.Printf("== %d match(es) ==\n", len(matches))
+		for _, match := range matches {
+			out, err := json.Marshal(match)
+			if err != nil {
+				log.Fatalf("Error encoding match: %v", err)
+			}
+			fmt.Println(string(out))
+		}
+	},
+}
+
+func init() {
+	jsonpathTestCmd.Flags().StringVar(&filename, "file", "", "Path to the JSON file")
+	jsonpathTestCmd.Flags().BoolVar(&transformBeforeExtract, "transform", true, "Whether to apply the configured valueSplits before evaluating")
+	err := jsonpathTestCmd.MarkFlagRequired("file")
+	if err != nil {
+		log.Fatal(err)
+	}
+	jsonpathCmd.AddCommand(jsonpathTestCmd)
+	rootCmd.AddCommand(jsonpathCmd)
+}
@@ -0,0 +1,178 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"spacelift-pushgateway/api"
+	"spacelift-pushgateway/helper"
+	"time"
+)
+
+// pipeline is the compiled form of the json, filters and prometheus config.
+// It is built once when the config is loaded, so invalid paths and expressions fail at startup.
+type pipeline struct {
+	valueSplits []ValueSplits
+	extractor   *api.Extractor
+	filter      *api.EventFilter
+	renamer     *api.Renamer
+	relabeler   *api.Relabeler
+	metrics     *api.MetricBuilder
+	normalizer  *api.Normalizer
+}
+
+// event is the result of running a payload through the pipeline.
+type event struct {
+	document   interface{}
+	fields     map[string]interface{}
+	labels     map[string]interface{}
+	env        map[string]interface{}
+	collisions []api.Collision
+	samples    []api.MetricSample
+	accepted   bool
+	rejection  api.Rejection
+}
+
+func newPipeline(c Config) (*pipeline, error) {
+	var errs []error
+	p := &pipeline{valueSplits: c.Json.ValueSplits}
+
+	extractor, err := api.NewExtractor(c.Json.FieldsToExtract)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("fieldsToExtract: %v", err))
+	}
+	p.extractor = extractor
+
+	variables := api.PayloadVariables(c.Json.FieldsToExtract)
+	filter, err := api.NewEventFilter(c.Filters, variables)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("filters: %v", err))
+	}
+	p.filter = filter
+
+	renamer, err := api.NewRenamer(c.Json.Rename, c.Json.Collisions)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("rename: %v", err))
+	}
+	p.renamer = renamer
+
+	relabeler, err := api.NewRelabeler(c.Json.Relabel)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("relabel: %v", err))
+	}
+	p.relabeler = relabeler
+
+	metrics, err := api.NewMetricBuilder(c.Prometheus.metrics(), variables)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("prometheus.metrics: %v", err))
+	}
+	p.metrics = metrics
+
+	normalization, err := c.Normalize.normalization()
+	if err == nil {
+		p.normalizer, err = api.NewNormalizer(normalization)
+	}
+	if err != nil {
+		errs = append(errs, fmt.Errorf("normalize: %v", err))
+	}
+
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return p, nil
+}
+
+// transform applies the value splits and decodes the payload.
+func (p *pipeline) transform(body []byte) (interface{}, error) {
+	body, err := applyValueSplits(body, p.valueSplits)
+	if err != nil {
+		return nil, fmt.Errorf("error transforming JSON: %v", err)
+	}
+	document, err := api.DecodeJSON(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal JSON: %v", err)
+	}
+	return document, nil
+}
+
+// evaluate extracts the fields from a decoded payload and runs the filters.
+func (p *pipeline) evaluate(document interface{}) (*event, error) {
+	fields, err := p.extractor.Extract(document)
+	if err != nil {
+		return nil, fmt.Errorf("error extracting data: %v", err)
+	}
+	env := api.ExpressionEnv(document, fields)
+	ev := &event{document: document, fields: fields, labels: fields, env: env}
+
+	ev.accepted, ev.rejection, err = p.filter.Accept(fields, env)
+	if err != nil {
+		return nil, fmt.Errorf("error evaluating filters: %v", err)
+	}
+	return ev, nil
+}
+
+// rename applies the rename and relabel rules to the extracted fields.
+// An event dropped by a keep or drop rule is marked as not accepted.
+func (p *pipeline) rename(ev *event) error {
+	labels, collisions, err := p.renamer.Apply(ev.fields)
+	ev.collisions = collisions
+	if err != nil {
+		return err
+	}
+	for _, collision := range collisions {
+		log.Warnf("Resolved rename collision %s", collision)
+	}
+	labels, keep := p.relabeler.Apply(labels)
+	if !keep {
+		ev.accepted = false
+		ev.rejection = api.Rejection{Rule: "relabel", Reason: "relabel"}
+		return nil
+	}
+	ev.labels = labels
+	return nil
+}
+
+// build produces the metric samples from the renamed labels and normalizes their label values.
+func (p *pipeline) build(ev *event) error {
+	samples, err := p.metrics.Samples(ev.labels, ev.env)
+	if err != nil {
+		return err
+	}
+	for i := range samples {
+		samples[i].Labels = p.normalizer.Apply(samples[i].Labels)
+	}
+	ev.samples = samples
+	return nil
+}
+
+// process runs all stages for a webhook payload and records their durations.
+func (p *pipeline) process(body []byte) (*event, error) {
+	start := time.Now()
+	document, err := p.transform(body)
+	helper.ObserveStage("transform", start)
+	if err != nil {
+		return nil, err
+	}
+
+	start = time.Now()
+	ev, err := p.evaluate(document)
+	helper.ObserveStage("extract", start)
+	if err != nil || !ev.accepted {
+		return ev, err
+	}
+
+	start = time.Now()
+	err = p.rename(ev)
+	helper.ObserveStage("rename", start)
+	if err != nil || !ev.accepted {
+		return ev, err
+	}
+
+	start = time.Now()
+	err = p.build(ev)
+	helper.ObserveStage("build", start)
+	if err != nil {
+		return nil, err
+	}
+	return ev, nil
+}
@@ -2,6 +2,8 @@ package cmd
 
 import (
 	"fmt"
+	"github.com/fsnotify/fsnotify"
+	"github.com/go-viper/mapstructure/v2"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -9,6 +11,8 @@ import (
 	"os"
 	"spacelift-pushgateway/api"
 	"spacelift-pushgateway/helper"
+	"sync/atomic"
+	"time"
 )
 
 func readJsonFile(filePath string) []byte {
@@ -19,6 +23,18 @@ func readJsonFile(filePath string) []byte {
 	return jsonData
 }
 
+// applyValueSplits runs the value splits over the JSON document.
+func applyValueSplits(jsonData []byte, valueSplits []ValueSplits) ([]byte, error) {
+	var err error
+	for _, splits := range valueSplits {
+		jsonData, err = api.TransformJsonValues(jsonData, splits.Path, splits.Separator)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return jsonData, nil
+}
+
 type ValueSplits struct {
 	Path      string
 	Separator string
@@ -26,30 +42,211 @@ type ValueSplits struct {
 
 type Config struct {
 	App struct {
-		Port int
+		Port         int
+		ReadTimeout  time.Duration
+		WriteTimeout time.Duration
+		IdleTimeout  time.Duration
+		// TLS serves HTTPS when a certificate is configured
+		TLS helper.ServerTLSConfig
+		// ShutdownGracePeriod bounds the wait for in-flight requests and queued events on shutdown
+		ShutdownGracePeriod time.Duration
+		// Limits protect /push from large and frequent requests
+		Limits struct {
+			MaxBodyBytes      int64
+			PerKey            api.RateLimit
+			PerIP             api.RateLimit
+			TrustForwardedFor bool
+		}
+		// Queue holds accepted events until they are pushed
+		Queue queueConfig
+		// Readiness configures the background Pushgateway checker behind /readyz
+		Readiness struct {
+			Interval         time.Duration
+			FailureThreshold int
+		}
 	}
 
 	Json struct {
 		ValueSplits     []ValueSplits
-		FieldsToExtract []string
+		FieldsToExtract []api.Field
 		Rename          []api.Rename
+		Collisions      api.CollisionPolicy
+		Relabel         []api.Relabel
+	}
+	Filters []api.Filter
+	// Auth holds the API keys accepted by the web server
+	Auth struct {
+		Keys     []api.APIKey
+		KeysFile string
 	}
 	Logging struct {
 		Level  string
 		Format string
 	}
-	Prometheus struct {
-		PushGatewayUrl   string
-		TargetMetric     string
-		TargetMetricHelp string
-		JobName          string
+	Prometheus prometheusConfig
+	// Normalize cleans up label values before they are pushed, see api.LabelNormalization
+	Normalize normalizeConfig
+	// Cardinality limits the distinct values per label, see api.CardinalityLimit
+	Cardinality cardinalityConfig
+	// Deduplication answers retried webhook deliveries without pushing them again, see api.Deduplication
+	Deduplication api.Deduplication
+	// Sinks are the destinations of the events, the default is the Pushgateway of the prometheus settings
+	Sinks []sinkConfig
+}
+
+type prometheusConfig struct {
+	PushGatewayUrl   string
+	TargetMetric     string
+	TargetMetricHelp string
+	JobName          string
+	// Value is an optional expression for the metric value, the default is the current unix time
+	Value      string
+	KeepLabels []string
+	DropLabels []string
+	// Metrics replaces the target metric with a list of metrics
+	Metrics []api.Metric
+	// Client configures authentication, TLS, proxy and timeouts for the Pushgateway
+	Client helper.HTTPClientConfig
+}
+
+// metrics returns the configured metrics, or the target metric if there are none.
+func (p prometheusConfig) metrics() []api.Metric {
+	if len(p.Metrics) > 0 {
+		return p.Metrics
 	}
+	return []api.Metric{{
+		Name:       p.TargetMetric,
+		Help:       p.TargetMetricHelp,
+		Value:      p.Value,
+		KeepLabels: p.KeepLabels,
+		DropLabels: p.DropLabels,
+	}}
+}
+
+// cardinalityConfig is api.CardinalityLimit with the limits of single labels as a
+// list, viper lowercases the keys of maps and label names are case-sensitive.
+type cardinalityConfig struct {
+	MaxValuesPerLabel int
+	Labels            []labelLimit
+	Overflow          string
+}
+
+// labelLimit bounds the distinct values of the label Name.
+type labelLimit struct {
+	Name      string
+	MaxValues int
+}
+
+// limit returns the cardinality limit, labels must be listed once.
+func (c cardinalityConfig) limit() (api.CardinalityLimit, error) {
+	limit := api.CardinalityLimit{MaxValuesPerLabel: c.MaxValuesPerLabel, Overflow: c.Overflow, Labels: make(map[string]int, len(c.Labels))}
+	for i, label := range c.Labels {
+		if label.Name == "" {
+			return limit, fmt.Errorf("label %d: missing name", i)
+		}
+		if _, ok := limit.Labels[label.Name]; ok {
+			return limit, fmt.Errorf("label %d: '%s' is listed twice", i, label.Name)
+		}
+		limit.Labels[label.Name] = label.MaxValues
+	}
+	return limit, nil
+}
+
+// normalizeConfig is api.LabelNormalization with the normalization of single labels
+// as a list, see cardinalityConfig.
+type normalizeConfig struct {
+	Default api.Normalization
+	Labels  []labelNormalization
+}
+
+// labelNormalization is the normalization of the label Name.
+type labelNormalization struct {
+	Name              string
+	api.Normalization `mapstructure:",squash"`
+}
+
+// normalization returns the label normalization, labels must be listed once.
+func (c normalizeConfig) normalization() (api.LabelNormalization, error) {
+	normalization := api.LabelNormalization{Default: c.Default, Labels: make(map[string]api.Normalization, len(c.Labels))}
+	for i, label := range c.Labels {
+		if label.Name == "" {
+			return normalization, fmt.Errorf("label %d: missing name", i)
+		}
+		if _, ok := normalization.Labels[label.Name]; ok {
+			return normalization, fmt.Errorf("label %d: '%s' is listed twice", i, label.Name)
+		}
+		normalization.Labels[label.Name] = label.Normalization
+	}
+	return normalization, nil
 }
 
 var (
+	// apiKey is the legacy single key from the API_KEY environment variable
 	apiKey string
 	config Config
+	// eventPipeline is replaced when the config is reloaded, see currentPipeline
+	eventPipeline atomic.Pointer[pipeline]
 )
+
+// Plain strings in fieldsToExtract are decoded into api.Field via UnmarshalText
+var decodeHook = viper.DecodeHook(mapstructure.ComposeDecodeHookFunc(
+	mapstructure.StringToTimeDurationHookFunc(),
+	mapstructure.StringToSliceHookFunc(","),
+	mapstructure.StringToTimeHookFunc(time.RFC3339),
+	mapstructure.TextUnmarshallerHookFunc(),
+))
+
+// apiKeys collects the keys from the config, the keys file and API_KEY.
+func apiKeys(c Config, legacyKey string) ([]api.APIKey, error) {
+	keys := append([]api.APIKey{}, c.Auth.Keys...)
+	if c.Auth.KeysFile != "" {
+		fileKeys, err := api.LoadAPIKeys(c.Auth.KeysFile)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, fileKeys...)
+	}
+	if legacyKey != "" {
+		keys = append(keys, api.APIKey{Name: "default", Key: legacyKey})
+	}
+	return keys, nil
+}
+
+// loadConfig unmarshals the config read by viper and compiles its pipeline.
+func loadConfig() (Config, *pipeline, error) {
+	var c Config
+	if err := viper.Unmarshal(&c, decodeHook); err != nil {
+		return c, nil, fmt.Errorf("unmarshalling config: %v", err)
+	}
+	p, err := newPipeline(c)
+	if err != nil {
+		return c, nil, fmt.Errorf("invalid config: %v", err)
+	}
+	return c, p, nil
+}
+
+// watchConfig reloads the pipeline whenever the config file changes. An invalid
+// config is logged and the previous pipeline stays active. Server settings like
+// the port are only read at startup.
+func watchConfig() {
+	viper.OnConfigChange(func(e fsnotify.Event) {
+		_, p, err := loadConfig()
+		helper.ConfigReloaded(err)
+		if err != nil {
+			log.Errorf("Config reload from %s failed, keeping the previous config: %v", e.Name, err)
+			return
+		}
+		eventPipeline.Store(p)
+		log.Infof("Reloaded config from %s", e.Name)
+	})
+	viper.WatchConfig()
+}
+
+// currentPipeline returns the pipeline of the most recently loaded config.
+func currentPipeline() *pipeline {
+	return eventPipeline.Load()
+}
+
 var rootCmd = &cobra.Command{
 	Use:   "spacelift-pushgateway",
 	Short: "Send Spacelift data to a Prometheus Pushgateway",
@@ -71,8 +268,22 @@ func Execute() {
 func init() {
 	helper.LoggerInit()
 	viper.SetDefault("PUSH_GATEWAY_URL", "http://localhost:9091")
-	viper.SetDefault("API_KEY", "extreme-secret-key")
+	viper.SetDefault("app.readTimeout", "10s")
+	viper.SetDefault("app.writeTimeout", "30s")
+	viper.SetDefault("app.idleTimeout", "60s")
+	viper.SetDefault("app.shutdownGracePeriod", "25s")
+	viper.SetDefault("app.limits.maxBodyBytes", 1<<20)
+	viper.SetDefault("app.queue.size", 1000)
+	viper.SetDefault("app.queue.workers", 1)
+	viper.SetDefault("prometheus.client.timeout", "10s")
+	viper.SetDefault("app.readiness.interval", "10s")
+	viper.SetDefault("app.readiness.failureThreshold", 3)
+
+	cobra.OnInitialize(initConfig)
+}
 
+// initConfig reads ./config.yaml before a command runs.
+func initConfig() {
 	viper.SetConfigName("config")
 	viper.SetConfigType("yaml")
 	viper.AddConfigPath(".")
@@ -81,9 +292,12 @@ func init() {
 		log.Fatalf("Error Loading config: %v", err)
 	}
 
-	if err := viper.Unmarshal(&config); err != nil {
-		log.Fatalf("Fehler unmarshalling config: %v", err)
+	c, p, err := loadConfig()
+	if err != nil {
+		log.Fatalf("Error Loading config: %v", err)
 	}
+	config = c
+	eventPipeline.Store(p)
 	viper.AutomaticEnv()
 	apiKey = viper.GetString("API_KEY")
 
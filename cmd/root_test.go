@@ -0,0 +1,58 @@
+package cmd
+
+import (
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"spacelift-pushgateway/api"
+)
+
+// TestLoadShippedConfig reads config.yaml like initConfig does, so settings for
+// label names keep their case although viper lowercases map keys.
+func TestLoadShippedConfig(t *testing.T) {
+	viper.Reset()
+	t.Cleanup(viper.Reset)
+	viper.SetConfigFile("../config.yaml")
+	require.NoError(t, viper.ReadInConfig())
+
+	c, p, err := loadConfig()
+	require.NoError(t, err)
+	assert.NotNil(t, p)
+
+	limit, err := c.Cardinality.limit()
+	require.NoError(t, err)
+	limiter, err := api.NewCardinalityLimiter(limit)
+	require.NoError(t, err)
+	_, err = limiter.Limit(map[string]string{"commit_issueId": "INFRA-1", "stackId": "infra"})
+	require.NoError(t, err)
+	status := limiter.Status()
+	assert.Equal(t, 100, status["commit_issueId"].Limit)
+	assert.Equal(t, 1000, status["stackId"].Limit)
+	assert.Equal(t, map[string]string{"namespace": "infra", "stackId": "Infra"}, p.normalizer.Apply(map[string]string{"namespace": " Infra", "stackId": "Infra"}))
+}
+
+func TestCardinalityConfigLimit(t *testing.T) {
+	c := cardinalityConfig{MaxValuesPerLabel: 10, Labels: []labelLimit{{Name: "stackId", MaxValues: 5}, {Name: "stackid", MaxValues: 1}}}
+	limit, err := c.limit()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{"stackId": 5, "stackid": 1}, limit.Labels)
+
+	c.Labels = append(c.Labels, labelLimit{Name: "stackId", MaxValues: 1})
+	_, err = c.limit()
+	assert.ErrorContains(t, err, "label 2: 'stackId' is listed twice")
+	_, err = cardinalityConfig{Labels: []labelLimit{{MaxValues: 1}}}.limit()
+	assert.ErrorContains(t, err, "label 0: missing name")
+}
+
+func TestNormalizeConfigNormalization(t *testing.T) {
+	c := normalizeConfig{Labels: []labelNormalization{{Name: "stackId", Normalization: api.Normalization{Lowercase: true}}}}
+	normalization, err := c.normalization()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]api.Normalization{"stackId": {Lowercase: true}}, normalization.Labels)
+
+	c.Labels = append(c.Labels, labelNormalization{Name: "stackId"})
+	_, err = c.normalization()
+	assert.ErrorContains(t, err, "label 1: 'stackId' is listed twice")
+}
@@ -0,0 +1,395 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"spacelift-pushgateway/api"
+	"spacelift-pushgateway/helper"
+	"strings"
+	"time"
+)
+
+// queueConfig sizes the queue of a sink.
+type queueConfig struct {
+	Size    int
+	Workers int
+	// Timeout bounds every push attempt, default api.DefaultPushTimeout
+	Timeout time.Duration
+}
+
+// sinkConfig is a destination of the events. Type selects the implementation, the
+// settings of the other types are ignored.
+type sinkConfig struct {
+	// Name identifies the sink in logs, metrics and /readyz, the default is the type
+	Name string
+	// Type is pushgateway (default), remote_write, otlp, otlp_traces, influxdb, statsd, eventlog or webhook
+	Type string
+	// Filters select the events for this sink, after the global filters
+	Filters []api.Filter
+	// Queue defaults to app.queue
+	Queue       queueConfig
+	Retry       api.Retry
+	Pushgateway pushgatewaySinkConfig
+	RemoteWrite remoteWriteSinkConfig
+	OTLP        otlpSinkConfig
+	Traces      tracesSinkConfig
+	InfluxDB    influxDBSinkConfig
+	StatsD      statsdSinkConfig
+	EventLog    eventLogSinkConfig
+	Webhook     webhookSinkConfig
+}
+
+type pushgatewaySinkConfig struct {
+	URL     string
+	JobName string
+	Client  helper.HTTPClientConfig
+}
+
+type remoteWriteSinkConfig struct {
+	URL string
+	// HealthURL is checked for /readyz, e.g. the /ready endpoint of the receiver
+	HealthURL string
+	// MaxSamplesPerSend bounds the samples of waiting events sent in one request
+	MaxSamplesPerSend int
+	Client            helper.HTTPClientConfig
+}
+
+type otlpSinkConfig struct {
+	// URL of the metrics endpoint, e.g. http://collector:4318/v1/metrics
+	URL string
+	// Encoding is protobuf (default) or json
+	Encoding string
+	// ResourceLabels become resource attributes, the other labels data point attributes
+	ResourceLabels    []string
+	ServiceName       string
+	HealthURL         string
+	MaxSamplesPerSend int
+	Client            helper.HTTPClientConfig
+}
+
+type tracesSinkConfig struct {
+	// URL of the traces endpoint, e.g. http://collector:4318/v1/traces
+	URL string
+	// Encoding is protobuf (default) or json
+	Encoding    string
+	ServiceName string
+	HealthURL   string
+	// RunID and State are the JSONPaths of the run ID (default {.run.id}) and the state (default {.state}) in the payload
+	RunID string
+	State string
+	// Attributes are the labels added to the spans, default all
+	Attributes     []string
+	TerminalStates []string
+	ErrorStates    []string
+	// Timeout exports runs without an event for this long as timed out, default 1h
+	Timeout time.Duration
+	MaxRuns int
+	Client  helper.HTTPClientConfig
+}
+
+type influxDBSinkConfig struct {
+	// URL of the write API, e.g. http://influxdb:8086/api/v2/write?org=infra&bucket=spacelift
+	URL string
+	// HealthURL is checked for /readyz, e.g. http://influxdb:8086/health
+	HealthURL         string
+	MaxSamplesPerSend int
+	// Client adds the token, e.g. headers: {Authorization: "Token ..."}
+	Client helper.HTTPClientConfig
+}
+
+type statsdSinkConfig struct {
+	// Address of the StatsD server or Datadog agent, e.g. localhost:8125
+	Address string
+	// Flavor is dogstatsd (default, labels as tags) or statsd (label values in the name)
+	Flavor        string
+	Prefix        string
+	MaxPacketSize int
+}
+
+type eventLogSinkConfig struct {
+	// Output is stdout (default), file, loki or elasticsearch
+	Output string
+	// Path, MaxSizeMB (default 100) and MaxBackups (default 5) configure the file output
+	Path       string
+	MaxSizeMB  int
+	MaxBackups int
+	// URL of the Loki push API or the Elasticsearch bulk API
+	URL       string
+	HealthURL string
+	// StreamLabels label the Loki streams, besides service_name
+	StreamLabels []string
+	// Index is the Elasticsearch index or data stream, default spacelift-events
+	Index  string
+	Client helper.HTTPClientConfig
+}
+
+type webhookSinkConfig struct {
+	// Targets are the URLs with an optional condition and template each
+	Targets []api.WebhookTarget
+	// Template is a Go text/template over the extracted fields, default {{json .}}
+	Template    string
+	ContentType string
+	// Secret or SecretFile sign the bodies with HMAC-SHA256 in SignatureHeader (default X-Signature-256)
+	Secret          string
+	SecretFile      string
+	SignatureHeader string
+	Client          helper.HTTPClientConfig
+}
+
+// secret returns the signing secret, read from SecretFile if set.
+func (c webhookSinkConfig) secret() ([]byte, error) {
+	if c.Secret != "" && c.SecretFile != "" {
+		return nil, fmt.Errorf("secret and secretFile are mutually exclusive")
+	}
+	if c.SecretFile == "" {
+		return []byte(c.Secret), nil
+	}
+	content, err := os.ReadFile(c.SecretFile)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(strings.TrimSpace(string(content))), nil
+}
+
+// defaultMaxAttempts applies to sinks without retry.maxAttempts. Events are
+// acknowledged once queued, so Spacelift never redelivers an event whose push failed.
+const defaultMaxAttempts = 5
+
+// defaultClientTimeout applies to the HTTP clients of sinks without client.timeout,
+// so a receiver that never answers cannot block a queue.
+const defaultClientTimeout = 10 * time.Second
+
+// sinks returns the configured sinks, or a Pushgateway sink from the prometheus
+// settings if there are none.
+func (c Config) sinks() []sinkConfig {
+	if len(c.Sinks) == 0 {
+		client := c.Prometheus.Client
+		if client.Timeout == 0 {
+			client.Timeout = defaultClientTimeout
+		}
+		return []sinkConfig{{
+			Name:  "pushgateway",
+			Type:  "pushgateway",
+			Queue: c.App.Queue,
+			Retry: api.Retry{MaxAttempts: defaultMaxAttempts},
+			Pushgateway: pushgatewaySinkConfig{
+				URL:     c.Prometheus.PushGatewayUrl,
+				JobName: c.Prometheus.JobName,
+				Client:  client,
+			},
+		}}
+	}
+	sinks := make([]sinkConfig, len(c.Sinks))
+	for i, sink := range c.Sinks {
+		if sink.Type == "" {
+			sink.Type = "pushgateway"
+		}
+		if sink.Name == "" {
+			sink.Name = sink.Type
+		}
+		if sink.Queue.Size == 0 {
+			sink.Queue.Size = c.App.Queue.Size
+		}
+		if sink.Queue.Workers == 0 {
+			sink.Queue.Workers = c.App.Queue.Workers
+		}
+		if sink.Queue.Timeout == 0 {
+			sink.Queue.Timeout = c.App.Queue.Timeout
+		}
+		for _, client := range []*helper.HTTPClientConfig{&sink.Pushgateway.Client, &sink.RemoteWrite.Client, &sink.OTLP.Client, &sink.Traces.Client, &sink.InfluxDB.Client, &sink.EventLog.Client, &sink.Webhook.Client} {
+			if client.Timeout == 0 {
+				client.Timeout = defaultClientTimeout
+			}
+		}
+		if sink.Retry.MaxAttempts == 0 {
+			sink.Retry.MaxAttempts = defaultMaxAttempts
+		}
+		sinks[i] = sink
+	}
+	return sinks
+}
+
+// newSink creates the sink of the configured type. Expressions can use variables,
+// see api.PayloadVariables.
+func newSink(c sinkConfig, variables api.Variables) (api.Sink, error) {
+	switch c.Type {
+	case "pushgateway":
+		if c.Pushgateway.URL == "" {
+			return nil, fmt.Errorf("missing pushgateway.url")
+		}
+		client, err := helper.NewHTTPClient(c.Pushgateway.Client)
+		if err != nil {
+			return nil, fmt.Errorf("invalid client config: %v", err)
+		}
+		return api.NewPushGatewayWithClient(c.Pushgateway.URL, "", "", c.Pushgateway.JobName, client), nil
+	case "remote_write":
+		if c.RemoteWrite.URL == "" {
+			return nil, fmt.Errorf("missing remoteWrite.url")
+		}
+		client, err := helper.NewHTTPClient(c.RemoteWrite.Client)
+		if err != nil {
+			return nil, fmt.Errorf("invalid client config: %v", err)
+		}
+		return api.NewRemoteWrite(c.RemoteWrite.URL, client, c.RemoteWrite.MaxSamplesPerSend, c.RemoteWrite.HealthURL), nil
+	case "otlp":
+		if c.OTLP.URL == "" {
+			return nil, fmt.Errorf("missing otlp.url")
+		}
+		client, err := helper.NewHTTPClient(c.OTLP.Client)
+		if err != nil {
+			return nil, fmt.Errorf("invalid client config: %v", err)
+		}
+		return api.NewOTLP(c.OTLP.URL, client, api.OTLPOptions{
+			Encoding:          c.OTLP.Encoding,
+			ResourceLabels:    c.OTLP.ResourceLabels,
+			ServiceName:       c.OTLP.ServiceName,
+			MaxSamplesPerSend: c.OTLP.MaxSamplesPerSend,
+			HealthURL:         c.OTLP.HealthURL,
+		})
+	case "otlp_traces":
+		if c.Traces.URL == "" {
+			return nil, fmt.Errorf("missing traces.url")
+		}
+		client, err := helper.NewHTTPClient(c.Traces.Client)
+		if err != nil {
+			return nil, fmt.Errorf("invalid client config: %v", err)
+		}
+		return api.NewRunTracer(c.Traces.URL, client, api.RunTracerOptions{
+			Encoding:       c.Traces.Encoding,
+			ServiceName:    c.Traces.ServiceName,
+			HealthURL:      c.Traces.HealthURL,
+			RunIDPath:      c.Traces.RunID,
+			StatePath:      c.Traces.State,
+			Attributes:     c.Traces.Attributes,
+			TerminalStates: c.Traces.TerminalStates,
+			ErrorStates:    c.Traces.ErrorStates,
+			Timeout:        c.Traces.Timeout,
+			MaxRuns:        c.Traces.MaxRuns,
+		})
+	case "influxdb":
+		if c.InfluxDB.URL == "" {
+			return nil, fmt.Errorf("missing influxDB.url")
+		}
+		client, err := helper.NewHTTPClient(c.InfluxDB.Client)
+		if err != nil {
+			return nil, fmt.Errorf("invalid client config: %v", err)
+		}
+		return api.NewInfluxDB(c.InfluxDB.URL, client, c.InfluxDB.MaxSamplesPerSend, c.InfluxDB.HealthURL), nil
+	case "statsd":
+		if c.StatsD.Address == "" {
+			return nil, fmt.Errorf("missing statsd.address")
+		}
+		return api.NewStatsD(c.StatsD.Address, api.StatsDOptions{
+			Flavor:        c.StatsD.Flavor,
+			Prefix:        c.StatsD.Prefix,
+			MaxPacketSize: c.StatsD.MaxPacketSize,
+		})
+	case "eventlog":
+		client, err := helper.NewHTTPClient(c.EventLog.Client)
+		if err != nil {
+			return nil, fmt.Errorf("invalid client config: %v", err)
+		}
+		sink, err := api.NewEventLog(api.EventLogOptions{
+			Output:       c.EventLog.Output,
+			Path:         c.EventLog.Path,
+			MaxSizeBytes: int64(c.EventLog.MaxSizeMB) << 20,
+			MaxBackups:   c.EventLog.MaxBackups,
+			URL:          c.EventLog.URL,
+			Client:       client,
+			HealthURL:    c.EventLog.HealthURL,
+			StreamLabels: c.EventLog.StreamLabels,
+			Index:        c.EventLog.Index,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("eventLog: %v", err)
+		}
+		return sink, nil
+	case "webhook":
+		client, err := helper.NewHTTPClient(c.Webhook.Client)
+		if err != nil {
+			return nil, fmt.Errorf("invalid client config: %v", err)
+		}
+		secret, err := c.Webhook.secret()
+		if err != nil {
+			return nil, fmt.Errorf("webhook: %v", err)
+		}
+		sink, err := api.NewWebhook(client, api.WebhookOptions{
+			Targets:         c.Webhook.Targets,
+			Variables:       variables,
+			Template:        c.Webhook.Template,
+			ContentType:     c.Webhook.ContentType,
+			Secret:          secret,
+			SignatureHeader: c.Webhook.SignatureHeader,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("webhook: %v", err)
+		}
+		return sink, nil
+	default:
+		return nil, fmt.Errorf("unknown type '%s', expected pushgateway, remote_write, otlp, otlp_traces, influxdb, statsd, eventlog or webhook", c.Type)
+	}
+}
+
+// newFanout creates all sinks with their filters and queues. All invalid sinks are
+// reported together.
+func newFanout(c Config) (*api.Fanout, error) {
+	var (
+		errs   []error
+		routes []*api.SinkRoute
+	)
+	variables := api.PayloadVariables(c.Json.FieldsToExtract)
+	for i, sc := range c.sinks() {
+		sink, err := newSink(sc, variables)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("sink %d (%s): %v", i, sc.Name, err))
+			continue
+		}
+		options := api.QueueOptions{Size: sc.Queue.Size, Workers: sc.Queue.Workers, Retry: sc.Retry, Timeout: sc.Queue.Timeout}
+		route := api.NewSinkRoute(sc.Name, sink, nil, options, pushed(sc.Name))
+		routes = append(routes, route)
+		if len(sc.Filters) > 0 {
+			route.Filter, err = api.NewEventFilter(sc.Filters, variables)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("sink %d (%s): filters: %v", i, sc.Name, err))
+			}
+		}
+	}
+	if len(errs) > 0 {
+		closeRoutes(routes)
+		return nil, errors.Join(errs...)
+	}
+	fanout, err := api.NewFanout(routes...)
+	if err != nil {
+		closeRoutes(routes)
+		return nil, err
+	}
+	return fanout, nil
+}
+
+// closeRoutes releases the queues and sinks built before the config turned out to
+// be invalid, e.g. the goroutine of a RunTracer or the socket of a StatsD sink.
+func closeRoutes(routes []*api.SinkRoute) {
+	for _, route := range routes {
+		if err := route.Close(context.Background()); err != nil {
+			log.Warnf("Failed to close sink %s: %v", route.Name, err)
+		}
+	}
+}
+
+// pushed returns the callback recording the results of the queued pushes of a sink.
+func pushed(sink string) api.PushResultFunc {
+	logger := log.WithField("sink", sink)
+	return func(samples []api.MetricSample, err error, duration time.Duration) {
+		helper.StageDuration.WithLabelValues("push").Observe(duration.Seconds())
+		if err != nil {
+			logger.Errorf("Failed to push: %v", err)
+			helper.PushErrors.WithLabelValues(sink, api.PushErrorType(err)).Inc()
+			helper.EventsDropped.WithLabelValues("push_error").Inc()
+			return
+		}
+		logger.Info("Successfully pushed data")
+	}
+}
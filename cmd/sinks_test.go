@@ -0,0 +1,71 @@
+package cmd
+
+import (
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"spacelift-pushgateway/api"
+	"spacelift-pushgateway/helper"
+)
+
+func TestConfigSinksDefaults(t *testing.T) {
+	var c Config
+	c.App.Queue.Size = 10
+	c.App.Queue.Workers = 2
+	c.Prometheus.PushGatewayUrl = "http://localhost:9091"
+	sinks := c.sinks()
+	assert.Len(t, sinks, 1)
+	assert.Equal(t, defaultMaxAttempts, sinks[0].Retry.MaxAttempts, "the sink from the prometheus settings retries")
+	assert.Equal(t, defaultClientTimeout, sinks[0].Pushgateway.Client.Timeout)
+
+	c.App.Queue.Timeout = time.Minute
+	c.Sinks = []sinkConfig{
+		{Name: "default"},
+		{Name: "once", Retry: api.Retry{MaxAttempts: 1}},
+		{Name: "events", Type: "eventlog", EventLog: eventLogSinkConfig{Client: helper.HTTPClientConfig{Timeout: time.Second}}},
+		{Name: "slack", Type: "webhook"},
+	}
+	sinks = c.sinks()
+	assert.Equal(t, "pushgateway", sinks[0].Type)
+	assert.Equal(t, queueConfig{Size: 10, Workers: 2, Timeout: time.Minute}, sinks[0].Queue)
+	assert.Equal(t, defaultMaxAttempts, sinks[0].Retry.MaxAttempts)
+	assert.Equal(t, 1, sinks[1].Retry.MaxAttempts, "1 disables retries")
+	assert.Equal(t, defaultClientTimeout, sinks[0].Pushgateway.Client.Timeout)
+	assert.Equal(t, time.Second, sinks[2].EventLog.Client.Timeout)
+	assert.Equal(t, defaultClientTimeout, sinks[3].Webhook.Client.Timeout, "every HTTP sink has a timeout")
+}
+
+func TestNewFanoutClosesSinksOnError(t *testing.T) {
+	traces := tracesSinkConfig{URL: "http://collector:4318/v1/traces"}
+	statsd := statsdSinkConfig{Address: "localhost:8125"}
+	for name, sinks := range map[string][]sinkConfig{
+		"invalid sink": {
+			{Name: "runs", Type: "otlp_traces", Traces: traces},
+			{Name: "datadog", Type: "statsd", StatsD: statsd},
+			{Name: "nourl"},
+		},
+		"invalid filter": {
+			{Name: "runs", Type: "otlp_traces", Traces: traces, Filters: []api.Filter{{Action: "maybe"}}},
+		},
+		"duplicate name": {
+			{Name: "runs", Type: "otlp_traces", Traces: traces},
+			{Name: "runs", Type: "statsd", StatsD: statsd},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			before := runtime.NumGoroutine()
+			var c Config
+			c.App.Queue.Size = 10
+			c.Sinks = sinks
+			_, err := newFanout(c)
+			require.Error(t, err)
+			for deadline := time.Now().Add(time.Second); runtime.NumGoroutine() > before && time.Now().Before(deadline); {
+				time.Sleep(10 * time.Millisecond)
+			}
+			assert.LessOrEqual(t, runtime.NumGoroutine(), before, "the sinks and queues built are closed")
+		})
+	}
+}
@@ -4,7 +4,6 @@ import (
 	"fmt"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
-	"spacelift-pushgateway/api"
 )
 
 var filename string
@@ -16,16 +15,9 @@ var transformCmd = &cobra.Command{
 It reads the JSON file, applies transformations based on the given paths and separators, and then outputs the transformed JSON.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		jsonData := readJsonFile(filename)
-		var (
-			transformedJSON []byte
-			err             error
-		)
-
-		for _, splits := range config.Json.ValueSplits {
-			transformedJSON, err = api.TransformJsonValues(jsonData, splits.Path, splits.Separator)
-			if err != nil {
-				log.Fatalf("Error transforming JSON: %v", err)
-			}
+		transformedJSON, err := applyValueSplits(jsonData, config.Json.ValueSplits)
+		if err != nil {
+			log.Fatalf("Error transforming JSON: %v", err)
 		}
 		fmt.Println(string(transformedJSON))
 	},
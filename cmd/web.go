@@ -1,96 +1,449 @@
 package cmd
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"io"
+	"math"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
 	"spacelift-pushgateway/api"
+	"spacelift-pushgateway/helper"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 )
 
 // webCmd represents the web command
 var webCmd = &cobra.Command{
 	Use:   "web",
-	Short: "A brief description of your command",
-	Long: `A longer description that spans multiple lines and likely contains examples
-and usage of using your command. For example:
-
-Cobra is a CLI library for Go that empowers applications.
-This application is a tool to generate the needed files
-to quickly create a Cobra application.`,
+	Short: "Receives Spacelift webhooks and pushes them to the Pushgateway",
+	Long: `The web command serves the /push webhook endpoint. Events are pushed to the
+Pushgateway in the background. On SIGINT or SIGTERM the server stops accepting
+requests, waits for in-flight requests and pushes all queued events before it exits.`,
 	Run: func(cmd *cobra.Command, args []string) {
-		gw := api.NewPushGateway(config.Prometheus.PushGatewayUrl, config.Prometheus.TargetMetric, config.Prometheus.TargetMetricHelp, config.Prometheus.JobName)
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		watchConfig()
 
-		if gw.CheckPushGatewayStatus() != nil {
-			log.Error(gw.CheckPushGatewayStatus())
+		s, err := newServer(config)
+		if err != nil {
+			log.Fatal(err)
+		}
+		listener, err := net.Listen("tcp", fmt.Sprintf(":%d", config.App.Port))
+		if err != nil {
+			log.Fatal(err)
+		}
+		scheme := "http"
+		if config.App.TLS.Enabled() {
+			scheme = "https"
 		}
+		log.Infof("Server is running on %s://localhost:%d", scheme, config.App.Port)
+		if err := s.serve(ctx, listener); err != nil {
+			log.Fatal(err)
+		}
+		log.Info("Server stopped")
+	},
+}
 
-		http.HandleFunc("/health", func(w http.ResponseWriter, request *http.Request) {
-			w.WriteHeader(http.StatusOK)
-			w.Write([]byte("OK"))
-		})
-		http.HandleFunc("/push", func(w http.ResponseWriter, r *http.Request) {
-			if r.Method != http.MethodPost {
-				http.Error(w, "Only POST method is supported", http.StatusMethodNotAllowed)
-				return
-			}
-			authHeader := r.Header.Get("Authorization")
+// server serves the webhook endpoint and pushes accepted events through its queue.
+type server struct {
+	config   Config
+	keys     *api.KeyStore
+	perKey   *api.RateLimiter
+	perIP    *api.RateLimiter
+	limiter  *api.CardinalityLimiter
+	dedup    *api.Deduplicator
+	fanout   *api.Fanout
+	checkers []*api.HealthChecker
+	http     *http.Server
+}
 
-			if authHeader != fmt.Sprintf("Bearer %s", apiKey) {
-				http.Error(w, "Unauthorized", http.StatusUnauthorized)
-				return
-			}
+func newServer(c Config) (*server, error) {
+	s := &server{config: c}
+	keys, err := apiKeys(c, apiKey)
+	if err != nil {
+		return nil, err
+	}
+	s.keys, err = api.NewKeyStore(keys)
+	if err != nil {
+		return nil, fmt.Errorf("invalid API keys: %v", err)
+	}
+	for _, name := range s.keys.Expiring(time.Now(), 7*24*time.Hour) {
+		log.Warnf("API key '%s' expires within 7 days", name)
+	}
 
-			body, err := io.ReadAll(r.Body)
-			if err != nil {
-				http.Error(w, "Unable to read request body", http.StatusInternalServerError)
-				return
-			}
-			defer func(Body io.ReadCloser) {
-				err := Body.Close()
-				if err != nil {
-					log.Fatal("Error closing body")
-				}
-			}(r.Body)
+	// The interval is also the timeout of the sink health checks
+	if c.App.Readiness.Interval <= 0 {
+		return nil, fmt.Errorf("invalid readiness config: interval must be positive, got %s", c.App.Readiness.Interval)
+	}
 
-			// Transform
-			for _, splits := range config.Json.ValueSplits {
-				body, err = api.TransformJsonValues(body, splits.Path, splits.Separator)
-				if err != nil {
-					log.Fatalf("Error transforming JSON: %v", err)
-				}
-			}
-			// Extract
-			results, err := api.ExtractMultipleJSONPaths(body, config.Json.FieldsToExtract)
-			if err != nil {
-				log.Fatalf("Error extracting data: %v", err)
-			}
+	s.perKey = api.NewRateLimiter(c.App.Limits.PerKey)
+	s.perIP = api.NewRateLimiter(c.App.Limits.PerIP)
+
+	// The limiter keeps its state for the lifetime of the process, changes to the
+	// cardinality config need a restart
+	limit, err := c.Cardinality.limit()
+	if err != nil {
+		return nil, fmt.Errorf("invalid cardinality config: %v", err)
+	}
+	limiter, err := api.NewCardinalityLimiter(limit)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cardinality config: %v", err)
+	}
+	s.limiter = limiter
+
+	if c.Deduplication.Enabled() {
+		s.dedup, err = api.NewDeduplicator(c.Deduplication)
+		if err != nil {
+			return nil, fmt.Errorf("invalid deduplication config: %v", err)
+		}
+	}
+
+	s.http = &http.Server{
+		Handler:      s.routes(),
+		ReadTimeout:  c.App.ReadTimeout,
+		WriteTimeout: c.App.WriteTimeout,
+		IdleTimeout:  c.App.IdleTimeout,
+	}
+	if c.App.TLS.Enabled() {
+		tlsConfig, err := helper.NewServerTLSConfig(c.App.TLS)
+		if err != nil {
+			return nil, fmt.Errorf("invalid TLS config: %v", err)
+		}
+		s.http.TLSConfig = tlsConfig
+	}
+
+	s.fanout, err = newFanout(c)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sinks: %v", err)
+	}
+	helper.SetQueueDepths(s.fanout.Len)
+	for _, route := range s.fanout.Routes() {
+		// A check must not outlast its interval
+		check := api.HealthCheck(route.Sink, c.App.Readiness.Interval)
+		s.checkers = append(s.checkers, api.NewHealthChecker(route.Name, check, c.App.Readiness.Interval, c.App.Readiness.FailureThreshold))
+	}
+	return s, nil
+}
+
+// pending returns the number of events not pushed yet by all sinks.
+func (s *server) pending() int {
+	var pending int
+	for _, n := range s.fanout.Len() {
+		pending += n
+	}
+	return pending
+}
+
+func (s *server) routes() http.Handler {
+	mux := http.NewServeMux()
+	// Liveness: the process serves requests
+	healthz := helper.InstrumentHandler("healthz", func(w http.ResponseWriter, request *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("OK"))
+	})
+	mux.HandleFunc("/health", healthz)
+	mux.HandleFunc("/healthz", healthz)
+	mux.HandleFunc("/readyz", helper.InstrumentHandler("readyz", s.handleReadyz))
+	mux.Handle("/metrics", helper.MetricsHandler())
+	mux.HandleFunc("/status/cardinality", helper.InstrumentHandler("status", s.authenticated("status", func(w http.ResponseWriter, r *http.Request, key string) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(s.limiter.Status()); err != nil {
+			log.WithField("key", key).Error(err)
+		}
+	})))
+	mux.HandleFunc("/push", helper.InstrumentHandler("push", s.limitedByIP(s.authenticated("push", s.handlePush))))
+	return mux
+}
+
+// serve serves requests on listener until ctx is done. It then stops accepting
+// requests, waits for in-flight requests and drains the push queue, all within
+// the shutdown grace period.
+func (s *server) serve(ctx context.Context, listener net.Listener) error {
+	checkerCtx, stopChecker := context.WithCancel(context.Background())
+	defer stopChecker()
+	for _, checker := range s.checkers {
+		go checker.Run(checkerCtx)
+	}
 
-			//fmt.Printf("%s", body)
-			//fmt.Println(results)
-			//Rename
-			results, err = api.RenameKeys(results, config.Json.Rename)
-			if err != nil {
-				log.Error(err)
+	served := make(chan error, 1)
+	go func() {
+		if s.http.TLSConfig != nil {
+			// The certificate comes from TLSConfig.GetCertificate
+			served <- s.http.ServeTLS(listener, "", "")
+			return
+		}
+		served <- s.http.Serve(listener)
+	}()
+
+	select {
+	case err := <-served:
+		return err
+	case <-ctx.Done():
+	}
+
+	log.Infof("Shutting down, waiting up to %s for in-flight requests and %d queued events", s.config.App.ShutdownGracePeriod, s.pending())
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), s.config.App.ShutdownGracePeriod)
+	defer cancel()
+	if err := s.http.Shutdown(shutdownCtx); err != nil {
+		return fmt.Errorf("shutting down server: %v", err)
+	}
+	if err := s.fanout.Close(shutdownCtx); err != nil {
+		return fmt.Errorf("draining push queues: %v", err)
+	}
+	if err := <-served; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// handleReadyz reports whether all dependencies are healthy.
+func (s *server) handleReadyz(w http.ResponseWriter, request *http.Request) {
+	readiness := struct {
+		Ready        bool                            `json:"ready"`
+		Dependencies map[string]api.DependencyStatus `json:"dependencies"`
+	}{
+		Ready:        true,
+		Dependencies: map[string]api.DependencyStatus{},
+	}
+	for _, checker := range s.checkers {
+		status := checker.Status()
+		readiness.Dependencies[checker.Name] = status
+		readiness.Ready = readiness.Ready && status.Healthy
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if !readiness.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(readiness); err != nil {
+		log.Error(err)
+	}
+}
+
+// clientIP returns the address of the client. Behind a proxy that appends the
+// client address to X-Forwarded-For, trustForwardedFor uses its last entry.
+func (s *server) clientIP(r *http.Request) string {
+	if s.config.App.Limits.TrustForwardedFor {
+		if forwarded := r.Header.Values("X-Forwarded-For"); len(forwarded) > 0 {
+			hops := strings.Split(forwarded[len(forwarded)-1], ",")
+			if ip := strings.TrimSpace(hops[len(hops)-1]); ip != "" {
+				return ip
 			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// tooManyRequests answers 429 with the seconds until the next request is allowed.
+func tooManyRequests(w http.ResponseWriter, limit string, retryAfter time.Duration) {
+	helper.RequestsLimited.WithLabelValues(limit).Inc()
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+}
+
+// limitedByIP applies the per IP rate limit before handler, so it also covers
+// requests with invalid keys.
+func (s *server) limitedByIP(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ip := s.clientIP(r)
+		if allowed, retryAfter := s.perIP.Allow(ip, time.Now()); !allowed {
+			log.WithField("ip", ip).Warn("Rate limit per IP exceeded")
+			tooManyRequests(w, "ip", retryAfter)
+			return
+		}
+		handler(w, r)
+	}
+}
 
-			//Send to PushGW
-			if err := gw.PushMetrics(results); err != nil {
-				errMsg := fmt.Sprintf("Failed to push to Pushgateway: %v", err)
-				log.Error(errMsg)
-				http.Error(w, errMsg, http.StatusInternalServerError)
+// authenticated checks the bearer token against the key store before calling handler
+// with the key name. endpoint is the scope the key must allow.
+func (s *server) authenticated(endpoint string, handler func(http.ResponseWriter, *http.Request, string)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		authHeader := r.Header.Get("Authorization")
+		if authHeader == "" {
+			helper.SetAuthResult(w, helper.AuthMissing, "")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		name, err := "", api.ErrUnknownKey
+		if token, ok := strings.CutPrefix(authHeader, "Bearer "); ok {
+			name, err = s.keys.Authenticate(token, endpoint, time.Now())
+		}
+		logger := log.WithField("key", name)
+		switch {
+		case errors.Is(err, api.ErrKeyExpired):
+			logger.Warn("Request with expired API key")
+			helper.SetAuthResult(w, helper.AuthExpired, name)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		case errors.Is(err, api.ErrKeyForbidden):
+			logger.Warnf("API key not allowed on %s", endpoint)
+			helper.SetAuthResult(w, helper.AuthForbidden, name)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		case err != nil:
+			helper.SetAuthResult(w, helper.AuthInvalid, "")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		helper.SetAuthResult(w, helper.AuthOK, name)
+		handler(w, r, name)
+	}
+}
+
+// handlePush runs a webhook payload through the pipeline and queues the event.
+func (s *server) handlePush(w http.ResponseWriter, r *http.Request, key string) {
+	logger := log.WithField("key", key)
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST method is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	if allowed, retryAfter := s.perKey.Allow(key, time.Now()); !allowed {
+		logger.Warn("Rate limit per API key exceeded")
+		tooManyRequests(w, "key", retryAfter)
+		return
+	}
+
+	if s.config.App.Limits.MaxBodyBytes > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, s.config.App.Limits.MaxBodyBytes)
+	}
+	body, err := io.ReadAll(r.Body)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		logger.Warnf("Request body larger than %d bytes", tooLarge.Limit)
+		helper.RequestsLimited.WithLabelValues("body_size").Inc()
+		http.Error(w, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Unable to read request body", http.StatusInternalServerError)
+		return
+	}
+	defer func(Body io.ReadCloser) {
+		err := Body.Close()
+		if err != nil {
+			logger.Error("Error closing body")
+		}
+	}(r.Body)
+
+	// Transform, extract, filter and rename
+	ev, err := currentPipeline().process(body)
+	if err != nil {
+		logger.Error(err)
+		helper.EventsDropped.WithLabelValues("invalid").Inc()
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if !ev.accepted {
+		logger.Infof("Event filtered: %s", ev.rejection.Reason)
+		helper.EventsFiltered.WithLabelValues("", ev.rejection.Rule).Inc()
+		w.Header().Set("X-Event-Status", "filtered")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	// Retried deliveries are answered without pushing the event again
+	var claimed string
+	if s.dedup != nil {
+		if id, ok := s.dedup.Key(r.Header, ev.document); ok {
+			if !s.dedup.Claim(id, time.Now()) {
+				logger.Info("Duplicate event")
+				helper.EventsDropped.WithLabelValues("duplicate").Inc()
+				w.Header().Set("X-Event-Status", "duplicate")
+				w.Header().Set("Content-Type", "application/json")
+				if err := json.NewEncoder(w).Encode(map[string]bool{"duplicate": true}); err != nil {
+					logger.Error(err)
+				}
 				return
 			}
+			claimed = id
+		}
+	}
+	// release allows a retry of an event that was not accepted or whose push
+	// failed. Only the first release counts, a later one would release the claim
+	// of a retry.
+	var releaseOnce sync.Once
+	release := func() {
+		if claimed != "" {
+			releaseOnce.Do(func() { s.dedup.Release(claimed) })
+		}
+	}
 
-			log.Info("Successfully pushed data to Pushgateway")
-
-			//fmt.Println(results)
-		})
-		log.Infof("Server is running on http://localhost:%d", config.App.Port)
-		log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", config.App.Port), nil))
+	// All samples are checked before any value is recorded, so rejected events use
+	// up no values
+	labelSets := make([]map[string]string, len(ev.samples))
+	for i, sample := range ev.samples {
+		labelSets[i] = sample.Labels
+	}
+	if err := s.limiter.Check(labelSets...); err != nil {
+		release()
+		logger.Warnf("Event rejected: %v", err)
+		helper.EventsDropped.WithLabelValues("cardinality").Inc()
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	for i, sample := range ev.samples {
+		ev.samples[i].Labels = s.limiter.Commit(sample.Labels)
+	}
 
-	},
+	// Queue for the sinks
+	received := time.Now()
+	for i := range ev.samples {
+		ev.samples[i].Timestamp = received
+	}
+	done := func(err error) {
+		if err != nil {
+			release()
+		}
+	}
+	dispatched, err := s.fanout.Dispatch(api.Event{Fields: ev.fields, Labels: ev.labels, Env: ev.env, Samples: ev.samples, Received: received, Key: key, Done: done})
+	for sink, rejection := range dispatched.Filtered {
+		logger.Debugf("Event filtered by sink %s: %s", sink, rejection.Reason)
+		helper.EventsFiltered.WithLabelValues(sink, rejection.Rule).Inc()
+	}
+	for sink, err := range dispatched.Failed {
+		logger.Warnf("Event rejected by sink %s: %v", sink, err)
+		reason := "invalid"
+		if errors.Is(err, api.ErrQueueFull) || errors.Is(err, api.ErrQueueClosed) {
+			reason = "queue_full"
+		}
+		helper.EventsDropped.WithLabelValues(reason).Inc()
+	}
+	// Spacelift only redelivers failed requests, so an event a sink could not take
+	// fails the request even if other sinks queued it
+	if err != nil {
+		release()
+		if len(dispatched.Queued) > 0 {
+			logger.WithField("sinks", dispatched.Queued).Warn("Event queued for some sinks only")
+		}
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if len(dispatched.Queued) == 0 {
+		release()
+		logger.Info("Event filtered by all sinks")
+		w.Header().Set("X-Event-Status", "filtered")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	logger.WithField("sinks", dispatched.Queued).Info("Event queued")
+	w.Header().Set("X-Event-Status", "queued")
+	w.WriteHeader(http.StatusAccepted)
 }
 
 func init() {
@@ -0,0 +1,541 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"spacelift-pushgateway/api"
+	"spacelift-pushgateway/helper"
+)
+
+// newTestServer loads the pipeline of c and returns the server with its handler.
+// The queue size, readiness interval, target metric and API key default to values
+// for tests, the key is "Bearer test-key".
+func newTestServer(t *testing.T, c Config) (*server, http.Handler) {
+	if c.App.Queue.Size == 0 {
+		c.App.Queue.Size = 10
+	}
+	if c.App.Readiness.Interval == 0 {
+		c.App.Readiness.Interval = time.Minute
+	}
+	if c.Prometheus.TargetMetric == "" {
+		c.Prometheus.TargetMetric = "spacelift_run"
+	}
+	if len(c.Auth.Keys) == 0 {
+		c.Auth.Keys = []api.APIKey{{Name: "test", Key: "test-key"}}
+	}
+	p, err := newPipeline(c)
+	require.NoError(t, err)
+	eventPipeline.Store(p)
+	s, err := newServer(c)
+	require.NoError(t, err)
+	// Stops the workers of the sinks, also if the test closed the fan-out already
+	t.Cleanup(func() { s.fanout.Close(context.Background()) })
+	return s, s.routes()
+}
+
+func TestServerShutdownDrainsAcceptedEvents(t *testing.T) {
+	// A slow Pushgateway, so events are still queued when the shutdown starts
+	var pushes atomic.Int32
+	pushGateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut {
+			time.Sleep(20 * time.Millisecond)
+			pushes.Add(1)
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer pushGateway.Close()
+
+	var c Config
+	c.App.ShutdownGracePeriod = 10 * time.Second
+	c.App.Queue.Size = 100
+	c.App.Queue.Workers = 1
+	c.Json.FieldsToExtract = []api.Field{{Path: "$.run"}}
+	c.Prometheus.PushGatewayUrl = pushGateway.URL
+	c.Prometheus.JobName = "test"
+	s, _ := newTestServer(t, c)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	ctx, shutdown := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- s.serve(ctx, listener)
+	}()
+
+	url := fmt.Sprintf("http://%s/push", listener.Addr())
+	var (
+		wg       sync.WaitGroup
+		accepted atomic.Int32
+	)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			request, _ := http.NewRequest(http.MethodPost, url, strings.NewReader(fmt.Sprintf(`{"run": "%d"}`, i)))
+			request.Header.Set("Authorization", "Bearer test-key")
+			response, err := http.DefaultClient.Do(request)
+			if err != nil {
+				// Requests arriving after the listener closed are not accepted
+				return
+			}
+			response.Body.Close()
+			if response.StatusCode == http.StatusAccepted {
+				accepted.Add(1)
+			}
+		}(i)
+	}
+
+	// Shut down as soon as the first events are accepted, while most are still queued
+	assert.Eventually(t, func() bool { return accepted.Load() >= 5 }, 5*time.Second, time.Millisecond)
+	shutdown()
+	require.NoError(t, <-served)
+	wg.Wait()
+
+	assert.Greater(t, accepted.Load(), int32(0))
+	assert.Equal(t, accepted.Load(), pushes.Load(), "every accepted event must be pushed")
+	assert.Equal(t, 0, s.pending())
+}
+
+func TestServerShutdownCancelsHungPushes(t *testing.T) {
+	// A receiver that accepts the request and never answers
+	started, canceled := make(chan struct{}, 1), make(chan struct{}, 1)
+	hung := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut {
+			return
+		}
+		// The server notices the canceled request only once the body is read
+		io.Copy(io.Discard, r.Body)
+		started <- struct{}{}
+		<-r.Context().Done()
+		canceled <- struct{}{}
+	}))
+	defer hung.Close()
+
+	var c Config
+	c.App.ShutdownGracePeriod = 100 * time.Millisecond
+	c.Json.FieldsToExtract = []api.Field{{Path: "$.state"}}
+	c.Sinks = []sinkConfig{{
+		Name:        "hung",
+		Pushgateway: pushgatewaySinkConfig{URL: hung.URL, JobName: "hung", Client: helper.HTTPClientConfig{Timeout: time.Hour}},
+		Queue:       queueConfig{Timeout: time.Hour},
+	}}
+	s, _ := newTestServer(t, c)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	ctx, shutdown := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- s.serve(ctx, listener)
+	}()
+
+	request, _ := http.NewRequest(http.MethodPost, fmt.Sprintf("http://%s/push", listener.Addr()), strings.NewReader(`{"state": "FINISHED"}`))
+	request.Header.Set("Authorization", "Bearer test-key")
+	response, err := http.DefaultClient.Do(request)
+	require.NoError(t, err)
+	response.Body.Close()
+	require.Equal(t, http.StatusAccepted, response.StatusCode)
+	<-started
+
+	shutdown()
+	select {
+	case err := <-served:
+		assert.ErrorContains(t, err, "1 events not pushed")
+	case <-time.After(5 * time.Second):
+		t.Fatal("the hung push blocks the shutdown")
+	}
+	select {
+	case <-canceled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the hung push is not canceled")
+	}
+	assert.Eventually(t, func() bool { return s.pending() == 0 }, 5*time.Second, 10*time.Millisecond, "the worker stops")
+}
+
+func TestServerAuthentication(t *testing.T) {
+	var c Config
+	c.Prometheus.PushGatewayUrl = "http://127.0.0.1:1"
+	c.Auth.Keys = []api.APIKey{
+		{Name: "spacelift", Key: "push-key", Endpoints: []string{"push"}},
+		{Name: "monitoring", Key: "status-key", Endpoints: []string{"status"}},
+		{Name: "old", Key: "old-key", ExpiresAt: time.Now().Add(-time.Hour)},
+	}
+	_, handler := newTestServer(t, c)
+
+	tests := []struct {
+		path          string
+		authorization string
+		expected      int
+	}{
+		{"/push", "", http.StatusUnauthorized},
+		{"/push", "Bearer wrong", http.StatusUnauthorized},
+		{"/push", "push-key", http.StatusUnauthorized},
+		{"/push", "Bearer old-key", http.StatusUnauthorized},
+		{"/push", "Bearer status-key", http.StatusForbidden},
+		{"/push", "Bearer push-key", http.StatusAccepted},
+		{"/status/cardinality", "Bearer push-key", http.StatusForbidden},
+		{"/status/cardinality", "Bearer status-key", http.StatusOK},
+		{"/healthz", "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path+" "+tt.authorization, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodPost, tt.path, strings.NewReader(`{}`))
+			if tt.authorization != "" {
+				request.Header.Set("Authorization", tt.authorization)
+			}
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, request)
+			assert.Equal(t, tt.expected, recorder.Code)
+		})
+	}
+}
+
+func TestServerLimits(t *testing.T) {
+	var c Config
+	c.App.Limits.MaxBodyBytes = 16
+	c.App.Limits.PerKey = api.RateLimit{Rate: 0.001, Burst: 2}
+	c.App.Limits.PerIP = api.RateLimit{Rate: 0.001, Burst: 4}
+	c.App.Limits.TrustForwardedFor = true
+	c.Prometheus.PushGatewayUrl = "http://127.0.0.1:1"
+	c.Auth.Keys = []api.APIKey{{Name: "a", Key: "key-a"}, {Name: "b", Key: "key-b"}}
+	_, handler := newTestServer(t, c)
+
+	tests := []struct {
+		name      string
+		key       string
+		forwarded string
+		body      string
+		expected  int
+	}{
+		{"too large", "key-a", "10.0.0.1", `{"run": "0123456789"}`, http.StatusRequestEntityTooLarge},
+		{"key a", "key-a", "10.0.0.1", `{}`, http.StatusAccepted},
+		{"key a burst exhausted", "key-a", "10.0.0.1", `{}`, http.StatusTooManyRequests},
+		{"key b", "key-b", "10.0.0.1", `{}`, http.StatusAccepted},
+		{"ip burst exhausted", "key-b", "10.0.0.1", `{}`, http.StatusTooManyRequests},
+		{"invalid key counts for ip", "wrong", "10.0.0.1", `{}`, http.StatusTooManyRequests},
+		{"other ip", "key-b", "proxy, 10.0.0.2", `{}`, http.StatusAccepted},
+	}
+	for _, tt := range tests {
+		request := httptest.NewRequest(http.MethodPost, "/push", strings.NewReader(tt.body))
+		request.Header.Set("Authorization", "Bearer "+tt.key)
+		request.Header.Set("X-Forwarded-For", tt.forwarded)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		assert.Equal(t, tt.expected, recorder.Code, tt.name)
+		if tt.expected == http.StatusTooManyRequests {
+			assert.NotEmpty(t, recorder.Header().Get("Retry-After"), tt.name)
+		}
+	}
+}
+
+func TestServerDeduplication(t *testing.T) {
+	pushGateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer pushGateway.Close()
+
+	var c Config
+	c.Json.FieldsToExtract = []api.Field{{Path: "$.state"}}
+	c.Prometheus.PushGatewayUrl = pushGateway.URL
+	c.Deduplication = api.Deduplication{Header: "X-Delivery-Id", Paths: []string{"$.run.id", "$.state"}}
+	_, handler := newTestServer(t, c)
+
+	tests := []struct {
+		name      string
+		delivery  string
+		body      string
+		expected  int
+		duplicate bool
+	}{
+		{"first delivery", "1", `{"run": {"id": "a"}, "state": "QUEUED"}`, http.StatusAccepted, false},
+		{"retry", "1", `{"run": {"id": "a"}, "state": "QUEUED"}`, http.StatusOK, true},
+		{"next delivery", "2", `{"run": {"id": "a"}, "state": "FINISHED"}`, http.StatusAccepted, false},
+		{"paths without header", "", `{"run": {"id": "b"}, "state": "QUEUED"}`, http.StatusAccepted, false},
+		{"paths retry", "", `{"run": {"id": "b"}, "state": "QUEUED"}`, http.StatusOK, true},
+		{"no key", "", `{"state": "QUEUED"}`, http.StatusAccepted, false},
+		{"no key again", "", `{"state": "QUEUED"}`, http.StatusAccepted, false},
+	}
+	for _, tt := range tests {
+		request := httptest.NewRequest(http.MethodPost, "/push", strings.NewReader(tt.body))
+		request.Header.Set("Authorization", "Bearer test-key")
+		if tt.delivery != "" {
+			request.Header.Set("X-Delivery-Id", tt.delivery)
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		assert.Equal(t, tt.expected, recorder.Code, tt.name)
+		if tt.duplicate {
+			assert.JSONEq(t, `{"duplicate": true}`, recorder.Body.String(), tt.name)
+			assert.Equal(t, "duplicate", recorder.Header().Get("X-Event-Status"), tt.name)
+		}
+	}
+}
+
+func TestServerReleasesClaimOfFailedPush(t *testing.T) {
+	pushGateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer pushGateway.Close()
+
+	var c Config
+	c.Json.FieldsToExtract = []api.Field{{Path: "$.state"}}
+	c.Deduplication = api.Deduplication{Header: "X-Delivery-Id"}
+	c.Sinks = []sinkConfig{{Pushgateway: pushgatewaySinkConfig{URL: pushGateway.URL, JobName: "job"}, Retry: api.Retry{MaxAttempts: 1}}}
+	s, handler := newTestServer(t, c)
+
+	deliver := func() int {
+		request := httptest.NewRequest(http.MethodPost, "/push", strings.NewReader(`{"state": "FAILED"}`))
+		request.Header.Set("Authorization", "Bearer test-key")
+		request.Header.Set("X-Delivery-Id", "1")
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		return recorder.Code
+	}
+	assert.Equal(t, http.StatusAccepted, deliver())
+	assert.Eventually(t, func() bool { return s.dedup.Len() == 0 }, 5*time.Second, 10*time.Millisecond, "the failed push releases the claim")
+	assert.Equal(t, http.StatusAccepted, deliver(), "a manual redelivery is pushed again")
+	require.NoError(t, s.fanout.Close(context.Background()))
+}
+
+// stageCount returns the number of observed durations of a pipeline stage.
+func stageCount(t *testing.T, stage string) uint64 {
+	families, err := helper.Registry.Gather()
+	require.NoError(t, err)
+	for _, family := range families {
+		if family.GetName() != "spacelift_pushgateway_stage_duration_seconds" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			if metric.GetLabel()[0].GetValue() == stage {
+				return metric.GetHistogram().GetSampleCount()
+			}
+		}
+	}
+	return 0
+}
+
+func TestPipelineObservesStages(t *testing.T) {
+	var c Config
+	c.Json.FieldsToExtract = []api.Field{{Path: "$.state"}}
+	c.Prometheus.TargetMetric = "spacelift_run"
+	p, err := newPipeline(c)
+	require.NoError(t, err)
+
+	stages := []string{"transform", "extract", "rename", "build"}
+	before := make(map[string]uint64)
+	for _, stage := range stages {
+		before[stage] = stageCount(t, stage)
+	}
+	ev, err := p.process([]byte(`{"state": "FINISHED"}`))
+	require.NoError(t, err)
+	require.True(t, ev.accepted)
+	require.NotEmpty(t, ev.samples)
+	for _, stage := range stages {
+		assert.Equal(t, before[stage]+1, stageCount(t, stage), stage)
+	}
+}
+
+func TestServerFansOutToSinks(t *testing.T) {
+	pushGateway := func(pushes *atomic.Int32) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodPut {
+				pushes.Add(1)
+			}
+			w.WriteHeader(http.StatusOK)
+		}))
+	}
+	var allPushes, failedPushes atomic.Int32
+	all := pushGateway(&allPushes)
+	defer all.Close()
+	failed := pushGateway(&failedPushes)
+	defer failed.Close()
+
+	var c Config
+	c.Json.FieldsToExtract = []api.Field{{Path: "$.state"}}
+	c.Sinks = []sinkConfig{
+		{Name: "all", Pushgateway: pushgatewaySinkConfig{URL: all.URL, JobName: "all"}},
+		{Name: "failed", Filters: []api.Filter{{Name: "failed-only", Field: "state", In: []string{"FAILED"}}}, Pushgateway: pushgatewaySinkConfig{URL: failed.URL, JobName: "failed"}},
+		{Name: "events", Type: "eventlog", EventLog: eventLogSinkConfig{Output: "file", Path: filepath.Join(t.TempDir(), "events.log")}},
+	}
+	s, handler := newTestServer(t, c)
+
+	for _, state := range []string{"FINISHED", "FAILED", "FINISHED"} {
+		request := httptest.NewRequest(http.MethodPost, "/push", strings.NewReader(fmt.Sprintf(`{"state": "%s"}`, state)))
+		request.Header.Set("Authorization", "Bearer test-key")
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		assert.Equal(t, http.StatusAccepted, recorder.Code, state)
+	}
+	require.NoError(t, s.fanout.Close(context.Background()))
+	assert.Equal(t, int32(3), allPushes.Load())
+	assert.Equal(t, int32(1), failedPushes.Load())
+	assert.Equal(t, float64(2), testutil.ToFloat64(helper.EventsFiltered.WithLabelValues("failed", "failed-only")))
+
+	events, err := os.ReadFile(c.Sinks[2].EventLog.Path)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(events)), "\n")
+	require.Len(t, lines, 3)
+	var document api.EventDocument
+	require.NoError(t, json.Unmarshal([]byte(lines[1]), &document))
+	assert.Equal(t, "test", document.Key)
+	assert.Equal(t, map[string]interface{}{"state": "FAILED"}, document.Fields)
+	assert.False(t, document.Timestamp.IsZero())
+}
+
+func TestServerFailsIfASinkCannotQueue(t *testing.T) {
+	started, block := make(chan struct{}, 3), make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-block
+	}))
+	defer slow.Close()
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer fast.Close()
+
+	var c Config
+	c.Json.FieldsToExtract = []api.Field{{Path: "$.state"}}
+	c.Deduplication = api.Deduplication{Header: "X-Delivery-Id"}
+	c.Sinks = []sinkConfig{
+		{Name: "slow", Pushgateway: pushgatewaySinkConfig{URL: slow.URL, JobName: "slow"}, Queue: queueConfig{Size: 1, Workers: 1}},
+		{Name: "fast", Pushgateway: pushgatewaySinkConfig{URL: fast.URL, JobName: "fast"}},
+	}
+	s, handler := newTestServer(t, c)
+
+	deliver := func(id string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(http.MethodPost, "/push", strings.NewReader(`{"state": "FINISHED"}`))
+		request.Header.Set("Authorization", "Bearer test-key")
+		request.Header.Set("X-Delivery-Id", id)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		return recorder
+	}
+	// The slow sink pushes the first event and holds the second one in its queue
+	assert.Equal(t, http.StatusAccepted, deliver("1").Code)
+	<-started
+	assert.Equal(t, http.StatusAccepted, deliver("2").Code)
+
+	recorder := deliver("3")
+	assert.Equal(t, http.StatusServiceUnavailable, recorder.Code, "queued for the fast sink only")
+	assert.Equal(t, "1", recorder.Header().Get("Retry-After"))
+	assert.Contains(t, recorder.Body.String(), "sink slow: push queue is full")
+	assert.Equal(t, 2, s.dedup.Len(), "the redelivery of the third event is not a duplicate")
+
+	close(block)
+	require.NoError(t, s.fanout.Close(context.Background()))
+}
+
+func TestServerForwardsWebhooks(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		bodies []string
+	)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		assert.Equal(t, api.Sign([]byte("webhook-secret"), body), r.Header.Get("X-Signature-256"))
+		mu.Lock()
+		defer mu.Unlock()
+		bodies = append(bodies, string(body))
+	}))
+	defer receiver.Close()
+	secretFile := filepath.Join(t.TempDir(), "secret")
+	require.NoError(t, os.WriteFile(secretFile, []byte("webhook-secret\n"), 0o600))
+
+	var c Config
+	c.Json.FieldsToExtract = []api.Field{{Path: "$.state"}, {Path: "$.stackId"}}
+	c.Sinks = []sinkConfig{{
+		Name: "slack",
+		Type: "webhook",
+		Webhook: webhookSinkConfig{
+			Targets:    []api.WebhookTarget{{URL: receiver.URL, Condition: `state == "FAILED"`}},
+			Template:   `{"text": "{{.stackId}} {{.state}}"}`,
+			SecretFile: secretFile,
+		},
+	}}
+	s, handler := newTestServer(t, c)
+
+	for _, state := range []string{"FINISHED", "FAILED"} {
+		request := httptest.NewRequest(http.MethodPost, "/push", strings.NewReader(fmt.Sprintf(`{"stackId": "infra", "state": "%s"}`, state)))
+		request.Header.Set("Authorization", "Bearer test-key")
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		assert.Equal(t, http.StatusAccepted, recorder.Code, state)
+	}
+	require.NoError(t, s.fanout.Close(context.Background()))
+	assert.Equal(t, []string{`{"text": "infra FAILED"}`}, bodies)
+}
+
+func TestNewServerReportsInvalidSinks(t *testing.T) {
+	tests := []struct {
+		name     string
+		sink     sinkConfig
+		expected string
+	}{
+		{"pushgateway without url", sinkConfig{Name: "nourl"}, "sink 0 (nourl): missing pushgateway.url"},
+		{"unknown type", sinkConfig{Name: "unknown", Type: "carrier-pigeon"}, "sink 0 (unknown): unknown type 'carrier-pigeon'"},
+		{"invalid filter", sinkConfig{Name: "filter", Filters: []api.Filter{{Action: "maybe"}}, Pushgateway: pushgatewaySinkConfig{URL: "http://localhost:9091"}}, "sink 0 (filter): filters"},
+		{"remote_write without url", sinkConfig{Type: "remote_write"}, "sink 0 (remote_write): missing remoteWrite.url"},
+		{"remote_write", sinkConfig{Type: "remote_write", RemoteWrite: remoteWriteSinkConfig{URL: "http://mimir:8080/api/v1/push"}}, ""},
+		{"otlp with unknown encoding", sinkConfig{Type: "otlp", OTLP: otlpSinkConfig{URL: "http://collector:4318/v1/metrics", Encoding: "xml"}}, "sink 0 (otlp): unknown encoding 'xml'"},
+		{"otlp", sinkConfig{Name: "otel", Type: "otlp", OTLP: otlpSinkConfig{URL: "http://collector:4318/v1/metrics", Encoding: "json"}}, ""},
+		{"otlp_traces without url", sinkConfig{Type: "otlp_traces"}, "sink 0 (otlp_traces): missing traces.url"},
+		{"otlp_traces", sinkConfig{Name: "runs", Type: "otlp_traces", Traces: tracesSinkConfig{URL: "http://collector:4318/v1/traces", Timeout: 2 * time.Hour}}, ""},
+		{"influxdb without url", sinkConfig{Type: "influxdb"}, "sink 0 (influxdb): missing influxDB.url"},
+		{"influxdb", sinkConfig{Type: "influxdb", InfluxDB: influxDBSinkConfig{URL: "http://influxdb:8086/api/v2/write?org=infra&bucket=spacelift"}}, ""},
+		{"statsd with unknown flavor", sinkConfig{Type: "statsd", StatsD: statsdSinkConfig{Address: "localhost:8125", Flavor: "graphite"}}, "sink 0 (statsd): unknown flavor 'graphite'"},
+		{"statsd", sinkConfig{Name: "datadog", Type: "statsd", StatsD: statsdSinkConfig{Address: "localhost:8125"}}, ""},
+		{"loki without url", sinkConfig{Type: "eventlog", EventLog: eventLogSinkConfig{Output: "loki"}}, "sink 0 (eventlog): eventLog: missing url"},
+		{"eventlog", sinkConfig{Name: "events", Type: "eventlog", EventLog: eventLogSinkConfig{Output: "file", Path: filepath.Join(t.TempDir(), "events.log"), MaxSizeMB: 10}}, ""},
+		{"webhook with invalid condition", sinkConfig{Type: "webhook", Webhook: webhookSinkConfig{Targets: []api.WebhookTarget{{URL: "http://localhost", Condition: "state =="}}}}, "sink 0 (webhook): webhook: target 0: failed to compile expression"},
+		{"webhook with two secrets", sinkConfig{Type: "webhook", Webhook: webhookSinkConfig{Targets: []api.WebhookTarget{{URL: "http://localhost"}}, Secret: "a", SecretFile: "/secret"}}, "sink 0 (webhook): webhook: secret and secretFile are mutually exclusive"},
+		{"webhook", sinkConfig{Name: "slack", Type: "webhook", Webhook: webhookSinkConfig{Targets: []api.WebhookTarget{{URL: "http://localhost"}}}}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var c Config
+			c.Auth.Keys = []api.APIKey{{Name: "test", Key: "test-key"}}
+			c.App.Readiness.Interval = time.Minute
+			c.Sinks = []sinkConfig{tt.sink}
+			s, err := newServer(c)
+			if tt.expected == "" {
+				require.NoError(t, err)
+				require.NoError(t, s.fanout.Close(context.Background()))
+				return
+			}
+			assert.ErrorContains(t, err, tt.expected)
+		})
+	}
+}
+
+func TestNewServerRefusesDefaultKey(t *testing.T) {
+	var c Config
+	_, err := newServer(c)
+	assert.ErrorContains(t, err, "no API keys configured")
+
+	c.Auth.Keys = []api.APIKey{{Name: "default", Key: api.DefaultAPIKey}}
+	_, err = newServer(c)
+	assert.ErrorContains(t, err, "uses the default key")
+}
+
+func TestNewServerRejectsReadinessInterval(t *testing.T) {
+	var c Config
+	c.Auth.Keys = []api.APIKey{{Name: "test", Key: "test-key"}}
+	for _, interval := range []time.Duration{0, -time.Second} {
+		c.App.Readiness.Interval = interval
+		_, err := newServer(c)
+		assert.ErrorContains(t, err, "invalid readiness config: interval must be positive")
+	}
+}
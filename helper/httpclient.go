@@ -0,0 +1,206 @@
+package helper
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HTTPClientConfig configures clients for the Pushgateway and other outgoing requests.
+// Timeout bounds a whole request, DialTimeout and TLSHandshakeTimeout the connection setup.
+// BasicAuth and the bearer token exclude each other; files are re-read when they change.
+// ProxyURL overrides the HTTP_PROXY/HTTPS_PROXY environment variables.
+type HTTPClientConfig struct {
+	Timeout             time.Duration
+	DialTimeout         time.Duration
+	TLSHandshakeTimeout time.Duration
+	BasicAuth           BasicAuth
+	BearerToken         string
+	BearerTokenFile     string
+	Headers             map[string]string
+	ProxyURL            string
+	TLS                 ClientTLSConfig
+}
+
+// BasicAuth holds the credentials for HTTP basic auth, the password either inline or in a file.
+type BasicAuth struct {
+	Username     string
+	Password     string
+	PasswordFile string
+}
+
+// ClientTLSConfig configures the TLS connection to a server. CAFile replaces the
+// system CAs, CertFile and KeyFile are presented as client certificate and reloaded
+// when they change.
+type ClientTLSConfig struct {
+	CAFile             string
+	CertFile           string
+	KeyFile            string
+	ServerName         string
+	InsecureSkipVerify bool
+}
+
+// NewHTTPClient builds a client from the config.
+func NewHTTPClient(c HTTPClientConfig) (*http.Client, error) {
+	if c.BasicAuth.Username != "" && (c.BearerToken != "" || c.BearerTokenFile != "") {
+		return nil, fmt.Errorf("basicAuth and bearer token are mutually exclusive")
+	}
+	if c.BearerToken != "" && c.BearerTokenFile != "" {
+		return nil, fmt.Errorf("bearerToken and bearerTokenFile are mutually exclusive")
+	}
+	if c.BasicAuth.Password != "" && c.BasicAuth.PasswordFile != "" {
+		return nil, fmt.Errorf("basicAuth password and passwordFile are mutually exclusive")
+	}
+
+	tlsConfig, err := newClientTLSConfig(c.TLS)
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	if c.DialTimeout > 0 {
+		transport.DialContext = (&net.Dialer{Timeout: c.DialTimeout, KeepAlive: 30 * time.Second}).DialContext
+	}
+	if c.TLSHandshakeTimeout > 0 {
+		transport.TLSHandshakeTimeout = c.TLSHandshakeTimeout
+	}
+	if c.ProxyURL != "" {
+		proxy, err := url.Parse(c.ProxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxyURL: %v", err)
+		}
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+
+	rt := &authRoundTripper{next: transport, headers: c.Headers, username: c.BasicAuth.Username}
+	switch {
+	case c.BasicAuth.PasswordFile != "":
+		rt.password, err = newReloadingFile(c.BasicAuth.PasswordFile)
+	case c.BasicAuth.Password != "":
+		rt.password = staticSecret(c.BasicAuth.Password)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("basicAuth: %v", err)
+	}
+	switch {
+	case c.BearerTokenFile != "":
+		rt.token, err = newReloadingFile(c.BearerTokenFile)
+	case c.BearerToken != "":
+		rt.token = staticSecret(c.BearerToken)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("bearerTokenFile: %v", err)
+	}
+	return &http.Client{Transport: rt, Timeout: c.Timeout}, nil
+}
+
+func newClientTLSConfig(c ClientTLSConfig) (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName:         c.ServerName,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+	}
+	if c.CAFile != "" {
+		pool, err := LoadCertPool(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	if c.CertFile != "" || c.KeyFile != "" {
+		if c.CertFile == "" || c.KeyFile == "" {
+			return nil, fmt.Errorf("certFile and keyFile must be set together")
+		}
+		reloader, err := NewCertReloader(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.GetClientCertificate = reloader.GetClientCertificate
+	}
+	return config, nil
+}
+
+// secret returns a credential, possibly re-reading it.
+type secret interface {
+	Get() (string, error)
+}
+
+type staticSecret string
+
+func (s staticSecret) Get() (string, error) {
+	return string(s), nil
+}
+
+// reloadingFile returns the trimmed content of a file, re-read when its modification time changes.
+type reloadingFile struct {
+	path string
+
+	mu      sync.Mutex
+	mod     time.Time
+	content string
+}
+
+func newReloadingFile(path string) (*reloadingFile, error) {
+	f := &reloadingFile{path: path}
+	if _, err := f.Get(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *reloadingFile) Get() (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return "", err
+	}
+	if info.ModTime().Equal(f.mod) {
+		return f.content, nil
+	}
+	content, err := os.ReadFile(f.path)
+	if err != nil {
+		return "", err
+	}
+	f.mod, f.content = info.ModTime(), strings.TrimSpace(string(content))
+	return f.content, nil
+}
+
+// authRoundTripper adds the configured headers and credentials to every request.
+type authRoundTripper struct {
+	next     http.RoundTripper
+	headers  map[string]string
+	username string
+	password secret
+	token    secret
+}
+
+func (rt *authRoundTripper) RoundTrip(request *http.Request) (*http.Response, error) {
+	request = request.Clone(request.Context())
+	for name, value := range rt.headers {
+		request.Header.Set(name, value)
+	}
+	if rt.username != "" {
+		var password string
+		if rt.password != nil {
+			var err error
+			if password, err = rt.password.Get(); err != nil {
+				return nil, fmt.Errorf("reading basic auth password: %v", err)
+			}
+		}
+		request.SetBasicAuth(rt.username, password)
+	}
+	if rt.token != nil {
+		token, err := rt.token.Get()
+		if err != nil {
+			return nil, fmt.Errorf("reading bearer token: %v", err)
+		}
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+	return rt.next.RoundTrip(request)
+}
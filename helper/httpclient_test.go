@@ -0,0 +1,143 @@
+package helper
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// echoServer answers with the Authorization and X-Tenant headers it received.
+func echoServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Authorization", r.Header.Get("Authorization"))
+		w.Header().Set("X-Tenant", r.Header.Get("X-Tenant"))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func get(t *testing.T, client *http.Client, url string) *http.Response {
+	t.Helper()
+	response, err := client.Get(url)
+	require.NoError(t, err)
+	response.Body.Close()
+	return response
+}
+
+func TestHTTPClientBasicAuthAndHeaders(t *testing.T) {
+	server := echoServer(t)
+	client, err := NewHTTPClient(HTTPClientConfig{
+		BasicAuth: BasicAuth{Username: "spacelift", Password: "secret"},
+		Headers:   map[string]string{"x-tenant": "infra"},
+	})
+	require.NoError(t, err)
+
+	response := get(t, client, server.URL)
+	assert.Equal(t, "Basic c3BhY2VsaWZ0OnNlY3JldA==", response.Header.Get("X-Authorization"))
+	assert.Equal(t, "infra", response.Header.Get("X-Tenant"))
+}
+
+func TestHTTPClientBearerTokenFileIsReread(t *testing.T) {
+	server := echoServer(t)
+	tokenFile := writeFile(t, t.TempDir(), "token", []byte("first\n"))
+	client, err := NewHTTPClient(HTTPClientConfig{BearerTokenFile: tokenFile})
+	require.NoError(t, err)
+	assert.Equal(t, "Bearer first", get(t, client, server.URL).Header.Get("X-Authorization"))
+
+	require.NoError(t, os.WriteFile(tokenFile, []byte("second"), 0600))
+	later := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(tokenFile, later, later))
+	assert.Equal(t, "Bearer second", get(t, client, server.URL).Header.Get("X-Authorization"))
+
+	require.NoError(t, os.Remove(tokenFile))
+	_, err = client.Get(server.URL)
+	assert.ErrorContains(t, err, "reading bearer token")
+}
+
+func TestHTTPClientMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	serverPEM, serverKeyPEM := ca.issue(t, "pushgateway", false)
+	serverCert, err := tls.X509KeyPair(serverPEM, serverKeyPEM)
+	require.NoError(t, err)
+	clientPEM, clientKeyPEM := ca.issue(t, "spacelift-pushgateway", true)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Client", r.TLS.PeerCertificates[0].Subject.CommonName)
+	}))
+	server.TLS = &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+	server.StartTLS()
+	defer server.Close()
+
+	client, err := NewHTTPClient(HTTPClientConfig{TLS: ClientTLSConfig{
+		CAFile:   writeFile(t, dir, "ca.crt", ca.pem),
+		CertFile: writeFile(t, dir, "tls.crt", clientPEM),
+		KeyFile:  writeFile(t, dir, "tls.key", clientKeyPEM),
+	}})
+	require.NoError(t, err)
+	assert.Equal(t, "spacelift-pushgateway", get(t, client, server.URL).Header.Get("X-Client"))
+
+	withoutCert, err := NewHTTPClient(HTTPClientConfig{TLS: ClientTLSConfig{CAFile: writeFile(t, dir, "ca.crt", ca.pem)}})
+	require.NoError(t, err)
+	_, err = withoutCert.Get(server.URL)
+	assert.Error(t, err)
+}
+
+func TestHTTPClientProxy(t *testing.T) {
+	var proxied string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = r.URL.String()
+	}))
+	defer proxy.Close()
+
+	client, err := NewHTTPClient(HTTPClientConfig{ProxyURL: proxy.URL})
+	require.NoError(t, err)
+	get(t, client, "http://pushgateway.invalid:9091/metrics")
+	assert.Equal(t, "http://pushgateway.invalid:9091/metrics", proxied)
+}
+
+func TestHTTPClientTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+	}))
+	defer server.Close()
+
+	client, err := NewHTTPClient(HTTPClientConfig{Timeout: 10 * time.Millisecond})
+	require.NoError(t, err)
+	_, err = client.Get(server.URL)
+	assert.ErrorContains(t, err, "Client.Timeout exceeded")
+}
+
+func TestNewHTTPClientErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   HTTPClientConfig
+		expected string
+	}{
+		{"basic auth and token", HTTPClientConfig{BasicAuth: BasicAuth{Username: "a"}, BearerToken: "t"}, "mutually exclusive"},
+		{"token and token file", HTTPClientConfig{BearerToken: "t", BearerTokenFile: "f"}, "mutually exclusive"},
+		{"missing token file", HTTPClientConfig{BearerTokenFile: "/nonexistent"}, "bearerTokenFile"},
+		{"cert without key", HTTPClientConfig{TLS: ClientTLSConfig{CertFile: "tls.crt"}}, "must be set together"},
+		{"invalid proxy", HTTPClientConfig{ProxyURL: "http://[::1"}, "invalid proxyURL"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewHTTPClient(tt.config)
+			assert.ErrorContains(t, err, tt.expected)
+		})
+	}
+}
@@ -0,0 +1,192 @@
+package helper
+
+import (
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Registry holds the metrics about the service itself. It is kept apart from the
+// default registry, which is used for label validation.
+var Registry = prometheus.NewRegistry()
+
+const metricsNamespace = "spacelift_pushgateway"
+
+var (
+	EventsFiltered = promauto.With(Registry).NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "events_filtered_total",
+		Help:      "Events that were not pushed because of a filter rule, by sink (empty for the global filters) and rule name or index.",
+	}, []string{"sink", "filter"})
+
+	EventsDropped = promauto.With(Registry).NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "events_dropped_total",
+		Help:      "Accepted requests whose event was not pushed, by reason.",
+	}, []string{"reason"})
+
+	HTTPRequests = promauto.With(Registry).NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests by handler, status code, authentication result and API key name.",
+	}, []string{"handler", "code", "auth", "key"})
+
+	RequestsLimited = promauto.With(Registry).NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "requests_limited_total",
+		Help:      "Requests rejected by a limit: the rate limits per ip and key, and the body_size limit.",
+	}, []string{"limit"})
+
+	StageDuration = promauto.With(Registry).NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "stage_duration_seconds",
+		Help:      "Duration of the pipeline stages transform, extract, rename, build and push.",
+		Buckets:   []float64{.0001, .0005, .001, .005, .01, .05, .1, .5, 1, 5},
+	}, []string{"stage"})
+
+	PushErrors = promauto.With(Registry).NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "push_errors_total",
+		Help:      "Failed pushes by sink and error type, after all retries.",
+	}, []string{"sink", "type"})
+
+	ConfigReloads = promauto.With(Registry).NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "config_reloads_total",
+		Help:      "Config reloads by result.",
+	}, []string{"result"})
+
+	ConfigLastReloadSuccessful = promauto.With(Registry).NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "config_last_reload_successful",
+		Help:      "Whether the last config reload succeeded.",
+	})
+
+	ConfigLastReloadSuccess = promauto.With(Registry).NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "config_last_reload_success_timestamp_seconds",
+		Help:      "Timestamp of the last successful config load.",
+	})
+)
+
+// queueDepths reports the events waiting per sink, see SetQueueDepths.
+var queueDepths atomic.Pointer[func() map[string]int]
+
+var pushQueueDepthDesc = prometheus.NewDesc(
+	prometheus.BuildFQName(metricsNamespace, "", "push_queue_depth"),
+	"Events waiting to be pushed, by sink.",
+	[]string{"sink"}, nil,
+)
+
+// queueDepthCollector reads the queue depths on every scrape, so they are exact.
+type queueDepthCollector struct{}
+
+func (queueDepthCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- pushQueueDepthDesc
+}
+
+func (queueDepthCollector) Collect(ch chan<- prometheus.Metric) {
+	depths := queueDepths.Load()
+	if depths == nil {
+		return
+	}
+	for sink, depth := range (*depths)() {
+		ch <- prometheus.MustNewConstMetric(pushQueueDepthDesc, prometheus.GaugeValue, float64(depth), sink)
+	}
+}
+
+// SetQueueDepths sets the function reporting the events waiting per sink.
+func SetQueueDepths(depths func() map[string]int) {
+	queueDepths.Store(&depths)
+}
+
+func init() {
+	Registry.MustRegister(
+		queueDepthCollector{},
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	ConfigLastReloadSuccessful.Set(1)
+	ConfigLastReloadSuccess.SetToCurrentTime()
+}
+
+// ObserveStage records the duration of a pipeline stage started at start.
+func ObserveStage(stage string, start time.Time) {
+	StageDuration.WithLabelValues(stage).Observe(time.Since(start).Seconds())
+}
+
+// ConfigReloaded records the result of a config reload.
+func ConfigReloaded(err error) {
+	if err != nil {
+		ConfigReloads.WithLabelValues("failure").Inc()
+		ConfigLastReloadSuccessful.Set(0)
+		return
+	}
+	ConfigReloads.WithLabelValues("success").Inc()
+	ConfigLastReloadSuccessful.Set(1)
+	ConfigLastReloadSuccess.SetToCurrentTime()
+}
+
+// MetricsHandler serves the metrics of Registry.
+func MetricsHandler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{Registry: Registry})
+}
+
+// Authentication results for HTTPRequests.
+const (
+	AuthNone      = "none"
+	AuthOK        = "ok"
+	AuthMissing   = "missing"
+	AuthInvalid   = "invalid"
+	AuthExpired   = "expired"
+	AuthForbidden = "forbidden"
+)
+
+type instrumentedWriter struct {
+	http.ResponseWriter
+	status int
+	auth   string
+	key    string
+}
+
+func (w *instrumentedWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *instrumentedWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// InstrumentHandler counts the requests of a handler in HTTPRequests. Handlers that
+// authenticate requests report the result with SetAuthResult.
+func InstrumentHandler(name string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		iw := &instrumentedWriter{ResponseWriter: w, auth: AuthNone}
+		handler(iw, r)
+		if iw.status == 0 {
+			iw.status = http.StatusOK
+		}
+		HTTPRequests.WithLabelValues(name, strconv.Itoa(iw.status), iw.auth, iw.key).Inc()
+	}
+}
+
+// SetAuthResult records the authentication result and the name of the API key, if
+// known, of a request served by InstrumentHandler.
+func SetAuthResult(w http.ResponseWriter, result, key string) {
+	if iw, ok := w.(*instrumentedWriter); ok {
+		iw.auth = result
+		iw.key = key
+	}
+}
@@ -0,0 +1,39 @@
+package helper
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInstrumentHandler(t *testing.T) {
+	handler := InstrumentHandler("test", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") == "" {
+			SetAuthResult(w, AuthMissing, "")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		SetAuthResult(w, AuthOK, "spacelift")
+		w.Write([]byte("OK"))
+	})
+
+	handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/", nil))
+	request := httptest.NewRequest(http.MethodPost, "/", nil)
+	request.Header.Set("Authorization", "Bearer key")
+	handler(httptest.NewRecorder(), request)
+	handler(httptest.NewRecorder(), request)
+
+	assert.Equal(t, float64(1), testutil.ToFloat64(HTTPRequests.WithLabelValues("test", "401", AuthMissing, "")))
+	assert.Equal(t, float64(2), testutil.ToFloat64(HTTPRequests.WithLabelValues("test", "200", AuthOK, "spacelift")))
+}
+
+func TestConfigReloaded(t *testing.T) {
+	ConfigReloaded(assert.AnError)
+	assert.Equal(t, float64(0), testutil.ToFloat64(ConfigLastReloadSuccessful))
+	ConfigReloaded(nil)
+	assert.Equal(t, float64(1), testutil.ToFloat64(ConfigLastReloadSuccessful))
+	assert.Equal(t, float64(1), testutil.ToFloat64(ConfigReloads.WithLabelValues("failure")))
+}
@@ -0,0 +1,169 @@
+package helper
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ServerTLSConfig configures HTTPS for the web server. TLS is enabled when CertFile is set.
+// With ClientCAFile, clients must present a certificate signed by one of its CAs;
+// ClientAuth relaxes this ("request", "require", "verify_if_given" or "require_and_verify",
+// the default). MinVersion is "1.2" (default) or "1.3".
+type ServerTLSConfig struct {
+	CertFile     string
+	KeyFile      string
+	ClientCAFile string
+	ClientAuth   string
+	MinVersion   string
+}
+
+// Enabled reports whether TLS is configured.
+func (c ServerTLSConfig) Enabled() bool {
+	return c.CertFile != ""
+}
+
+var clientAuthTypes = map[string]tls.ClientAuthType{
+	"request":            tls.RequestClientCert,
+	"require":            tls.RequireAnyClientCert,
+	"verify_if_given":    tls.VerifyClientCertIfGiven,
+	"require_and_verify": tls.RequireAndVerifyClientCert,
+}
+
+// ParseTLSVersion parses "1.2" or "1.3"; an empty string means TLS 1.2.
+func ParseTLSVersion(version string) (uint16, error) {
+	switch version {
+	case "", "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("unsupported TLS version '%s', expected 1.2 or 1.3", version)
+}
+
+// NewServerTLSConfig builds the tls.Config for the web server. The certificate is
+// reloaded when its files change, see CertReloader.
+func NewServerTLSConfig(c ServerTLSConfig) (*tls.Config, error) {
+	if c.KeyFile == "" {
+		return nil, fmt.Errorf("keyFile is required with certFile")
+	}
+	minVersion, err := ParseTLSVersion(c.MinVersion)
+	if err != nil {
+		return nil, err
+	}
+	reloader, err := NewCertReloader(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		MinVersion:     minVersion,
+		GetCertificate: reloader.GetCertificate,
+	}
+
+	if c.ClientCAFile != "" {
+		pool, err := LoadCertPool(c.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	if c.ClientAuth != "" {
+		clientAuth, ok := clientAuthTypes[c.ClientAuth]
+		if !ok {
+			return nil, fmt.Errorf("unknown clientAuth '%s'", c.ClientAuth)
+		}
+		if config.ClientCAs == nil && (clientAuth == tls.VerifyClientCertIfGiven || clientAuth == tls.RequireAndVerifyClientCert) {
+			return nil, fmt.Errorf("clientAuth '%s' needs a clientCAFile", c.ClientAuth)
+		}
+		config.ClientAuth = clientAuth
+	}
+	return config, nil
+}
+
+// LoadCertPool reads PEM encoded CA certificates.
+func LoadCertPool(file string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("reading CA file: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", file)
+	}
+	return pool, nil
+}
+
+// CertReloader serves a certificate and reloads it when the modification time of
+// the certificate or key file changes. A broken certificate is logged and the
+// previous one stays in use, so a half-written update does not break the server.
+type CertReloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	certMod time.Time
+	keyMod  time.Time
+}
+
+// NewCertReloader loads the certificate and key.
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	r := &CertReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *CertReloader) modTimes() (time.Time, time.Time, error) {
+	certInfo, err := os.Stat(r.certFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	keyInfo, err := os.Stat(r.keyFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	return certInfo.ModTime(), keyInfo.ModTime(), nil
+}
+
+func (r *CertReloader) reload() error {
+	certMod, keyMod, err := r.modTimes()
+	if err != nil {
+		return fmt.Errorf("loading certificate: %v", err)
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("loading certificate: %v", err)
+	}
+	r.cert, r.certMod, r.keyMod = &cert, certMod, keyMod
+	return nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	certMod, keyMod, err := r.modTimes()
+	if err == nil && (!certMod.Equal(r.certMod) || !keyMod.Equal(r.keyMod)) {
+		if err := r.reload(); err != nil {
+			// Retry on the next change only
+			r.certMod, r.keyMod = certMod, keyMod
+			log.Errorf("Keeping the previous certificate: %v", err)
+		} else {
+			log.Infof("Reloaded certificate %s", r.certFile)
+		}
+	}
+	return r.cert, nil
+}
+
+// GetClientCertificate implements tls.Config.GetClientCertificate.
+func (r *CertReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return r.GetCertificate(nil)
+}
@@ -0,0 +1,239 @@
+package helper
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testCA issues certificates for tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns a PEM encoded certificate and key for 127.0.0.1 (server) or a client.
+func (ca *testCA) issue(t *testing.T, commonName string, client bool) ([]byte, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	if client {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+}
+
+func writeFile(t *testing.T, dir, name string, content []byte) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	require.NoError(t, os.WriteFile(path, content, 0600))
+	return path
+}
+
+// startTLSServer serves OK with the given TLS config and returns its URL.
+func startTLSServer(t *testing.T, config *tls.Config) string {
+	t.Helper()
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	}))
+	// StartTLS would add its own certificate, which takes precedence over GetCertificate
+	server.Listener = tls.NewListener(server.Listener, config)
+	server.Start()
+	t.Cleanup(server.Close)
+	return "https://" + server.Listener.Addr().String()
+}
+
+func tlsClient(t *testing.T, ca *testCA, clientCert *tls.Certificate, maxVersion uint16) *http.Client {
+	t.Helper()
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	config := &tls.Config{RootCAs: pool, MaxVersion: maxVersion}
+	if clientCert != nil {
+		config.Certificates = []tls.Certificate{*clientCert}
+	}
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: config, DisableKeepAlives: true}}
+}
+
+func TestServerTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	certPEM, keyPEM := ca.issue(t, "server", false)
+	certFile := writeFile(t, dir, "tls.crt", certPEM)
+	keyFile := writeFile(t, dir, "tls.key", keyPEM)
+
+	config, err := NewServerTLSConfig(ServerTLSConfig{CertFile: certFile, KeyFile: keyFile})
+	require.NoError(t, err)
+	url := startTLSServer(t, config)
+
+	response, err := tlsClient(t, ca, nil, 0).Get(url)
+	require.NoError(t, err)
+	response.Body.Close()
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+
+	_, err = http.Get(url)
+	assert.Error(t, err, "the certificate is not trusted by the system pool")
+}
+
+func TestServerMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	certPEM, keyPEM := ca.issue(t, "server", false)
+	clientPEM, clientKeyPEM := ca.issue(t, "spacelift", true)
+	clientCert, err := tls.X509KeyPair(clientPEM, clientKeyPEM)
+	require.NoError(t, err)
+	otherPEM, otherKeyPEM := newTestCA(t).issue(t, "stranger", true)
+	otherCert, err := tls.X509KeyPair(otherPEM, otherKeyPEM)
+	require.NoError(t, err)
+
+	config, err := NewServerTLSConfig(ServerTLSConfig{
+		CertFile:     writeFile(t, dir, "tls.crt", certPEM),
+		KeyFile:      writeFile(t, dir, "tls.key", keyPEM),
+		ClientCAFile: writeFile(t, dir, "ca.crt", ca.pem),
+	})
+	require.NoError(t, err)
+	url := startTLSServer(t, config)
+
+	response, err := tlsClient(t, ca, &clientCert, 0).Get(url)
+	require.NoError(t, err)
+	response.Body.Close()
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+
+	_, err = tlsClient(t, ca, nil, 0).Get(url)
+	assert.Error(t, err, "clients without certificate are rejected")
+	_, err = tlsClient(t, ca, &otherCert, 0).Get(url)
+	assert.Error(t, err, "clients with a certificate of another CA are rejected")
+}
+
+func TestServerTLSMinVersion(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	certPEM, keyPEM := ca.issue(t, "server", false)
+
+	config, err := NewServerTLSConfig(ServerTLSConfig{
+		CertFile:   writeFile(t, dir, "tls.crt", certPEM),
+		KeyFile:    writeFile(t, dir, "tls.key", keyPEM),
+		MinVersion: "1.3",
+	})
+	require.NoError(t, err)
+	url := startTLSServer(t, config)
+
+	_, err = tlsClient(t, ca, nil, tls.VersionTLS12).Get(url)
+	assert.Error(t, err)
+	response, err := tlsClient(t, ca, nil, tls.VersionTLS13).Get(url)
+	require.NoError(t, err)
+	response.Body.Close()
+}
+
+func TestServerTLSReloadsCertificate(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	certPEM, keyPEM := ca.issue(t, "first", false)
+	certFile := writeFile(t, dir, "tls.crt", certPEM)
+	keyFile := writeFile(t, dir, "tls.key", keyPEM)
+
+	config, err := NewServerTLSConfig(ServerTLSConfig{CertFile: certFile, KeyFile: keyFile})
+	require.NoError(t, err)
+	url := startTLSServer(t, config)
+	client := tlsClient(t, ca, nil, 0)
+
+	servedName := func() string {
+		response, err := client.Get(url)
+		require.NoError(t, err)
+		response.Body.Close()
+		return response.TLS.PeerCertificates[0].Subject.CommonName
+	}
+	assert.Equal(t, "first", servedName())
+
+	// A broken update keeps the previous certificate
+	writeFile(t, dir, "tls.crt", []byte("garbage"))
+	later := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(certFile, later, later))
+	assert.Equal(t, "first", servedName())
+
+	certPEM, keyPEM = ca.issue(t, "second", false)
+	writeFile(t, dir, "tls.crt", certPEM)
+	writeFile(t, dir, "tls.key", keyPEM)
+	later = later.Add(time.Minute)
+	require.NoError(t, os.Chtimes(certFile, later, later))
+	require.NoError(t, os.Chtimes(keyFile, later, later))
+	assert.Equal(t, "second", servedName())
+}
+
+func TestNewServerTLSConfigErrors(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	certPEM, keyPEM := ca.issue(t, "server", false)
+	certFile := writeFile(t, dir, "tls.crt", certPEM)
+	keyFile := writeFile(t, dir, "tls.key", keyPEM)
+
+	tests := []struct {
+		name     string
+		config   ServerTLSConfig
+		expected string
+	}{
+		{"missing key", ServerTLSConfig{CertFile: certFile}, "keyFile is required"},
+		{"unknown version", ServerTLSConfig{CertFile: certFile, KeyFile: keyFile, MinVersion: "1.0"}, "unsupported TLS version '1.0'"},
+		{"missing file", ServerTLSConfig{CertFile: filepath.Join(dir, "missing"), KeyFile: keyFile}, "loading certificate"},
+		{"invalid CA", ServerTLSConfig{CertFile: certFile, KeyFile: keyFile, ClientCAFile: keyFile}, "no certificates found"},
+		{"unknown client auth", ServerTLSConfig{CertFile: certFile, KeyFile: keyFile, ClientAuth: "always"}, "unknown clientAuth 'always'"},
+		{"verify without CA", ServerTLSConfig{CertFile: certFile, KeyFile: keyFile, ClientAuth: "verify_if_given"}, "needs a clientCAFile"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewServerTLSConfig(tt.config)
+			assert.ErrorContains(t, err, tt.expected)
+		})
+	}
+}